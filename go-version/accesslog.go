@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// AccessLog is a request log file rotated by size, and optionally on a fixed
+// interval, keeping a bounded number of old files
+type AccessLog struct {
+	file *lumberjack.Logger
+	stop chan struct{}
+	once sync.Once
+}
+
+// NewAccessLog opens (creating if needed) the access log at path; files are
+// rotated once they reach maxSizeMB, keeping at most maxBackups old files
+// for up to maxAgeDays (0 keeps them regardless of age)
+func NewAccessLog(path string, maxSizeMB, maxBackups, maxAgeDays int) *AccessLog {
+	return &AccessLog{
+		file: &lumberjack.Logger{
+			Filename:   path,
+			MaxSize:    maxSizeMB,
+			MaxBackups: maxBackups,
+			MaxAge:     maxAgeDays,
+		},
+		stop: make(chan struct{}),
+	}
+}
+
+// Write appends a log line, rotating first when the file is full
+func (a *AccessLog) Write(p []byte) (int, error) {
+	return a.file.Write(p)
+}
+
+// RotateEvery starts a new file on each tick until the log is closed,
+// blocking; a non-positive interval only rotates by size
+func (a *AccessLog) RotateEvery(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := a.file.Rotate(); err != nil {
+				log.Printf("Access log: rotation failed: %v", err)
+			}
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// Close stops interval rotation and closes the current file. Writes are
+// unbuffered, so every line written so far is already on disk.
+func (a *AccessLog) Close() error {
+	a.once.Do(func() { close(a.stop) })
+	return a.file.Close()
+}
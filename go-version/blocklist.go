@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Blocklist holds destination hosts that must not be redirected to.
+// Entries come from a file and/or env and can be changed at runtime;
+// blocking a host also blocks all of its subdomains.
+type Blocklist struct {
+	mu      sync.RWMutex
+	path    string
+	static  []string            // entries from env, applied on every load
+	hosts   map[string]struct{} // effective set
+	added   map[string]struct{} // runtime additions, survive reloads
+	removed map[string]struct{} // runtime removals, survive reloads
+	modTime time.Time
+}
+
+// NewBlocklist creates a blocklist backed by an optional file and static entries
+func NewBlocklist(path string, static []string) *Blocklist {
+	return &Blocklist{
+		path:    path,
+		static:  static,
+		hosts:   make(map[string]struct{}),
+		added:   make(map[string]struct{}),
+		removed: make(map[string]struct{}),
+	}
+}
+
+// normalizeHost lowercases a host and strips any port and trailing dot
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+}
+
+// Load (re)reads the blocklist file and rebuilds the effective set
+func (b *Blocklist) Load() error {
+	entries := append([]string(nil), b.static...)
+	var modTime time.Time
+
+	if b.path != "" {
+		f, err := os.Open(b.path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if info, err := f.Stat(); err == nil {
+			modTime = info.ModTime()
+		}
+
+		// One host per line, blank lines and # comments are ignored
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line, _, _ := strings.Cut(scanner.Text(), "#")
+			if line = strings.TrimSpace(line); line != "" {
+				entries = append(entries, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	hosts := make(map[string]struct{}, len(entries))
+	for _, entry := range entries {
+		if host := normalizeHost(entry); host != "" {
+			hosts[host] = struct{}{}
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for host := range b.added {
+		hosts[host] = struct{}{}
+	}
+	for host := range b.removed {
+		delete(hosts, host)
+	}
+	b.hosts = hosts
+	b.modTime = modTime
+	return nil
+}
+
+// Watch polls the blocklist file and reloads it whenever it changes
+func (b *Blocklist) Watch(interval time.Duration) {
+	if b.path == "" || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		info, err := os.Stat(b.path)
+		if err != nil {
+			log.Printf("Blocklist: unable to stat %s: %v", b.path, err)
+			continue
+		}
+
+		b.mu.RLock()
+		changed := !info.ModTime().Equal(b.modTime)
+		b.mu.RUnlock()
+
+		if changed {
+			if err := b.Load(); err != nil {
+				log.Printf("Blocklist: reload failed, keeping previous entries: %v", err)
+				continue
+			}
+			log.Printf("Blocklist: reloaded %d entries from %s", b.Len(), b.path)
+		}
+	}
+}
+
+// Add blocks a host at runtime
+func (b *Blocklist) Add(host string) bool {
+	host = normalizeHost(host)
+	if host == "" {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.hosts[host] = struct{}{}
+	b.added[host] = struct{}{}
+	delete(b.removed, host)
+	return true
+}
+
+// Remove unblocks a host at runtime, returning false if it wasn't blocked
+func (b *Blocklist) Remove(host string) bool {
+	host = normalizeHost(host)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, exists := b.hosts[host]; !exists {
+		return false
+	}
+	delete(b.hosts, host)
+	delete(b.added, host)
+	b.removed[host] = struct{}{}
+	return true
+}
+
+// IsBlockedHost reports whether a host or any of its parent domains is blocked
+func (b *Blocklist) IsBlockedHost(host string) bool {
+	host = normalizeHost(host)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.hosts) == 0 {
+		return false
+	}
+	for host != "" {
+		if _, blocked := b.hosts[host]; blocked {
+			return true
+		}
+		_, parent, found := strings.Cut(host, ".")
+		if !found {
+			break
+		}
+		host = parent
+	}
+	return false
+}
+
+// IsBlocked reports whether a destination URL points at a blocked host
+func (b *Blocklist) IsBlocked(rawURL string) bool {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	return b.IsBlockedHost(parsed.Host)
+}
+
+// Hosts returns the effective blocklist, sorted
+func (b *Blocklist) Hosts() []string {
+	b.mu.RLock()
+	hosts := make([]string, 0, len(b.hosts))
+	for host := range b.hosts {
+		hosts = append(hosts, host)
+	}
+	b.mu.RUnlock()
+
+	sort.Strings(hosts)
+	return hosts
+}
+
+// Len returns the number of blocked hosts
+func (b *Blocklist) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.hosts)
+}
+
+// privateHostLookupTimeout bounds the DNS lookup behind resolvesToPrivate
+const privateHostLookupTimeout = 2 * time.Second
+
+// isPrivateIP reports whether ip is loopback, link-local, unspecified or in a
+// private range (RFC 1918, IPv6 unique local)
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsPrivate() || ip.IsUnspecified()
+}
+
+// resolvesToPrivate reports whether a destination URL's host is, or resolves
+// to, a private address. Any private address among those a name resolves to
+// counts, since the client may pick any of them.
+func resolvesToPrivate(ctx context.Context, rawURL string) (bool, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return false, err
+	}
+	host := parsed.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		return isPrivateIP(ip), nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		if isPrivateIP(addr.IP) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// TrustedHosts is an escape hatch for internal destinations: its hosts skip
+// the destination scheme check at creation and the blocklist at redirect
+// time. Hosts match exactly, subdomains are not trusted. Empty by default.
+type TrustedHosts struct {
+	hosts map[string]struct{}
+}
+
+// NewTrustedHosts creates a trusted host set from static entries
+func NewTrustedHosts(entries []string) *TrustedHosts {
+	hosts := make(map[string]struct{}, len(entries))
+	for _, entry := range entries {
+		if host := normalizeHost(entry); host != "" {
+			hosts[host] = struct{}{}
+		}
+	}
+	return &TrustedHosts{hosts: hosts}
+}
+
+// Trusts reports whether a destination URL points at a trusted host. A nil
+// set trusts nothing.
+func (t *TrustedHosts) Trusts(rawURL string) bool {
+	if t == nil || len(t.hosts) == 0 {
+		return false
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Host == "" {
+		return false
+	}
+	_, trusted := t.hosts[normalizeHost(parsed.Host)]
+	return trusted
+}
+
+// Len returns the number of trusted hosts
+func (t *TrustedHosts) Len() int {
+	if t == nil {
+		return 0
+	}
+	return len(t.hosts)
+}
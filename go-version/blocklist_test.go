@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestBlocklistStopsExistingLinks(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN", "secret")
+	link := srv.shorten(t, `{"url": "https://spam.example/offer"}`)
+	other := srv.shorten(t, `{"url": "https://example.com/"}`)
+
+	if resp := srv.do(t, "GET", "/"+link.ShortCode, ""); resp.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("before blocking: status = %d, want %d", resp.StatusCode, http.StatusMovedPermanently)
+	}
+
+	resp := srv.do(t, "POST", "/api/admin/blocklist", `{"host": "SPAM.example"}`, "Authorization", "Bearer secret")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /api/admin/blocklist: status = %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+
+	resp = srv.do(t, "GET", "/"+link.ShortCode, "")
+	if resp.StatusCode != http.StatusForbidden || resp.Header.Get("Location") != "" {
+		t.Errorf("blocked link: status = %d, Location = %q; want %d without a redirect", resp.StatusCode, resp.Header.Get("Location"), http.StatusForbidden)
+	}
+	if resp := srv.do(t, "GET", "/"+other.ShortCode, ""); resp.StatusCode != http.StatusMovedPermanently {
+		t.Errorf("unrelated link: status = %d, want %d", resp.StatusCode, http.StatusMovedPermanently)
+	}
+
+	srv.do(t, "DELETE", "/api/admin/blocklist/spam.example", "", "Authorization", "Bearer secret")
+	if resp := srv.do(t, "GET", "/"+link.ShortCode, ""); resp.StatusCode != http.StatusMovedPermanently {
+		t.Errorf("after unblocking: status = %d, want %d", resp.StatusCode, http.StatusMovedPermanently)
+	}
+}
+
+func TestBlocklistMatchesHostAndSubdomains(t *testing.T) {
+	blocklist := NewBlocklist("", []string{"bad.example"})
+	if err := blocklist.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	tests := map[string]bool{
+		"https://bad.example/x":              true,
+		"https://BAD.example:8443/":          true,
+		"https://sub.bad.example/":           true,
+		"https://example.com/?u=bad.example": false,
+	}
+	for destination, want := range tests {
+		if got := blocklist.IsBlocked(destination); got != want {
+			t.Errorf("IsBlocked(%q) = %v, want %v", destination, got, want)
+		}
+	}
+}
+
+func TestTrustedHostsSkipPrivateAndBlocklistChecks(t *testing.T) {
+	srv := newTestServer(t, "BLOCK_PRIVATE_HOSTS", "true", "BLOCKLIST", "docs.internal", "TRUSTED_HOSTS", "10.0.0.5, docs.internal")
+
+	for _, url := range []string{"http://10.0.0.5/wiki", "ftp://10.0.0.5/file", "http://DOCS.internal/guide"} {
+		link := srv.shorten(t, `{"url": "`+url+`"}`)
+		if resp := srv.do(t, "GET", "/"+link.ShortCode, ""); resp.StatusCode != http.StatusMovedPermanently {
+			t.Errorf("trusted %s: redirect status = %d, want %d", url, resp.StatusCode, http.StatusMovedPermanently)
+		}
+	}
+
+	// Only the listed hosts are exempt, not their neighbours
+	for _, url := range []string{"http://10.0.0.6/wiki", "http://127.0.0.1/", "ftp://10.0.0.6/file"} {
+		if resp := srv.do(t, "POST", "/api/shorten", `{"url": "`+url+`"}`); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("untrusted %s: status = %d, want %d", url, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
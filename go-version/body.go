@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gofiber/fiber/v2"
+)
+
+// defaultMaxDecodedBodySize caps how large a compressed request body may
+// inflate to, independently of BodyLimit which only sees the wire size
+const defaultMaxDecodedBodySize = 16 * 1024 * 1024 // 16MB
+
+// errBodyTooLarge is returned when a body inflates past the configured limit
+var errBodyTooLarge = errors.New("decoded request body too large")
+
+// errUnsupportedEncoding is returned for a Content-Encoding we can't undo
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// decodedBody returns the request body with any Content-Encoding undone,
+// never inflating more than limit bytes. c.Body() decompresses without a
+// bound, so endpoints accepting large payloads must go through this instead.
+func decodedBody(c *fiber.Ctx, limit int64) ([]byte, error) {
+	body := c.Request().Body()
+
+	// Encodings are listed in the order they were applied, so undo them in reverse
+	encodings := splitList(c.Get(fiber.HeaderContentEncoding))
+	for i := len(encodings) - 1; i >= 0; i-- {
+		var (
+			r   io.Reader
+			err error
+		)
+		switch encoding := strings.ToLower(encodings[i]); encoding {
+		case "identity":
+			continue
+		case "gzip", "x-gzip":
+			r, err = gzip.NewReader(bytes.NewReader(body))
+		case "deflate":
+			r, err = zlib.NewReader(bytes.NewReader(body)) // HTTP deflate is zlib-wrapped
+		case "br":
+			r = brotli.NewReader(bytes.NewReader(body))
+		default:
+			return nil, fmt.Errorf("%w %q", errUnsupportedEncoding, encoding)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if body, err = io.ReadAll(io.LimitReader(r, limit+1)); err != nil {
+			return nil, err
+		}
+		if int64(len(body)) > limit {
+			return nil, errBodyTooLarge
+		}
+	}
+
+	if int64(len(body)) > limit {
+		return nil, errBodyTooLarge
+	}
+	return body, nil
+}
+
+// sendBodyError answers a request whose body decodedBody refused with a
+// 413, 415 or 400
+func sendBodyError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": "Request body too large"})
+	case errors.Is(err, errUnsupportedEncoding):
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{"error": "Unsupported content encoding"})
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import "strings"
+
+// maxCodeSuggestions bounds the "did you mean" hints returned for a mistyped code
+const maxCodeSuggestions = 3
+
+// luhnCheckChar computes the Luhn mod N check character of code over alphabet.
+// It returns false when code contains a character outside the alphabet.
+func luhnCheckChar(code, alphabet string) (byte, bool) {
+	n := len(alphabet)
+	factor := 2
+	sum := 0
+	for i := len(code) - 1; i >= 0; i-- {
+		point := strings.IndexByte(alphabet, code[i])
+		if point < 0 {
+			return 0, false
+		}
+		addend := factor * point
+		sum += addend/n + addend%n
+		factor = 3 - factor // Alternate between 2 and 1
+	}
+	return alphabet[(n-sum%n)%n], true
+}
+
+// hasValidChecksum reports whether the last character of code is the check
+// character of the rest
+func hasValidChecksum(code, alphabet string) bool {
+	if len(code) < 2 {
+		return false
+	}
+	check, ok := luhnCheckChar(code[:len(code)-1], alphabet)
+	return ok && check == code[len(code)-1]
+}
+
+// ValidChecksum reports whether a requested short code passes the checksum.
+// Only codes of the generated length carry a check character; anything else,
+// such as codes created before checksums were enabled, is not checked.
+func (s *URLStore) ValidChecksum(shortCode string) bool {
+	if !s.checksum || len(shortCode) != s.codeLength+1 {
+		return true
+	}
+	return hasValidChecksum(s.key(shortCode), s.CodeAlphabet())
+}
+
+// SuggestCodes returns existing short codes one typo away from a code that
+// failed its checksum: a single substituted character or two swapped
+// neighbouring characters. Only URLs already in memory are suggested, so
+// a lazily loaded store doesn't query the persister for every candidate.
+func (s *URLStore) SuggestCodes(shortCode string) []string {
+	alphabet := s.CodeAlphabet()
+	code := []byte(s.key(shortCode))
+
+	suggestions := []string{}
+	seen := make(map[string]struct{})
+	try := func(candidate string) bool {
+		if _, dup := seen[candidate]; dup || !hasValidChecksum(candidate, alphabet) {
+			return true
+		}
+		seen[candidate] = struct{}{}
+		if value, exists := s.store.Load(candidate); exists && !value.(*URL).Deleted() {
+			suggestions = append(suggestions, value.(*URL).ShortCode)
+		}
+		return len(suggestions) < maxCodeSuggestions
+	}
+
+	for i := 0; i+1 < len(code); i++ {
+		code[i], code[i+1] = code[i+1], code[i]
+		more := try(string(code))
+		code[i], code[i+1] = code[i+1], code[i]
+		if !more {
+			return suggestions
+		}
+	}
+	for i := range code {
+		original := code[i]
+		for j := 0; j < len(alphabet); j++ {
+			if alphabet[j] == original {
+				continue
+			}
+			code[i] = alphabet[j]
+			more := try(string(code))
+			code[i] = original
+			if !more {
+				return suggestions
+			}
+		}
+	}
+	return suggestions
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// clickBufferSize bounds the clicks queued between redirects and the worker
+const clickBufferSize = 64 * 1024
+
+// Click is a single redirect to be counted
+type Click struct {
+	ShortCode string
+	Referrer  string    // Normalized referer host, empty to skip referrer tracking
+	UserAgent string    // Truncated User-Agent, empty to skip User-Agent tracking
+	At        time.Time // When the redirect happened, used for time-bucketed analytics
+	Preview   bool      // Fetched by a link preview crawler, counted as a preview hit only
+}
+
+// ClickRecorder funnels click increments from the redirect handler through a
+// buffered channel to a single worker, which applies them to the store in
+// batches every flush window. Close drains everything still queued, so no
+// clicks are lost on shutdown regardless of the window.
+type ClickRecorder struct {
+	store   *URLStore
+	window  time.Duration
+	clicks  chan Click
+	done    chan struct{}
+	pending atomic.Int64 // Recorded but not yet applied to the store
+
+	mu     sync.RWMutex // Held for reading while sending, so Close never closes under a sender
+	closed bool
+}
+
+// NewClickRecorder creates a recorder and starts its worker. A window of 0
+// applies each click as soon as the worker receives it.
+func NewClickRecorder(store *URLStore, window time.Duration) *ClickRecorder {
+	r := &ClickRecorder{
+		store:  store,
+		window: window,
+		clicks: make(chan Click, clickBufferSize),
+		done:   make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// Record queues a click, blocking only if the buffer is full. Once the
+// recorder is closed, clicks are applied to the store directly: a shutdown
+// that times out can leave handlers still running after Close.
+func (r *ClickRecorder) Record(click Click) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		r.store.RecordClick(click)
+		return
+	}
+	r.pending.Add(1)
+	r.clicks <- click
+}
+
+// Pending returns how many recorded clicks haven't been applied yet
+func (r *ClickRecorder) Pending() int64 {
+	return r.pending.Load()
+}
+
+// apply records a click in the store
+func (r *ClickRecorder) apply(click Click) {
+	r.store.RecordClick(click)
+	r.pending.Add(-1)
+}
+
+// Close stops queueing clicks and waits until every queued click is applied.
+// It is safe to call more than once.
+func (r *ClickRecorder) Close() {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.clicks)
+	}
+	r.mu.Unlock()
+	<-r.done
+}
+
+func (r *ClickRecorder) run() {
+	defer close(r.done)
+
+	if r.window <= 0 {
+		for click := range r.clicks {
+			r.apply(click)
+		}
+		return
+	}
+
+	ticker := time.NewTicker(r.window)
+	defer ticker.Stop()
+
+	pending := make([]Click, 0, 1024)
+	flush := func() {
+		for _, click := range pending {
+			r.apply(click)
+		}
+		pending = pending[:0]
+	}
+
+	for {
+		select {
+		case click, ok := <-r.clicks:
+			if !ok {
+				flush()
+				return
+			}
+			pending = append(pending, click)
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClickRecorderAcceptsClicksAfterClose(t *testing.T) {
+	store := NewURLStore()
+	url, _, err := store.Insert(newShortURL(&CreateURLRequest{URL: "https://example.com/late"}, time.Now()))
+	if err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+
+	recorder := NewClickRecorder(store, time.Hour)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recorder.Record(Click{ShortCode: url.ShortCode, At: time.Now()})
+		}()
+	}
+	recorder.Close()
+	wg.Wait()
+	recorder.Close()
+
+	if clicks := store.TotalClicks(); clicks != 100 {
+		t.Errorf("TotalClicks() = %d, want 100", clicks)
+	}
+	if pending := recorder.Pending(); pending != 0 {
+		t.Errorf("Pending() = %d after Close, want 0", pending)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	neturl "net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// CodeStrategy selects how short codes are generated for new links
+type CodeStrategy string
+
+const (
+	CodeStrategyRandom CodeStrategy = "random" // Random nanoid codes
+	CodeStrategyHash   CodeStrategy = "hash"   // Derived from the destination, same URL gets the same code
+)
+
+// ParseCodeStrategy validates a CODE_STRATEGY value
+func ParseCodeStrategy(value string) (CodeStrategy, error) {
+	switch CodeStrategy(strings.ToLower(value)) {
+	case "", CodeStrategyRandom:
+		return CodeStrategyRandom, nil
+	case CodeStrategyHash:
+		return CodeStrategyHash, nil
+	default:
+		return "", fmt.Errorf("must be %q or %q", CodeStrategyRandom, CodeStrategyHash)
+	}
+}
+
+// Bounds for CODE_LENGTH and CODE_ALPHABET
+const (
+	minCodeLength       = 3
+	maxCodeLength       = 32
+	minCodeAlphabetSize = 16
+)
+
+// CodeConfig controls the shape of generated short codes. It is read once at
+// startup; the zero Alphabet means the built-in one.
+type CodeConfig struct {
+	Length   int
+	Alphabet string
+}
+
+// ParseCodeConfig validates CODE_LENGTH and CODE_ALPHABET values. Empty values
+// keep the defaults. A custom alphabet is lowercased when codes are matched
+// case-insensitively, and must still have minCodeAlphabetSize distinct
+// characters afterwards.
+func ParseCodeConfig(length, alphabet string, foldCase bool) (CodeConfig, error) {
+	config := CodeConfig{Length: defaultCodeLength}
+	if length != "" {
+		n, err := strconv.Atoi(length)
+		if err != nil || n < minCodeLength || n > maxCodeLength {
+			return config, fmt.Errorf("CODE_LENGTH %q must be between %d and %d", length, minCodeLength, maxCodeLength)
+		}
+		config.Length = n
+	}
+	if alphabet == "" {
+		return config, nil
+	}
+
+	if foldCase {
+		alphabet = strings.ToLower(alphabet)
+	}
+	seen := make(map[rune]struct{}, len(alphabet))
+	var unique strings.Builder
+	for _, r := range alphabet {
+		if !customCodePattern.MatchString(string(r)) {
+			return config, fmt.Errorf("CODE_ALPHABET may only contain letters, digits, \"_\" and \"-\", got %q", r)
+		}
+		if _, dup := seen[r]; dup {
+			continue
+		}
+		seen[r] = struct{}{}
+		unique.WriteRune(r)
+	}
+	if unique.Len() < minCodeAlphabetSize {
+		return config, fmt.Errorf("CODE_ALPHABET must have at least %d distinct characters, got %d", minCodeAlphabetSize, unique.Len())
+	}
+	config.Alphabet = unique.String()
+	return config, nil
+}
+
+// normalizeDestination canonicalizes a URL for hashing so trivially different
+// spellings of the same destination (scheme/host case, default port, empty
+// path, fragment) map to the same code
+func normalizeDestination(rawURL string) string {
+	parsed, err := neturl.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	parsed.Host = strings.ToLower(parsed.Host)
+	if port := parsed.Port(); (parsed.Scheme == "http" && port == "80") || (parsed.Scheme == "https" && port == "443") {
+		parsed.Host = parsed.Hostname()
+	}
+	if parsed.Path == "" {
+		parsed.Path = "/"
+	}
+	parsed.Fragment = ""
+	parsed.RawFragment = ""
+	return parsed.String()
+}
+
+// hashDigits encodes sha256(destination + salt) in the given alphabet. Short
+// codes are prefixes of the result, so a collision can be resolved by taking
+// one more character.
+func hashDigits(destination, salt, alphabet string) string {
+	sum := sha256.Sum256([]byte(destination + salt))
+	n := new(big.Int).SetBytes(sum[:])
+	base := big.NewInt(int64(len(alphabet)))
+	mod := new(big.Int)
+
+	var digits []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, base, mod)
+		digits = append(digits, alphabet[mod.Int64()])
+	}
+	return string(digits)
+}
+
+// insertHashed stores url under a code derived from its destination. If the
+// destination was already shortened with the same settings the existing URL
+// is returned instead; a different destination, different settings, or a
+// link that can't be shared (soft-deleted, protected, expired or out of
+// clicks) on the prefix means a longer code.
+func (s *URLStore) insertHashed(url *URL) (*URL, bool) {
+	now := s.now()
+	// Base62 (base36 when case-insensitive), the alphabet without "_" and "-"
+	alphabet := strings.NewReplacer("_", "", "-", "").Replace(s.CodeAlphabet())
+	destination := normalizeDestination(url.OriginalURL)
+	digits := hashDigits(destination, s.codeSalt, alphabet)
+
+	for length := s.codeLength; length <= len(digits); length++ {
+		url.ShortCode = s.withCheckChar(digits[:length])
+		if s.lazy {
+			s.load(url.ShortCode) // The code may only be taken in the persister
+		}
+		existing, taken := s.store.LoadOrStore(s.key(url.ShortCode), url)
+		if !taken {
+			s.index(url.ShortCode, url)
+			return url, true
+		}
+		if existing := existing.(*URL); existing.Shareable(now) && existing.SameSettings(url) && normalizeDestination(existing.Destination()) == destination {
+			return existing, false
+		}
+	}
+	return nil, false
+}
+
+// customCodePattern is the shape of vanity codes chosen by clients
+var customCodePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// minAliasLength is the shortest custom code accepted
+const minAliasLength = 3
+
+// maxAliasLength is the longest custom code accepted, independent of the
+// length of generated codes; configured once at startup from MAX_ALIAS_LENGTH
+var maxAliasLength = 32
+
+// reservedCodes are first path segments served by routes other than the
+// redirect, compared case-insensitively; a link there would be unreachable
+var reservedCodes = map[string]struct{}{
+	"api":     {},
+	"static":  {},
+	"health":  {},
+	"ready":   {},
+	"metrics": {},
+	"docs":    {},
+}
+
+// validateCustomCode checks a client-chosen short code's shape and that it
+// doesn't shadow a route
+func validateCustomCode(code string) error {
+	if len(code) < minAliasLength || len(code) > maxAliasLength || !customCodePattern.MatchString(code) {
+		return &ValidationError{Field: "custom_code", Message: fmt.Sprintf("Custom code must be %d-%d letters, digits, '_' or '-'", minAliasLength, maxAliasLength), Reason: "invalid alias"}
+	}
+	if isReservedCode(code) {
+		return &ValidationError{Field: "custom_code", Message: "Custom code is reserved", Reason: "reserved alias"}
+	}
+	return nil
+}
+
+// isReservedCode reports whether a short code shadows a route
+func isReservedCode(code string) bool {
+	_, reserved := reservedCodes[strings.ToLower(code)]
+	return reserved
+}
+
+// InsertCustom stores url under a client-chosen short code, returning false
+// without storing anything if the code (compared in folded form) is taken
+func (s *URLStore) InsertCustom(url *URL, shortCode string) bool {
+	url.ShortCode = shortCode
+	return s.Add(shortCode, url) == nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newHashStore returns a store using hashed codes with a controllable clock
+func newHashStore(now *time.Time) *URLStore {
+	store := NewURLStore()
+	store.SetCodeStrategy(CodeStrategyHash, "test-salt")
+	store.SetClock(func() time.Time { return *now })
+	return store
+}
+
+func TestHashedCodeReusesLiveLink(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	store := newHashStore(&now)
+
+	first, created, err := store.Insert(newShortURL(&CreateURLRequest{URL: "https://example.com/page"}, now))
+	if err != nil || !created {
+		t.Fatalf("first Insert: created=%v err=%v", created, err)
+	}
+	second, created, err := store.Insert(newShortURL(&CreateURLRequest{URL: "https://example.com/page"}, now))
+	if err != nil || created || second != first {
+		t.Fatalf("second Insert returned %v (created=%v, err=%v), want the first link", second, created, err)
+	}
+}
+
+func TestHashedCodeSkipsStaleLinks(t *testing.T) {
+	tests := []struct {
+		name  string
+		req   CreateURLRequest
+		stale func(store *URLStore, url *URL, now *time.Time)
+	}{
+		{
+			name: "expired",
+			req:  CreateURLRequest{URL: "https://example.com/ttl", ExpiresIn: 60},
+			stale: func(_ *URLStore, _ *URL, now *time.Time) {
+				*now = now.Add(2 * time.Minute)
+			},
+		},
+		{
+			name: "soft-deleted",
+			req:  CreateURLRequest{URL: "https://example.com/deleted"},
+			stale: func(store *URLStore, url *URL, _ *time.Time) {
+				store.Delete(url.ShortCode)
+			},
+		},
+		{
+			name: "out of clicks",
+			req:  CreateURLRequest{URL: "https://example.com/once", MaxClicks: 1},
+			stale: func(store *URLStore, url *URL, _ *time.Time) {
+				store.ClaimClick(url)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+			store := newHashStore(&now)
+
+			old, _, err := store.Insert(newShortURL(&tt.req, now))
+			if err != nil {
+				t.Fatalf("Insert: %v", err)
+			}
+			tt.stale(store, old, &now)
+
+			fresh, created, err := store.Insert(newShortURL(&CreateURLRequest{URL: tt.req.URL, OwnerID: "new-owner"}, now))
+			if err != nil {
+				t.Fatalf("Insert after the link went stale: %v", err)
+			}
+			if !created || fresh == old {
+				t.Fatalf("Insert returned the stale link %s, want a new one", old.ShortCode)
+			}
+			if fresh.ShortCode == old.ShortCode || fresh.ShortCode[:len(old.ShortCode)] != old.ShortCode {
+				t.Errorf("new code %q should extend the stale code %q", fresh.ShortCode, old.ShortCode)
+			}
+			if fresh.Owner() != "new-owner" {
+				t.Errorf("new link owner = %q, want the request's owner", fresh.Owner())
+			}
+		})
+	}
+}
+
+func TestCaseInsensitiveStoreGeneratesLowercaseCodes(t *testing.T) {
+	store := NewURLStore()
+	store.SetCaseInsensitive(true)
+
+	for i := 0; i < 200; i++ {
+		code, err := store.NewShortCode()
+		if err != nil {
+			t.Fatalf("NewShortCode: %v", err)
+		}
+		if code != strings.ToLower(code) || len(code) != defaultCodeLength {
+			t.Fatalf("generated code %q, want %d lowercase characters", code, defaultCodeLength)
+		}
+	}
+}
+
+func TestCaseInsensitiveCollisionsUseFoldedCodes(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	store := NewURLStore()
+	store.SetCaseInsensitive(true)
+	if err := store.Add("abcdef", newShortURL(&CreateURLRequest{URL: "https://example.com/first"}, now)); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	// The first draw only differs from the stored code by case
+	codes := []string{"ABCDEF", "ghijkl"}
+	store.SetCodeGenerator(func(alphabet string, size int) (string, error) {
+		code := codes[0]
+		codes = codes[1:]
+		return code, nil
+	})
+
+	url := newShortURL(&CreateURLRequest{URL: "https://example.com/second"}, now)
+	if err := store.InsertRandom(url); err != nil {
+		t.Fatalf("InsertRandom: %v", err)
+	}
+	if url.ShortCode != "ghijkl" {
+		t.Errorf("short code = %q, want the second draw", url.ShortCode)
+	}
+	if first, ok := store.Get("ABCDEF"); !ok || first.OriginalURL != "https://example.com/first" {
+		t.Errorf("Get(ABCDEF) should find the first link")
+	}
+}
+
+func TestHashedCodesAreDeterministic(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	first, _, err := newHashStore(&now).Insert(newShortURL(&CreateURLRequest{URL: "https://example.com/page"}, now))
+	if err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	// Another store with the same salt, and a spelling that normalizes the same
+	second, _, err := newHashStore(&now).Insert(newShortURL(&CreateURLRequest{URL: "HTTPS://Example.com:443/page#top"}, now))
+	if err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if first.ShortCode != second.ShortCode || len(first.ShortCode) != defaultCodeLength {
+		t.Errorf("codes %q and %q should be the same %d characters", first.ShortCode, second.ShortCode, defaultCodeLength)
+	}
+
+	salted := NewURLStore()
+	salted.SetCodeStrategy(CodeStrategyHash, "other-salt")
+	third, _, err := salted.Insert(newShortURL(&CreateURLRequest{URL: "https://example.com/page"}, now))
+	if err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if third.ShortCode == first.ShortCode {
+		t.Errorf("a different salt gave the same code %q", third.ShortCode)
+	}
+}
+
+func TestHashedCodeCollisionExtendsCode(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	store := newHashStore(&now)
+
+	// Another destination already holds the code the hash starts with
+	alphabet := strings.NewReplacer("_", "", "-", "").Replace(shortCodeAlphabet)
+	digits := hashDigits(normalizeDestination("https://example.com/page"), "test-salt", alphabet)
+	if err := store.Add(digits[:defaultCodeLength], newShortURL(&CreateURLRequest{URL: "https://example.org/other"}, now)); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	url, created, err := store.Insert(newShortURL(&CreateURLRequest{URL: "https://example.com/page"}, now))
+	if err != nil || !created {
+		t.Fatalf("Insert: created=%v err=%v", created, err)
+	}
+	if url.ShortCode != digits[:defaultCodeLength+1] {
+		t.Errorf("short code = %q, want the hash extended by one character, %q", url.ShortCode, digits[:defaultCodeLength+1])
+	}
+	again, created, err := store.Insert(newShortURL(&CreateURLRequest{URL: "https://example.com/page"}, now))
+	if err != nil || created || again != url {
+		t.Errorf("shortening again should return the extended link, got %v (created=%v, err=%v)", again, created, err)
+	}
+}
+
+func TestRandomCodeCollisionsAreRedrawn(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	store := NewURLStore()
+	first := newShortURL(&CreateURLRequest{URL: "https://example.com/first"}, now)
+	if err := store.Add("taken1", first); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := store.Add("taken1", newShortURL(&CreateURLRequest{URL: "https://example.com/other"}, now)); !errors.Is(err, errCodeTaken) {
+		t.Fatalf("Add of a taken code: err = %v, want %v", err, errCodeTaken)
+	}
+
+	// The first two draws collide with the stored code
+	draws := 0
+	store.SetCodeGenerator(func(alphabet string, size int) (string, error) {
+		draws++
+		if draws <= 2 {
+			return "taken1", nil
+		}
+		return "fresh1", nil
+	})
+	url := newShortURL(&CreateURLRequest{URL: "https://example.com/second"}, now)
+	if err := store.InsertRandom(url); err != nil {
+		t.Fatalf("InsertRandom: %v", err)
+	}
+	if url.ShortCode != "fresh1" || draws != 3 {
+		t.Errorf("short code = %q after %d draws, want fresh1 after 3", url.ShortCode, draws)
+	}
+	if stored, _ := store.Get("taken1"); stored != first {
+		t.Error("a collision replaced the stored link")
+	}
+
+	// A generator that only returns taken codes gives up
+	draws = 0
+	store.SetCodeGenerator(func(alphabet string, size int) (string, error) {
+		draws++
+		return "taken1", nil
+	})
+	err := store.InsertRandom(newShortURL(&CreateURLRequest{URL: "https://example.com/third"}, now))
+	if !errors.Is(err, errNoCodeAvailable) || draws != maxCodeAttempts {
+		t.Errorf("InsertRandom = %v after %d draws, want %v after %d", err, draws, errNoCodeAvailable, maxCodeAttempts)
+	}
+}
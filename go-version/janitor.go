@@ -0,0 +1,162 @@
+package main
+
+import (
+	"log"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Janitor runs periodic maintenance jobs that scan the whole store. Jobs
+// run one at a time from a single goroutine, so two full scans never
+// overlap; first runs are staggered and every run is jittered so jobs with
+// similar intervals drift apart instead of firing back to back.
+type Janitor struct {
+	mu      sync.Mutex
+	jobs    []*janitorJob
+	jitter  float64       // Fraction of a job's interval added at random to each run
+	stagger time.Duration // Delay between consecutive jobs' first runs
+	now     func() time.Time
+	after   func(time.Duration) <-chan time.Time // Timer Run waits for the next job on
+	wake    chan struct{}                        // Signals Run that the schedule changed
+}
+
+type janitorJob struct {
+	name     string
+	interval time.Duration
+	run      func()
+	next     time.Time
+	last     time.Time
+	took     time.Duration
+}
+
+// JanitorJobStatus model
+type JanitorJobStatus struct {
+	Name         string     `json:"name"`
+	Interval     string     `json:"interval"`
+	NextRun      time.Time  `json:"next_run"`
+	LastRun      *time.Time `json:"last_run,omitempty"`
+	LastDuration string     `json:"last_duration,omitempty"`
+}
+
+// NewJanitor creates a janitor with no jobs
+func NewJanitor(jitter float64, stagger time.Duration) *Janitor {
+	return &Janitor{
+		jitter:  jitter,
+		stagger: stagger,
+		now:     time.Now,
+		after:   time.After,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// SetClock replaces the clock jobs are scheduled by and the timer Run waits
+// on. It must be called before any job is added.
+func (j *Janitor) SetClock(now func() time.Time, after func(time.Duration) <-chan time.Time) {
+	j.now = now
+	j.after = after
+}
+
+// Add schedules a job every interval, first running one interval (plus its
+// stagger offset) from now. Jobs with a non-positive interval are disabled.
+func (j *Janitor) Add(name string, interval time.Duration, run func()) {
+	if interval <= 0 {
+		return
+	}
+
+	j.mu.Lock()
+	offset := time.Duration(len(j.jobs)) * j.stagger
+	j.jobs = append(j.jobs, &janitorJob{
+		name:     name,
+		interval: interval,
+		run:      run,
+		next:     j.now().Add(interval + offset + j.jitterFor(interval)),
+	})
+	j.mu.Unlock()
+
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+}
+
+// jitterFor returns a random delay of up to the jitter fraction of interval
+func (j *Janitor) jitterFor(interval time.Duration) time.Duration {
+	if j.jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Float64() * j.jitter * float64(interval))
+}
+
+// due returns the job to run soonest, or nil when there are none
+func (j *Janitor) due() *janitorJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var soonest *janitorJob
+	for _, job := range j.jobs {
+		if soonest == nil || job.next.Before(soonest.next) {
+			soonest = job
+		}
+	}
+	return soonest
+}
+
+// Run executes jobs as they come due, blocking forever
+func (j *Janitor) Run() {
+	for {
+		job := j.due()
+		if job == nil {
+			<-j.wake
+			continue
+		}
+
+		j.mu.Lock()
+		wait := job.next.Sub(j.now())
+		j.mu.Unlock()
+		if wait > 0 {
+			select {
+			case <-j.after(wait):
+			case <-j.wake:
+				continue // A job was added, it may be due sooner
+			}
+		}
+
+		started := j.now()
+		job.run()
+		took := j.now().Sub(started)
+
+		j.mu.Lock()
+		job.last, job.took = started, took
+		job.next = started.Add(job.interval + j.jitterFor(job.interval))
+		j.mu.Unlock()
+
+		if took > job.interval {
+			log.Printf("Janitor: %s took %s, longer than its %s interval", job.name, took, job.interval)
+		}
+	}
+}
+
+// Jobs returns every scheduled job, soonest first
+func (j *Janitor) Jobs() []JanitorJobStatus {
+	j.mu.Lock()
+	statuses := make([]JanitorJobStatus, 0, len(j.jobs))
+	for _, job := range j.jobs {
+		status := JanitorJobStatus{
+			Name:     job.name,
+			Interval: job.interval.String(),
+			NextRun:  job.next,
+		}
+		if !job.last.IsZero() {
+			last := job.last
+			status.LastRun = &last
+			status.LastDuration = job.took.String()
+		}
+		statuses = append(statuses, status)
+	}
+	j.mu.Unlock()
+
+	sort.Slice(statuses, func(a, b int) bool { return statuses[a].NextRun.Before(statuses[b].NextRun) })
+	return statuses
+}
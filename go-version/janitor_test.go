@@ -0,0 +1,130 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a janitor clock that only moves when the test advances it
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeTimer
+	armed   chan time.Time // Deadline of every timer handed out
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, armed: make(chan time.Time, 16)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := fakeTimer{at: c.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.ch <- c.now
+	} else {
+		c.waiters = append(c.waiters, timer)
+	}
+	select {
+	case c.armed <- timer.at:
+	default:
+	}
+	return timer.ch
+}
+
+// Advance moves the clock forward, firing the timers that came due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, timer := range c.waiters {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.ch <- c.now
+	}
+	c.waiters = pending
+}
+
+// waitForTimer blocks until a timer with the given deadline is handed out
+func (c *fakeClock) waitForTimer(t *testing.T, at time.Time) {
+	t.Helper()
+	for {
+		select {
+		case armed := <-c.armed:
+			if armed.Equal(at) {
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("janitor never waited for %s", at)
+		}
+	}
+}
+
+func TestJanitorRunsJobsOnItsClock(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clock := newFakeClock(start)
+	janitor := NewJanitor(0, 30*time.Second)
+	janitor.SetClock(clock.Now, clock.After)
+
+	ran := make(chan string, 4)
+	janitor.Add("sweep", time.Minute, func() { ran <- "sweep" })
+	janitor.Add("purge", time.Minute, func() { ran <- "purge" })
+	go janitor.Run()
+
+	expectRun := func(want string) {
+		t.Helper()
+		select {
+		case got := <-ran:
+			if got != want {
+				t.Fatalf("ran %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s didn't run", want)
+		}
+	}
+
+	// The second job's first run is staggered after the first's
+	clock.waitForTimer(t, start.Add(time.Minute))
+	clock.Advance(59 * time.Second)
+	select {
+	case got := <-ran:
+		t.Fatalf("%s ran before its interval", got)
+	default:
+	}
+	clock.Advance(time.Second)
+	expectRun("sweep")
+
+	clock.waitForTimer(t, start.Add(90*time.Second))
+	jobs := janitor.Jobs()
+	if len(jobs) != 2 || jobs[0].Name != "purge" || jobs[1].Name != "sweep" {
+		t.Fatalf("Jobs() = %+v, want purge then sweep", jobs)
+	}
+	if jobs[0].LastRun != nil || !jobs[0].NextRun.Equal(start.Add(90*time.Second)) {
+		t.Errorf("purge = %+v, want its first run at %s", jobs[0], start.Add(90*time.Second))
+	}
+	if jobs[1].LastRun == nil || !jobs[1].LastRun.Equal(start.Add(time.Minute)) || !jobs[1].NextRun.Equal(start.Add(2*time.Minute)) {
+		t.Errorf("sweep = %+v, want last run at %s and next at %s", jobs[1], start.Add(time.Minute), start.Add(2*time.Minute))
+	}
+
+	clock.Advance(30 * time.Second)
+	expectRun("purge")
+	clock.waitForTimer(t, start.Add(2*time.Minute))
+	clock.Advance(30 * time.Second)
+	expectRun("sweep")
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// linkCheckConcurrency bounds the destinations probed at the same time
+const linkCheckConcurrency = 8
+
+// linkCheckMaxRedirects bounds the redirects a probe follows
+const linkCheckMaxRedirects = 5
+
+// errPrivateAddress is returned for probes that would reach a private address
+var errPrivateAddress = errors.New("destination resolves to a private address")
+
+// LinkCheck is the cached result of probing a destination
+type LinkCheck struct {
+	Destination string    `json:"destination"`
+	Status      int       `json:"status,omitempty"` // Final HTTP status, 0 when the request failed
+	Error       string    `json:"error,omitempty"`
+	LatencyMS   int64     `json:"latency_ms"` // Time until the response (or failure)
+	CheckedAt   time.Time `json:"checked_at"`
+}
+
+// Reachable reports whether the probe got a non-error response
+func (r LinkCheck) Reachable() bool {
+	return r.Error == "" && r.Status < http.StatusBadRequest
+}
+
+// LinkChecker periodically probes every distinct destination in the store
+// and caches the outcome, so reports never trigger outbound requests
+type LinkChecker struct {
+	store     *URLStore
+	blocklist *Blocklist // Blocked destinations are never probed
+	client    *http.Client
+
+	mu      sync.RWMutex
+	results map[string]LinkCheck // Destination -> latest result
+}
+
+// NewLinkChecker creates a checker whose probes give up after timeout
+func NewLinkChecker(store *URLStore, blocklist *Blocklist, timeout time.Duration) *LinkChecker {
+	return &LinkChecker{
+		store:     store,
+		blocklist: blocklist,
+		client:    newPublicClient(timeout),
+		results:   make(map[string]LinkCheck),
+	}
+}
+
+// newPublicClient returns a client that only connects to public addresses.
+// The check runs on the resolved address of every connection, redirect hops
+// included, so neither DNS names nor redirects can point a probe at the
+// internal network. This holds whether or not BLOCK_PRIVATE_HOSTS is set,
+// since probes are triggered by anonymous callers.
+func newPublicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+				return errPrivateAddress
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil // A proxy would connect on our behalf, past the check
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= linkCheckMaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", linkCheckMaxRedirects)
+			}
+			if ip := net.ParseIP(req.URL.Hostname()); ip != nil && isPrivateIP(ip) {
+				return errPrivateAddress
+			}
+			return nil
+		},
+	}
+}
+
+// Check probes a single destination with a HEAD request, falling back to
+// GET for servers that don't allow HEAD
+func (lc *LinkChecker) Check(destination string) LinkCheck {
+	result := LinkCheck{Destination: destination, CheckedAt: lc.store.Now()}
+
+	start := time.Now()
+	resp, err := lc.client.Head(destination)
+	if err == nil && resp.StatusCode == http.StatusMethodNotAllowed {
+		resp.Body.Close()
+		resp, err = lc.client.Get(destination)
+	}
+	result.LatencyMS = time.Since(start).Milliseconds()
+
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	resp.Body.Close()
+	result.Status = resp.StatusCode
+	return result
+}
+
+// destinations returns every distinct redirect target in the store
+func (lc *LinkChecker) destinations() []string {
+	seen := make(map[string]struct{})
+	for _, url := range lc.store.GetAll() {
+		seen[url.Destination()] = struct{}{}
+		for _, dest := range []string{url.IOSURL, url.AndroidURL} {
+			if dest != "" {
+				seen[dest] = struct{}{}
+			}
+		}
+		for _, rule := range url.QueryRules {
+			seen[rule.Destination] = struct{}{}
+		}
+	}
+
+	destinations := make([]string, 0, len(seen))
+	for dest := range seen {
+		if lc.blocklist == nil || !lc.blocklist.IsBlocked(dest) {
+			destinations = append(destinations, dest)
+		}
+	}
+	return destinations
+}
+
+// CheckAll probes every destination and replaces the cached results, so
+// destinations no longer linked to drop out of the cache
+func (lc *LinkChecker) CheckAll() int {
+	destinations := lc.destinations()
+	results := make(map[string]LinkCheck, len(destinations))
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		pending = make(chan string)
+	)
+	for i := 0; i < linkCheckConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for dest := range pending {
+				result := lc.Check(dest)
+				mu.Lock()
+				results[dest] = result
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, dest := range destinations {
+		pending <- dest
+	}
+	close(pending)
+	wg.Wait()
+
+	lc.mu.Lock()
+	lc.results = results
+	lc.mu.Unlock()
+	return len(results)
+}
+
+// Slowest returns cached results with the highest latency first
+func (lc *LinkChecker) Slowest(limit int) []LinkCheck {
+	lc.mu.RLock()
+	results := make([]LinkCheck, 0, len(lc.results))
+	for _, result := range lc.results {
+		results = append(results, result)
+	}
+	lc.mu.RUnlock()
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].LatencyMS != results[j].LatencyMS {
+			return results[i].LatencyMS > results[j].LatencyMS
+		}
+		return results[i].Destination < results[j].Destination
+	})
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLinkCheckRefusesPrivateAddresses(t *testing.T) {
+	var hits int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+	}))
+	defer server.Close()
+
+	checker := NewLinkChecker(NewURLStore(), nil, time.Second)
+	for _, destination := range []string{server.URL, strings.Replace(server.URL, "127.0.0.1", "localhost", 1)} {
+		check := checker.Check(destination)
+		if check.Reachable() || !strings.Contains(check.Error, errPrivateAddress.Error()) {
+			t.Errorf("Check(%s) = %+v, want it refused as private", destination, check)
+		}
+	}
+	if hits != 0 {
+		t.Errorf("loopback server got %d requests, want none", hits)
+	}
+}
+
+func TestLinkCheckRefusesPrivateRedirects(t *testing.T) {
+	client := newPublicClient(time.Second)
+	req, _ := http.NewRequest(http.MethodHead, "http://10.0.0.1/admin", nil)
+	via := []*http.Request{{}}
+	if err := client.CheckRedirect(req, via); !errors.Is(err, errPrivateAddress) {
+		t.Errorf("redirect to a private address: err = %v, want %v", err, errPrivateAddress)
+	}
+
+	req, _ = http.NewRequest(http.MethodHead, "https://example.com/", nil)
+	if err := client.CheckRedirect(req, make([]*http.Request, linkCheckMaxRedirects)); err == nil {
+		t.Errorf("redirect number %d was followed", linkCheckMaxRedirects+1)
+	}
+	if err := client.CheckRedirect(req, via); err != nil {
+		t.Errorf("redirect to a public host: %v", err)
+	}
+}
+
+// newLoopbackChecker returns a checker for store whose probes may reach the
+// loopback test servers that the public client refuses
+func newLoopbackChecker(store *URLStore) *LinkChecker {
+	checker := NewLinkChecker(store, nil, time.Second)
+	checker.client = &http.Client{Timeout: time.Second}
+	return checker
+}
+
+func TestSlowestRanksDestinationsByLatency(t *testing.T) {
+	delays := []time.Duration{0, 80 * time.Millisecond, 40 * time.Millisecond}
+	store := NewURLStore()
+	var destinations []string
+	for _, delay := range delays {
+		delay := delay
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(delay)
+		}))
+		defer server.Close()
+		destinations = append(destinations, server.URL+"/")
+		if err := store.InsertRandom(newShortURL(&CreateURLRequest{URL: server.URL + "/"}, store.Now())); err != nil {
+			t.Fatalf("InsertRandom: %v", err)
+		}
+	}
+
+	checker := newLoopbackChecker(store)
+	if checked := checker.CheckAll(); checked != len(delays) {
+		t.Fatalf("CheckAll checked %d destinations, want %d", checked, len(delays))
+	}
+	slowest := checker.Slowest(2)
+	if len(slowest) != 2 || slowest[0].Destination != destinations[1] || slowest[1].Destination != destinations[2] {
+		t.Fatalf("Slowest(2) = %+v, want %s then %s", slowest, destinations[1], destinations[2])
+	}
+	if slowest[0].LatencyMS < 80 || slowest[0].Status != http.StatusOK {
+		t.Errorf("slowest result = %+v, want status 200 and at least 80ms", slowest[0])
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// LogFormat selects how access and application logs are written
+type LogFormat string
+
+const (
+	LogFormatText LogFormat = "text" // Pipe-delimited access log and plain log lines
+	LogFormatJSON LogFormat = "json" // One JSON object per line, for Loki/ELK
+)
+
+// ParseLogFormat validates a LOG_FORMAT value
+func ParseLogFormat(value string) (LogFormat, error) {
+	switch LogFormat(strings.ToLower(value)) {
+	case "", LogFormatText:
+		return LogFormatText, nil
+	case LogFormatJSON:
+		return LogFormatJSON, nil
+	default:
+		return "", fmt.Errorf("must be %q or %q", LogFormatText, LogFormatJSON)
+	}
+}
+
+// useJSONLogs routes the standard logger, and so every log.Printf, through
+// slog's JSON handler. log.Fatal still exits after writing its line.
+func useJSONLogs() {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+	log.SetFlags(0) // slog adds its own timestamp
+}
+
+// newJSONAccessLogger returns middleware writing one JSON line per request
+// to out, with the request ID set by the requestid middleware. Like Fiber's
+// logger it hands errors to the app's error handler first so the logged
+// status is the one sent; requests for which skip returns true aren't logged.
+func newJSONAccessLogger(out io.Writer, skip func(c *fiber.Ctx) bool) fiber.Handler {
+	logger := slog.New(slog.NewJSONHandler(out, nil))
+	return func(c *fiber.Ctx) error {
+		if skip(c) {
+			return c.Next()
+		}
+
+		start := time.Now()
+		if err := c.Next(); err != nil {
+			if err := c.App().ErrorHandler(c, err); err != nil {
+				_ = c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+
+		logger.LogAttrs(context.Background(), slog.LevelInfo, "request",
+			slog.Int("status", c.Response().StatusCode()),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("method", c.Method()),
+			slog.String("path", c.Path()),
+			slog.String("request_id", c.GetRespHeader(fiber.HeaderXRequestID)),
+		)
+		return nil
+	}
+}
+
+// requestIDInErrors adds the response's X-Request-ID to JSON error bodies as
+// a top-level "request_id", so a failed call can be matched to its log line.
+// It must run inside the compress middleware, while the body is still plain.
+// Errors returned rather than written are left to the error handler.
+func requestIDInErrors() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		err := c.Next()
+		resp := c.Response()
+		body := resp.Body()
+		if err != nil || resp.StatusCode() < fiber.StatusBadRequest || len(body) < 2 || body[0] != '{' ||
+			!bytes.HasPrefix(resp.Header.ContentType(), []byte(fiber.MIMEApplicationJSON)) {
+			return err
+		}
+		id := c.GetRespHeader(fiber.HeaderXRequestID)
+		if id == "" {
+			return nil
+		}
+
+		quoted, _ := json.Marshal(id) // Incoming IDs are client supplied
+		tagged := make([]byte, 0, len(body)+len(quoted)+16)
+		tagged = append(tagged, `{"request_id":`...)
+		tagged = append(tagged, quoted...)
+		if rest := bytes.TrimSpace(body[1:]); len(rest) > 0 && rest[0] != '}' {
+			tagged = append(tagged, ',')
+		}
+		tagged = append(tagged, body[1:]...)
+		resp.SetBodyRaw(tagged)
+		return nil
+	}
+}
@@ -1,12 +1,29 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
 	"log"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	neturl "net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -16,31 +33,545 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/compress"
 	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/gofiber/fiber/v2/middleware/favicon"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
 	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	gonanoid "github.com/matoous/go-nanoid/v2"
 )
 
 // URL model
 type URL struct {
-	ID          string    `json:"id"`
-	OriginalURL string    `json:"original_url"`
-	ShortCode   string    `json:"short_code"`
-	CreatedAt   time.Time `json:"created_at"`
-	AccessCount int64     `json:"access_count"`
+	ID             string      `json:"id"`
+	OriginalURL    string      `json:"original_url"`
+	ShortCode      string      `json:"short_code"`
+	CreatedAt      time.Time   `json:"created_at"`
+	AccessCount    int64       `json:"access_count"`
+	IOSURL         string      `json:"ios_url,omitempty"`
+	AndroidURL     string      `json:"android_url,omitempty"`
+	OwnerID        string      `json:"owner_id,omitempty"`
+	QueryRules     []QueryRule `json:"query_rules,omitempty"`
+	RedirectStatus int         `json:"redirect_status,omitempty"`
+	CreatedByIP    string      `json:"created_by_ip,omitempty"` // Audit only, never in public responses
+	SignClicks     bool        `json:"sign_clicks,omitempty"`
+	ExpiresAt      *time.Time  `json:"expires_at,omitempty"`     // Redirects stop after this, nil never expires
+	PreviewHits    int64       `json:"preview_hits,omitempty"`   // Redirects served to link preview crawlers, not in AccessCount
+	MaxClicks      int64       `json:"max_clicks,omitempty"`     // Redirects stop after this many, 0 is unlimited
+	ClaimedClicks  int64       `json:"claimed_clicks,omitempty"` // Redirects served against MaxClicks, claimed before redirecting
+	PasswordHash   string      `json:"password_hash,omitempty"`  // bcrypt, set for protected links; never in API responses
+	Campaign       string      `json:"campaign,omitempty"`
+	ForwardQuery   bool        `json:"forward_query,omitempty"` // Pass the incoming query string on to the destination
+	Tags           []string    `json:"tags,omitempty"`
+	DeletedAt      *time.Time  `json:"deleted_at,omitempty"` // Soft-deleted: hidden everywhere until restored or purged
+
+	// Clicks bucketed by hour of day in the store's timezone
+	HourlyClicks [24]int64 `json:"hourly_clicks"`
+
+	// Clicks per day (YYYY-MM-DD in the store's timezone), trimmed to the retention window
+	DailyClicks map[string]int64 `json:"daily_clicks,omitempty"`
+
+	// Clicks per normalized referer host, capped at maxReferrersPerURL distinct hosts
+	Referrers map[string]int64 `json:"referrers,omitempty"`
+
+	// Clicks per User-Agent (truncated to maxUserAgentLength), capped at maxUserAgentsPerURL distinct values
+	UserAgents map[string]int64 `json:"user_agents,omitempty"`
+
+	// Clicks per minute (Unix time / 60) over the last clickHistoryMinutes
+	MinuteClicks map[int64]int64 `json:"minute_clicks,omitempty"`
+
+	// Lifecycle events, oldest first, capped at maxLinkHistory
+	History []LinkEvent `json:"history,omitempty"`
+
+	mu      sync.RWMutex // Guards fields that can change after creation (OriginalURL, OwnerID, ExpiresAt, DeletedAt, History)
+	statsMu sync.Mutex   // Guards DailyClicks, Referrers, UserAgents and MinuteClicks
+}
+
+// LinkEvent model, one entry in a link's lifecycle history
+type LinkEvent struct {
+	Type   string    `json:"type"` // created, updated, expired, deleted or restored
+	At     time.Time `json:"at"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// Lifecycle event types
+const (
+	eventCreated  = "created"
+	eventUpdated  = "updated"
+	eventExpired  = "expired"
+	eventDeleted  = "deleted"
+	eventRestored = "restored"
+)
+
+// maxLinkHistory bounds the lifecycle events kept per link; the oldest are
+// dropped first
+const maxLinkHistory = 50
+
+// clickHistoryMinutes is how far back per-minute clicks are kept
+const clickHistoryMinutes = 7 * 24 * 60
+
+// dayLayout formats the keys of the per-day click series
+const dayLayout = "2006-01-02"
+
+const (
+	directReferrer     = "direct" // Clicks without a usable Referer header
+	otherReferrer      = "other"  // Clicks from hosts beyond the per-URL cap
+	maxReferrersPerURL = 100
+)
+
+const (
+	maxUserAgentsPerURL = 50  // Distinct User-Agents counted per URL, the rest count as "other"
+	maxUserAgentLength  = 256 // Longer User-Agents are truncated before counting
+)
+
+// truncateUserAgent bounds the memory a single User-Agent can take
+func truncateUserAgent(userAgent string) string {
+	if len(userAgent) > maxUserAgentLength {
+		return userAgent[:maxUserAgentLength]
+	}
+	return userAgent
+}
+
+// referrerHost normalizes a Referer header to a bare host (lowercased, without
+// "www." or port), bucketing missing or unparsable values as direct traffic
+func referrerHost(referer string) string {
+	parsed, err := neturl.Parse(referer)
+	if err != nil || parsed.Hostname() == "" {
+		return directReferrer
+	}
+	return strings.TrimPrefix(strings.ToLower(parsed.Hostname()), "www.")
+}
+
+// siteHost normalizes a host for matching links by site: lowercased, without
+// "www.", port or trailing dot
+func siteHost(host string) string {
+	return strings.TrimPrefix(normalizeHost(host), "www.")
+}
+
+// OnSite reports whether the URL's web destination is on the given site host
+func (u *URL) OnSite(site string) bool {
+	parsed, err := neturl.Parse(u.Destination())
+	return err == nil && siteHost(parsed.Host) == site
+}
+
+// Owner returns the ID of the URL's owner
+func (u *URL) Owner() string {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.OwnerID
+}
+
+// RecordEvent appends an event to the URL's lifecycle history
+func (u *URL) RecordEvent(kind string, at time.Time, detail string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.appendEvent(LinkEvent{Type: kind, At: at, Detail: detail})
+}
+
+// appendEvent adds to the history, dropping the oldest events over the cap.
+// Callers must hold mu.
+func (u *URL) appendEvent(event LinkEvent) {
+	if len(u.History) >= maxLinkHistory {
+		u.History = append(u.History[:0:0], u.History[len(u.History)-maxLinkHistory+1:]...)
+	}
+	u.History = append(u.History, event)
+}
+
+// LifecycleHistory returns a copy of the URL's lifecycle events, oldest first
+func (u *URL) LifecycleHistory() []LinkEvent {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return append([]LinkEvent{}, u.History...)
+}
+
+// NoteExpiry records an expired event, dated at the expiry time, the first
+// time the URL is seen past its expiry. It reports whether one was recorded.
+func (u *URL) NoteExpiry(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.ExpiresAt == nil || now.Before(*u.ExpiresAt) {
+		return false
+	}
+	if n := len(u.History); n > 0 && u.History[n-1].Type == eventExpired && u.History[n-1].At.Equal(*u.ExpiresAt) {
+		return false
+	}
+	u.appendEvent(LinkEvent{Type: eventExpired, At: *u.ExpiresAt})
+	return true
 }
 
 // CreateURLRequest model
 type CreateURLRequest struct {
+	URL            string      `json:"url"`
+	IOSURL         string      `json:"ios_url"`
+	AndroidURL     string      `json:"android_url"`
+	OwnerID        string      `json:"owner_id"`
+	QueryRules     []QueryRule `json:"query_rules"`
+	RedirectStatus int         `json:"redirect_status"`
+	SignClicks     bool        `json:"sign_clicks"`
+	ExpiresAt      *time.Time  `json:"expires_at"`
+	ExpiresIn      int64       `json:"expires_in"` // Seconds from creation, alternative to ExpiresAt
+	MaxClicks      int64       `json:"max_clicks"` // Redirects before the link stops working, 0 is unlimited
+	Password       string      `json:"password"`   // Required to follow the link when set, stored hashed
+	Campaign       string      `json:"campaign"`
+	ForwardQuery   bool        `json:"forward_query"`
+	Tags           []string    `json:"tags"`
+	CustomCode     string      `json:"custom_code"` // Vanity short code, generated when empty
+}
+
+// QueryRule sends requests carrying param=value to a specific destination
+type QueryRule struct {
+	Param       string `json:"param"`
+	Value       string `json:"value"`
+	Destination string `json:"destination"`
+}
+
+// maxCampaignLength bounds campaign names, which appear in URL paths
+const maxCampaignLength = 100
+
+// maxQueryRules bounds the rules evaluated on every redirect of a link
+const maxQueryRules = 20
+
+// CloneURLRequest model, any field that is set overrides the copied value
+type CloneURLRequest struct {
+	URL            *string      `json:"url"`
+	IOSURL         *string      `json:"ios_url"`
+	AndroidURL     *string      `json:"android_url"`
+	OwnerID        *string      `json:"owner_id"`
+	QueryRules     *[]QueryRule `json:"query_rules"`
+	RedirectStatus *int         `json:"redirect_status"`
+	SignClicks     *bool        `json:"sign_clicks"`
+	MaxClicks      *int64       `json:"max_clicks"`
+	Password       *string      `json:"password"` // Replaces the copied password; a protected link's can't be removed
+	Campaign       *string      `json:"campaign"`
+	ForwardQuery   *bool        `json:"forward_query"`
+	Tags           *[]string    `json:"tags"`
+}
+
+// ValidateURLsRequest model
+type ValidateURLsRequest struct {
+	URLs []string `json:"urls"`
+}
+
+// QRMetadataRequest model
+type QRMetadataRequest struct {
+	ShortCodes []string `json:"short_codes"`
+}
+
+// ExpireURLsRequest model, exactly one of TTLSeconds and ExpiresAt must be set
+type ExpireURLsRequest struct {
+	ShortCodes []string   `json:"short_codes"`
+	TTLSeconds *int64     `json:"ttl_seconds"` // From now, 0 clears the expiry
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
+// UpdateURLRequest model
+type UpdateURLRequest struct {
 	URL string `json:"url"`
 }
 
+// TransferURLRequest model
+type TransferURLRequest struct {
+	OwnerID string `json:"owner_id"`
+}
+
 // URLResponse model
 type URLResponse struct {
-	OriginalURL string    `json:"original_url"`
-	ShortCode   string    `json:"short_code"`
-	ShortURL    string    `json:"short_url"`
-	CreatedAt   time.Time `json:"created_at"`
-	AccessCount int64     `json:"access_count"`
+	ID             string      `json:"id"`
+	OriginalURL    string      `json:"original_url"`
+	ShortCode      string      `json:"short_code"`
+	ShortURL       string      `json:"short_url"`
+	CreatedAt      time.Time   `json:"created_at"`
+	AccessCount    int64       `json:"access_count"`
+	IOSURL         string      `json:"ios_url,omitempty"`
+	AndroidURL     string      `json:"android_url,omitempty"`
+	OwnerID        string      `json:"owner_id,omitempty"`
+	QueryRules     []QueryRule `json:"query_rules,omitempty"`
+	RedirectStatus int         `json:"redirect_status"`
+	SignClicks     bool        `json:"sign_clicks,omitempty"`
+	ExpiresAt      *time.Time  `json:"expires_at,omitempty"`
+	PreviewHits    int64       `json:"preview_hits"`
+	MaxClicks      int64       `json:"max_clicks,omitempty"`
+	ClicksLeft     *int64      `json:"clicks_left,omitempty"` // Only set when MaxClicks is
+	Protected      bool        `json:"protected,omitempty"`   // Destinations are left out while set
+	Campaign       string      `json:"campaign,omitempty"`
+	ForwardQuery   bool        `json:"forward_query,omitempty"`
+	Tags           []string    `json:"tags,omitempty"`
+}
+
+// newURLResponse builds the API representation of a URL. Protected links
+// leave out every destination, including platform URLs and query rules.
+func newURLResponse(url *URL, baseURL string) URLResponse {
+	resp := URLResponse{
+		ID:             url.ID,
+		OriginalURL:    url.PublicDestination(),
+		ShortCode:      url.ShortCode,
+		ShortURL:       fmt.Sprintf("%s/%s", baseURL, url.ShortCode),
+		CreatedAt:      url.CreatedAt,
+		AccessCount:    atomic.LoadInt64(&url.AccessCount),
+		IOSURL:         url.IOSURL,
+		AndroidURL:     url.AndroidURL,
+		OwnerID:        url.Owner(),
+		QueryRules:     url.QueryRules,
+		RedirectStatus: url.StatusCode(),
+		SignClicks:     url.SignClicks,
+		ExpiresAt:      url.Expiry(),
+		PreviewHits:    atomic.LoadInt64(&url.PreviewHits),
+		MaxClicks:      url.MaxClicks,
+		ClicksLeft:     url.ClicksLeft(),
+		Protected:      url.Protected(),
+		Campaign:       url.Campaign,
+		ForwardQuery:   url.ForwardQuery,
+		Tags:           url.Tags,
+	}
+	if resp.Protected {
+		resp.IOSURL, resp.AndroidURL, resp.QueryRules = "", "", nil
+	}
+	return resp
+}
+
+// AdminURLResponse model, a URLResponse with audit fields for admin callers
+type AdminURLResponse struct {
+	URLResponse
+	CreatedByIP string     `json:"created_by_ip"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"` // Only in ?deleted=true listings
+}
+
+// URLPageResponse model, the envelope used for paged or opted-in URL listings
+type URLPageResponse struct {
+	URLs       []URLResponse `json:"urls"`
+	Count      int           `json:"count"` // URLs in this page
+	Total      int           `json:"total"` // URLs matching the filters across all pages
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// LinkHistoryResponse model
+type LinkHistoryResponse struct {
+	ShortCode string      `json:"short_code"`
+	Events    []LinkEvent `json:"events"` // Oldest first
+}
+
+// HourlyClicksResponse model
+type HourlyClicksResponse struct {
+	ShortCode string    `json:"short_code"`
+	Timezone  string    `json:"timezone"`
+	Hours     [24]int64 `json:"hours"`
+	Total     int64     `json:"total"`
+}
+
+// ReferrerCount model
+type ReferrerCount struct {
+	Host   string `json:"host"`
+	Clicks int64  `json:"clicks"`
+}
+
+// ReferrersResponse model
+type ReferrersResponse struct {
+	Referrers []ReferrerCount `json:"referrers"`
+}
+
+// UserAgentCount model
+type UserAgentCount struct {
+	UserAgent string `json:"user_agent"`
+	Clicks    int64  `json:"clicks"`
+}
+
+// URLReferrersResponse model, where one link's clicks came from
+type URLReferrersResponse struct {
+	ShortCode  string           `json:"short_code"`
+	Referrers  []ReferrerCount  `json:"referrers"`
+	UserAgents []UserAgentCount `json:"user_agents"`
+}
+
+// SlowDestinationsResponse model
+type SlowDestinationsResponse struct {
+	Destinations []LinkCheck `json:"destinations"`
+}
+
+// DailyClickCount model, one day of a click time series
+type DailyClickCount struct {
+	Date   string `json:"date"` // YYYY-MM-DD in the store's timezone
+	Clicks int64  `json:"clicks"`
+}
+
+// DailyCreationCount model, links created on one day
+type DailyCreationCount struct {
+	Date  string `json:"date"` // YYYY-MM-DD in the store's timezone
+	Links int    `json:"links"`
+}
+
+// CreationsResponse model
+type CreationsResponse struct {
+	Timezone string               `json:"timezone"`
+	Total    int                  `json:"total"`  // Links created within the returned days
+	Series   []DailyCreationCount `json:"series"` // Oldest day first
+}
+
+// CodeLengthCount is the number of stored short codes of one length
+type CodeLengthCount struct {
+	Length int `json:"length"`
+	Count  int `json:"count"`
+}
+
+// CodeLengthsResponse model
+type CodeLengthsResponse struct {
+	Total   int               `json:"total"`
+	Lengths []CodeLengthCount `json:"lengths"`
+}
+
+// StoreGrowthResponse model
+type StoreGrowthResponse struct {
+	Total    int64   `json:"total"`
+	LastHour int     `json:"last_hour"`
+	LastDay  int     `json:"last_day"`
+	LastWeek int     `json:"last_week"`
+	PerHour  float64 `json:"per_hour"` // Average over the last week
+
+	// Set when MAX_URLS is configured
+	MaxURLs   int64  `json:"max_urls,omitempty"`
+	Remaining *int64 `json:"remaining,omitempty"`
+
+	// When the limit is reached at the weekly rate, omitted without a limit or growth
+	ProjectedFullAt         *time.Time `json:"projected_full_at,omitempty"`
+	ProjectedSecondsToLimit *int64     `json:"projected_seconds_to_limit,omitempty"`
+}
+
+// CampaignTimeseriesResponse model
+type CampaignTimeseriesResponse struct {
+	Campaign string            `json:"campaign"`
+	Links    int               `json:"links"`
+	Total    int64             `json:"total_clicks"` // Clicks within the returned days
+	Series   []DailyClickCount `json:"series"`       // Oldest day first
+}
+
+// SimulateRedirectRequest model, the request inputs a redirect depends on
+type SimulateRedirectRequest struct {
+	UserAgent string     `json:"user_agent"`
+	Query     string     `json:"query"` // Raw query string, e.g. "utm_source=mail&lang=de"
+	At        *time.Time `json:"at"`    // When the click happens, defaults to now
+}
+
+// SimulateRedirectResponse model, what GET /:shortCode would answer
+type SimulateRedirectResponse struct {
+	ShortCode   string `json:"short_code"`
+	Status      int    `json:"status"`
+	Outcome     string `json:"outcome"` // "redirect", "expired" or "blocked"
+	Platform    string `json:"platform"`
+	Destination string `json:"destination,omitempty"`
+}
+
+// URLStatsResponse model
+type URLStatsResponse struct {
+	ShortCode string            `json:"short_code"`
+	Total     int64             `json:"total_clicks"` // All clicks, including days outside the series
+	Series    []DailyClickCount `json:"series"`       // Oldest day first
+}
+
+// maxTimeseriesDays bounds the days returned by time series endpoints
+const maxTimeseriesDays = 366
+
+// defaultAnalyticsRetention bounds per-day analytics unless ANALYTICS_RETENTION says otherwise
+const defaultAnalyticsRetention = 90 * 24 * time.Hour
+
+// ClicksSinceResponse model
+type ClicksSinceResponse struct {
+	ShortCode string    `json:"short_code"`
+	Since     time.Time `json:"since"`
+	Clicks    int64     `json:"clicks"`
+}
+
+// RedirectTargetResponse model, returned instead of a redirect in JSON mode
+type RedirectTargetResponse struct {
+	OriginalURL string `json:"original_url"` // The destination the redirect would have sent the client to
+	ShortCode   string `json:"short_code"`
+}
+
+// ExpireURLResult model, the outcome for one code of a bulk expiry update
+type ExpireURLResult struct {
+	ShortCode string     `json:"short_code"`
+	Updated   bool       `json:"updated"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// DeleteByFilterRequest model, links matching every set criterion are deleted
+type DeleteByFilterRequest struct {
+	OlderThan  string `json:"older_than"` // Created longer ago than this duration, e.g. "30d"
+	ZeroClicks bool   `json:"zero_clicks"`
+	Domain     string `json:"domain"` // Web destination on this site, "www." ignored
+	Tag        string `json:"tag"`
+	Confirm    bool   `json:"confirm"` // Required to actually delete
+	DryRun     bool   `json:"dry_run"` // Only count the matches
+}
+
+// DeleteByFilterResponse model
+type DeleteByFilterResponse struct {
+	Matched int  `json:"matched"`
+	Deleted int  `json:"deleted"`
+	DryRun  bool `json:"dry_run"`
+}
+
+// RouteInfo model
+type RouteInfo struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+}
+
+// BatchShortenError model, a batch item that wasn't shortened
+type BatchShortenError struct {
+	Index int         `json:"index"` // Position of the item in the request
+	URL   string      `json:"url,omitempty"`
+	Error ErrorDetail `json:"error"`
+}
+
+// ImportResponse model
+type ImportResponse struct {
+	Imported int           `json:"imported"`
+	Skipped  int           `json:"skipped"`
+	Errors   []ImportError `json:"errors"` // Why each skipped entry was skipped
+}
+
+// ImportError model
+type ImportError struct {
+	Index int         `json:"index"` // Position of the entry in the request
+	Error ErrorDetail `json:"error"`
+}
+
+// URLValidationResult model, Reason is only set for invalid URLs
+type URLValidationResult struct {
+	URL    string `json:"url"`
+	Valid  bool   `json:"valid"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// ValidateURLsResponse model
+type ValidateURLsResponse struct {
+	Results []URLValidationResult `json:"results"`
+	Valid   int                   `json:"valid"`
+	Invalid int                   `json:"invalid"`
+}
+
+// QRMetadata model, the short URL doubles as the QR payload
+type QRMetadata struct {
+	ShortCode string `json:"short_code"`
+	ShortURL  string `json:"short_url"`
+}
+
+// ServerConfigResponse model, the connection settings the server runs with
+type ServerConfigResponse struct {
+	Prefork       bool   `json:"prefork"`
+	KeepAlive     bool   `json:"keep_alive"`
+	IdleTimeout   string `json:"idle_timeout"`
+	ReadTimeout   string `json:"read_timeout"`
+	WriteTimeout  string `json:"write_timeout"`
+	MaxConnsPerIP int    `json:"max_conns_per_ip"` // 0 is unlimited
+	Concurrency   int    `json:"concurrency"`
+	BodyLimit     int    `json:"body_limit"` // Bytes
+}
+
+// ThroughputResponse model, rates over the last THROUGHPUT_WINDOW
+type ThroughputResponse struct {
+	RedirectsPerSecond float64 `json:"redirects_per_second"`
+	ShortensPerSecond  float64 `json:"shortens_per_second"`
+	WindowSeconds      float64 `json:"window_seconds"` // Shorter than the configured window just after startup
 }
 
 // AnalyticsResponse model
@@ -50,316 +581,4068 @@ type AnalyticsResponse struct {
 	URLs        []URLResponse `json:"urls"`
 }
 
-// URLStore is a high-performance URL storage
-type URLStore struct {
-	store      sync.Map // Use sync.Map instead of map with mutex for better concurrency
-	urlCount   atomic.Int64
-	clickCount atomic.Int64
+// WarmCacheRequest model, either short codes or the number of most clicked links
+type WarmCacheRequest struct {
+	ShortCodes []string `json:"short_codes"`
+	Top        int      `json:"top"`
 }
 
-// NewURLStore creates a new URLStore
-func NewURLStore() *URLStore {
-	return &URLStore{}
+// WarmCacheResponse model
+type WarmCacheResponse struct {
+	Loaded int `json:"loaded"` // URLs read from the persister, excluding ones already in memory
 }
 
-// Add a URL to the store
-func (s *URLStore) Add(shortCode string, url *URL) {
-	s.store.Store(shortCode, url)
-	s.urlCount.Add(1)
+// AnalyticsRecord model, one line of the NDJSON analytics export
+type AnalyticsRecord struct {
+	ShortCode   string    `json:"short_code"`
+	OriginalURL string    `json:"original_url"`
+	AccessCount int64     `json:"access_count"`
+	CreatedAt   time.Time `json:"created_at"`
 }
 
-// Get a URL by short code
-func (s *URLStore) Get(shortCode string) (*URL, bool) {
-	value, exists := s.store.Load(shortCode)
-	if !exists {
-		return nil, false
+// analyticsRecordOrders are the accepted sort values of the NDJSON export
+var analyticsRecordOrders = map[string]func(a, b *AnalyticsRecord) bool{
+	"clicks":  func(a, b *AnalyticsRecord) bool { return a.AccessCount > b.AccessCount },
+	"created": func(a, b *AnalyticsRecord) bool { return a.CreatedAt.Before(b.CreatedAt) },
+	"code":    func(a, b *AnalyticsRecord) bool { return a.ShortCode < b.ShortCode },
+}
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// maxBatchSize bounds the items accepted by batch endpoints
+const maxBatchSize = 1000
+
+// Decoded body limits of the public batch endpoints, with room for
+// maxBatchSize short codes or URLs
+const (
+	maxQRMetadataBodySize = 64 * 1024
+	maxValidateBodySize   = 4 * 1024 * 1024
+)
+
+// Limits on the DNS work of a /api/validate batch: how many URLs are checked
+// at the same time, and how long the whole batch may spend on lookups
+const (
+	validateConcurrency  = 8
+	validateBatchTimeout = 10 * time.Second
+)
+
+// urlCursor is a position in the newest-first URL listing. Because it is
+// derived from the sort key rather than an offset, inserts and deletes
+// elsewhere in the list never shift the remaining pages.
+type urlCursor struct {
+	createdAt time.Time
+	shortCode string
+}
+
+// newestFirst orders URLs by creation time descending, then by short code
+func newestFirst(a, b *URL) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.After(b.CreatedAt)
 	}
-	return value.(*URL), true
+	return a.ShortCode > b.ShortCode
+}
+
+// urlHeap keeps the oldest of the URLs it holds on top, see newestURLs
+type urlHeap []*URL
+
+func (h urlHeap) Len() int            { return len(h) }
+func (h urlHeap) Less(i, j int) bool  { return newestFirst(h[j], h[i]) }
+func (h urlHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *urlHeap) Push(x interface{}) { *h = append(*h, x.(*URL)) }
+func (h *urlHeap) Pop() interface{} {
+	old := *h
+	url := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return url
+}
+
+// newestURLs returns the n newest URLs, newest first. Only the selected URLs
+// are sorted, so a page costs O(len(urls) log n) however large the store is.
+func newestURLs(urls []*URL, n int) []*URL {
+	if n >= len(urls) {
+		sort.Slice(urls, func(i, j int) bool {
+			return newestFirst(urls[i], urls[j])
+		})
+		return urls
+	}
+
+	h := make(urlHeap, 0, n)
+	for _, url := range urls {
+		if len(h) < n {
+			heap.Push(&h, url)
+		} else if newestFirst(url, h[0]) {
+			h[0] = url
+			heap.Fix(&h, 0)
+		}
+	}
+	sort.Slice(h, func(i, j int) bool {
+		return newestFirst(h[i], h[j])
+	})
+	return h
+}
+
+// precedes reports whether the cursor position comes before a URL in the listing
+func (c urlCursor) precedes(url *URL) bool {
+	return newestFirst(&URL{CreatedAt: c.createdAt, ShortCode: c.shortCode}, url)
+}
+
+// encodeURLCursor builds an opaque cursor pointing just past a URL
+func encodeURLCursor(url *URL) string {
+	raw := fmt.Sprintf("%d:%s", url.CreatedAt.UnixNano(), url.ShortCode)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeURLCursor parses a cursor produced by encodeURLCursor
+func decodeURLCursor(cursor string) (urlCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return urlCursor{}, err
+	}
+	nanos, code, found := strings.Cut(string(raw), ":")
+	if !found || code == "" {
+		return urlCursor{}, fmt.Errorf("malformed cursor")
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return urlCursor{}, err
+	}
+	return urlCursor{createdAt: time.Unix(0, n), shortCode: code}, nil
+}
+
+// Platform is the client platform a redirect is served to
+type Platform int
+
+const (
+	PlatformWeb Platform = iota
+	PlatformIOS
+	PlatformAndroid
+)
+
+func (p Platform) String() string {
+	switch p {
+	case PlatformIOS:
+		return "ios"
+	case PlatformAndroid:
+		return "android"
+	default:
+		return "web"
+	}
+}
+
+// ClassifyPlatform derives the client platform from a User-Agent header
+func ClassifyPlatform(userAgent string) Platform {
+	switch {
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"), strings.Contains(userAgent, "iPod"):
+		return PlatformIOS
+	case strings.Contains(userAgent, "Android"):
+		return PlatformAndroid
+	default:
+		return PlatformWeb
+	}
+}
+
+// defaultPreviewBots are User-Agent substrings of common link preview crawlers
+var defaultPreviewBots = []string{
+	"Slackbot",
+	"Twitterbot",
+	"facebookexternalhit",
+	"LinkedInBot",
+	"Discordbot",
+	"TelegramBot",
+	"WhatsApp",
+	"SkypeUriPreview",
+}
+
+// PreviewDetector recognizes link preview crawlers, whose fetches are
+// redirected normally but kept out of a link's access count
+type PreviewDetector struct {
+	patterns []string // Lowercased User-Agent substrings
+}
+
+// NewPreviewDetector creates a detector matching any of the given User-Agent
+// substrings case-insensitively
+func NewPreviewDetector(patterns []string) *PreviewDetector {
+	d := &PreviewDetector{patterns: make([]string, 0, len(patterns))}
+	for _, pattern := range patterns {
+		d.patterns = append(d.patterns, strings.ToLower(pattern))
+	}
+	return d
+}
+
+// IsPreview reports whether a request comes from a preview crawler. HEAD
+// requests never follow the redirect, so they are always treated as previews.
+// A nil detector treats every request as a click.
+func (d *PreviewDetector) IsPreview(method, userAgent string) bool {
+	if d == nil {
+		return false
+	}
+	if method == fiber.MethodHead {
+		return true
+	}
+	userAgent = strings.ToLower(userAgent)
+	for _, pattern := range d.patterns {
+		if strings.Contains(userAgent, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPlatformOverrides reports whether the URL redirects differently per platform
+func (u *URL) HasPlatformOverrides() bool {
+	return u.IOSURL != "" || u.AndroidURL != ""
+}
+
+// DestinationFor returns the redirect target for a platform, falling back to the web URL
+func (u *URL) DestinationFor(p Platform) string {
+	switch {
+	case p == PlatformIOS && u.IOSURL != "":
+		return u.IOSURL
+	case p == PlatformAndroid && u.AndroidURL != "":
+		return u.AndroidURL
+	default:
+		return u.Destination()
+	}
+}
+
+// Destination returns the URL's web destination
+func (u *URL) Destination() string {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.OriginalURL
+}
+
+// SetDestination repoints the URL's web destination
+func (u *URL) SetDestination(destination string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.OriginalURL = destination
+}
+
+// defaultRedirectStatus is used for links that don't specify a redirect
+// status, configured once at startup from DEFAULT_REDIRECT_STATUS
+var defaultRedirectStatus = fiber.StatusMovedPermanently
+
+// isAllowedRedirectStatus reports whether a link may use the given redirect status
+func isAllowedRedirectStatus(status int) bool {
+	switch status {
+	case fiber.StatusMovedPermanently, fiber.StatusFound, fiber.StatusTemporaryRedirect, fiber.StatusPermanentRedirect:
+		return true
+	default:
+		return false
+	}
+}
+
+// isPermanentRedirect reports whether clients may cache a redirect status indefinitely
+func isPermanentRedirect(status int) bool {
+	return status == fiber.StatusMovedPermanently || status == fiber.StatusPermanentRedirect
+}
+
+// Expiry returns when the URL expires, or nil if it never does
+func (u *URL) Expiry() *time.Time {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.ExpiresAt
+}
+
+// SetExpiry changes when the URL expires, nil removes the expiry. The time
+// is replaced rather than modified in place, so values returned by Expiry
+// stay valid.
+func (u *URL) SetExpiry(expiresAt *time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.ExpiresAt = expiresAt
+}
+
+// Expired reports whether the URL's expiry has passed at the given time
+func (u *URL) Expired(now time.Time) bool {
+	expiresAt := u.Expiry()
+	return expiresAt != nil && !now.Before(*expiresAt)
+}
+
+// DeletionTime returns when the URL was soft-deleted, or nil if it is live
+func (u *URL) DeletionTime() *time.Time {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.DeletedAt
+}
+
+// Deleted reports whether the URL is soft-deleted
+func (u *URL) Deleted() bool {
+	return u.DeletionTime() != nil
+}
+
+// Shareable reports whether a link may be returned for a repeated
+// destination instead of creating a new one: it still redirects and doesn't
+// need a password
+func (u *URL) Shareable(now time.Time) bool {
+	return !u.Deleted() && !u.Expired(now) && !u.ClicksExhausted() && !u.Protected()
+}
+
+// SameSettings reports whether two links behave alike apart from their code
+// and destination, so a request for one may be answered with the other
+func (u *URL) SameSettings(other *URL) bool {
+	expiresAt, otherExpiresAt := u.Expiry(), other.Expiry()
+	if (expiresAt == nil) != (otherExpiresAt == nil) || (expiresAt != nil && !expiresAt.Equal(*otherExpiresAt)) {
+		return false
+	}
+	return u.Owner() == other.Owner() &&
+		u.IOSURL == other.IOSURL &&
+		u.AndroidURL == other.AndroidURL &&
+		slices.Equal(u.QueryRules, other.QueryRules) &&
+		u.RedirectStatus == other.RedirectStatus &&
+		u.SignClicks == other.SignClicks &&
+		u.MaxClicks == other.MaxClicks &&
+		u.Campaign == other.Campaign &&
+		u.ForwardQuery == other.ForwardQuery &&
+		slices.Equal(u.Tags, other.Tags)
+}
+
+// ClicksExhausted reports whether a URL with MaxClicks has served all of them
+func (u *URL) ClicksExhausted() bool {
+	return u.MaxClicks > 0 && atomic.LoadInt64(&u.ClaimedClicks) >= u.MaxClicks
+}
+
+// ClicksLeft returns how many more redirects a URL with MaxClicks will
+// serve, nil when it is unlimited
+func (u *URL) ClicksLeft() *int64 {
+	if u.MaxClicks == 0 {
+		return nil
+	}
+	left := u.MaxClicks - atomic.LoadInt64(&u.ClaimedClicks)
+	if left < 0 {
+		left = 0
+	}
+	return &left
+}
+
+// StatusCode returns the redirect status used for the URL
+func (u *URL) StatusCode() int {
+	if u.RedirectStatus == 0 {
+		return defaultRedirectStatus
+	}
+	return u.RedirectStatus
 }
 
-// IncrementAccessCount increments the access count for a URL
-func (s *URLStore) IncrementAccessCount(shortCode string) bool {
-	value, exists := s.store.Load(shortCode)
-	if !exists {
-		return false
-	}
+// redirectCacheControl returns the Cache-Control header for a redirect. Permanent
+// redirects are cached for a day; temporary ones must be revalidated so links
+// that get repointed take effect, either immediately (maxAge 0) or after maxAge seconds.
+// Max-ages are shortened by earlyExpiryMaxAge so cached copies don't all expire at once.
+func redirectCacheControl(status int, temporaryMaxAge int, beta float64) string {
+	if isPermanentRedirect(status) {
+		maxAge := earlyExpiryMaxAge(86400, beta, 1-rand.Float64()) // Cache for ~24 hours
+		return fmt.Sprintf("public, max-age=%d", maxAge)
+	}
+	if temporaryMaxAge <= 0 {
+		return "no-cache"
+	}
+	maxAge := earlyExpiryMaxAge(temporaryMaxAge, beta, 1-rand.Float64())
+	return fmt.Sprintf("public, max-age=%d, must-revalidate", maxAge)
+}
+
+// metaRefreshPage redirects clients that can't follow a 3xx, such as some
+// email clients, with a link to click if the refresh is ignored too
+var metaRefreshPage = template.Must(template.New("refresh").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="0; url={{.}}">
+<title>Redirecting</title>
+</head>
+<body>
+<p>Redirecting to <a href="{{.}}">{{.}}</a></p>
+</body>
+</html>
+`))
+
+// earlyExpiryMaxAge applies XFetch-style probabilistic early expiration to a
+// TTL: it is reduced by beta * (ttl/10) * -ln(u) for u uniform in (0, 1], so
+// most responses expire close to the TTL and a few expire noticeably earlier,
+// spreading revalidations out. The result never drops below half the TTL;
+// beta 0 disables the jitter.
+func earlyExpiryMaxAge(ttl int, beta float64, u float64) int {
+	if beta <= 0 || ttl <= 1 || u <= 0 || u > 1 {
+		return ttl
+	}
+	early := beta * float64(ttl) / 10 * -math.Log(u)
+	if limit := float64(ttl) / 2; early > limit {
+		early = limit
+	}
+	return ttl - int(early)
+}
+
+// ResolveDestination picks the redirect target for a request. The first query
+// rule matching the incoming query string wins, then the platform override,
+// then the web default. On links with rules or ForwardQuery, query parameters
+// that aren't used for routing are forwarded to the chosen destination.
+func (u *URL) ResolveDestination(p Platform, rawQuery string) string {
+	if len(u.QueryRules) == 0 {
+		if !u.ForwardQuery || rawQuery == "" {
+			return u.DestinationFor(p)
+		}
+		query, _ := neturl.ParseQuery(rawQuery)
+		return appendQuery(u.DestinationFor(p), query)
+	}
+
+	query, _ := neturl.ParseQuery(rawQuery)
+
+	destination := ""
+rules:
+	for _, rule := range u.QueryRules {
+		for _, value := range query[rule.Param] {
+			if value == rule.Value {
+				destination = rule.Destination
+				break rules
+			}
+		}
+	}
+	if destination == "" {
+		destination = u.DestinationFor(p)
+	}
+
+	// Routing parameters are consumed; everything else is passed along
+	for _, rule := range u.QueryRules {
+		query.Del(rule.Param)
+	}
+	return appendQuery(destination, query)
+}
+
+// appendQuery merges extra query parameters into a destination URL. A
+// parameter already on the destination is replaced rather than duplicated, so
+// forwarded values can't pile up next to the destination's own.
+func appendQuery(destination string, extra neturl.Values) string {
+	if len(extra) == 0 {
+		return destination
+	}
+
+	parsed, err := neturl.Parse(destination)
+	if err != nil {
+		return destination
+	}
+
+	query := parsed.Query()
+	for key, values := range extra {
+		query[key] = values
+	}
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
+
+// validateQueryRules checks query rules supplied at creation time
+func validateQueryRules(rules []QueryRule, trusted *TrustedHosts) error {
+	if len(rules) > maxQueryRules {
+		return &ValidationError{Field: "query_rules", Message: fmt.Sprintf("At most %d query rules are allowed", maxQueryRules)}
+	}
+	for i, rule := range rules {
+		if rule.Param == "" {
+			return &ValidationError{Field: fmt.Sprintf("query_rules[%d].param", i), Message: "Query rule param is required"}
+		}
+		if err := checkDestination(rule.Destination, trusted); err != nil {
+			return &ValidationError{Field: fmt.Sprintf("query_rules[%d].destination", i), Message: "Invalid query rule destination provided: " + err.Error(), Reason: err.Error()}
+		}
+	}
+	return nil
+}
+
+// ValidationError reports which request field failed validation; its
+// message is returned to clients as-is
+type ValidationError struct {
+	Field   string
+	Message string
+	Reason  string // Short name of the rule that failed, Message when empty
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// Error codes of ErrorDetail
+const (
+	errorCodeValidation   = "VALIDATION"
+	errorCodeConflict     = "CONFLICT"
+	errorCodeLimitReached = "LIMIT_REACHED"
+	errorCodeInternal     = "INTERNAL"
+)
+
+// FieldError model, one request field that failed validation
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// ErrorDetail model, a machine-readable error with the fields at fault
+type ErrorDetail struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+// ErrorResponse model
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// validationDetail describes a validation failure; errors other than a
+// ValidationError carry no field
+func validationDetail(err error) ErrorDetail {
+	detail := ErrorDetail{Code: errorCodeValidation, Message: err.Error()}
+	var verr *ValidationError
+	if errors.As(err, &verr) && verr.Field != "" {
+		reason := verr.Reason
+		if reason == "" {
+			reason = verr.Message
+		}
+		detail.Fields = []FieldError{{Field: verr.Field, Reason: reason}}
+	}
+	return detail
+}
+
+// createErrorDetail describes a failure to store a link
+func createErrorDetail(err *fiber.Error) ErrorDetail {
+	code := errorCodeLimitReached
+	switch err.Code {
+	case fiber.StatusConflict:
+		code = errorCodeConflict
+	case fiber.StatusInternalServerError:
+		code = errorCodeInternal
+	}
+	return ErrorDetail{Code: code, Message: err.Message}
+}
+
+// sendValidationError answers 400 with a structured validation error
+func sendValidationError(c *fiber.Ctx, err error) error {
+	return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{Error: validationDetail(err)})
+}
+
+// validateCreateURLRequest applies the shorten validation rules to a request;
+// destinations on trusted hosts skip the scheme check
+func validateCreateURLRequest(req *CreateURLRequest, trusted *TrustedHosts) error {
+	// Basic URL validation
+	if err := checkDestination(req.URL, trusted); err != nil {
+		return &ValidationError{Field: "url", Message: "Invalid URL provided: " + err.Error(), Reason: err.Error()}
+	}
+
+	// Platform overrides are optional but must be valid when present
+	if req.IOSURL != "" {
+		if err := checkDestination(req.IOSURL, trusted); err != nil {
+			return &ValidationError{Field: "ios_url", Message: "Invalid platform URL provided: " + err.Error(), Reason: err.Error()}
+		}
+	}
+	if req.AndroidURL != "" {
+		if err := checkDestination(req.AndroidURL, trusted); err != nil {
+			return &ValidationError{Field: "android_url", Message: "Invalid platform URL provided: " + err.Error(), Reason: err.Error()}
+		}
+	}
+	if req.ExpiresIn < 0 {
+		return &ValidationError{Field: "expires_in", Message: "expires_in must not be negative"}
+	}
+	if req.ExpiresIn > 0 && req.ExpiresAt != nil {
+		return &ValidationError{Field: "expires_in", Message: "Only one of expires_in and expires_at may be set"}
+	}
+	if req.MaxClicks < 0 {
+		return &ValidationError{Field: "max_clicks", Message: "max_clicks must not be negative"}
+	}
+	if len(req.Password) > maxPasswordLength {
+		return &ValidationError{Field: "password", Message: fmt.Sprintf("password must be at most %d bytes", maxPasswordLength)}
+	}
+	if req.RedirectStatus != 0 && !isAllowedRedirectStatus(req.RedirectStatus) {
+		return &ValidationError{Field: "redirect_status", Message: "Invalid redirect status provided"}
+	}
+	if len(req.Campaign) > maxCampaignLength || strings.ContainsRune(req.Campaign, '/') {
+		return &ValidationError{Field: "campaign", Message: fmt.Sprintf("Campaign must be at most %d characters without slashes", maxCampaignLength)}
+	}
+	if req.CustomCode != "" {
+		if err := validateCustomCode(req.CustomCode); err != nil {
+			return err
+		}
+	}
+	return validateQueryRules(req.QueryRules, trusted)
+}
+
+// Alphabets for generated short codes
+const (
+	shortCodeAlphabet          = "_-0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	lowercaseShortCodeAlphabet = "_-0123456789abcdefghijklmnopqrstuvwxyz" // Case-insensitive codes
+)
+
+// maxCodeAttempts bounds how many random codes Insert tries before giving up
+const maxCodeAttempts = 10
+
+// Errors from storing a URL under a short code
+var (
+	errCodeTaken       = errors.New("short code is already taken")
+	errNoCodeAvailable = errors.New("no free short code found")
+)
+
+// Bounds for URL_ID_LENGTH
+const (
+	minIDLength = 8
+	maxIDLength = 64
+)
+
+// idLength is the length of the internal URL.ID of new links; configured once
+// at startup from URL_ID_LENGTH. Existing IDs keep their length.
+var idLength = 10
+
+// defaultCodeLength is the length of generated short codes, excluding any
+// check character, unless CODE_LENGTH overrides it
+const defaultCodeLength = 6
+
+// newShortURL builds a URL with a freshly generated ID from a validated
+// request; the short code is assigned when it is inserted into the store
+func newShortURL(req *CreateURLRequest, now time.Time) *URL {
+	// Generate unique ID
+	id, _ := gonanoid.New(idLength)
+
+	expiresAt := req.ExpiresAt
+	if req.ExpiresIn > 0 {
+		t := now.Add(time.Duration(req.ExpiresIn) * time.Second)
+		expiresAt = &t
+	}
+
+	// The length was validated, so hashing can't fail
+	var passwordHash string
+	if req.Password != "" {
+		passwordHash, _ = hashPassword(req.Password)
+	}
+
+	return &URL{
+		ID:             id,
+		OriginalURL:    req.URL,
+		CreatedAt:      now,
+		AccessCount:    0,
+		IOSURL:         req.IOSURL,
+		AndroidURL:     req.AndroidURL,
+		OwnerID:        req.OwnerID,
+		QueryRules:     req.QueryRules,
+		RedirectStatus: req.RedirectStatus,
+		SignClicks:     req.SignClicks,
+		ExpiresAt:      expiresAt,
+		MaxClicks:      req.MaxClicks,
+		PasswordHash:   passwordHash,
+		Campaign:       req.Campaign,
+		ForwardQuery:   req.ForwardQuery,
+		Tags:           req.Tags,
+		History:        []LinkEvent{{Type: eventCreated, At: now}},
+	}
+}
+
+// checkURL explains why s isn't an absolute http(s) URL with a host
+func checkURL(s string) error {
+	if s == "" {
+		return errors.New("missing URL")
+	}
+	if parsed, err := neturl.Parse(s); err == nil && parsed.Scheme == "" {
+		return errors.New("missing scheme")
+	}
+	parsed, err := neturl.ParseRequestURI(s)
+	if err != nil {
+		return errors.New("must be an absolute URL")
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return errors.New("scheme must be http or https")
+	}
+	if parsed.Hostname() == "" {
+		return errors.New("missing host")
+	}
+	return nil
+}
+
+// isValidURL performs basic URL validation
+func isValidURL(s string) bool {
+	return checkURL(s) == nil
+}
+
+// checkDestination accepts http(s) URLs, and any URL on a trusted host
+func checkDestination(s string, trusted *TrustedHosts) error {
+	if trusted.Trusts(s) {
+		return nil
+	}
+	return checkURL(s)
+}
+
+// isValidDestination accepts http(s) URLs, and any URL on a trusted host
+func isValidDestination(s string, trusted *TrustedHosts) bool {
+	return checkDestination(s, trusted) == nil
+}
+
+// normalizeURL lowercases the scheme and host and drops a default port,
+// leaving the rest of the URL (and unparseable input) untouched
+func normalizeURL(rawURL string) string {
+	parsed, err := neturl.Parse(rawURL)
+	if err != nil || parsed.Host == "" {
+		return rawURL
+	}
+	host := strings.ToLower(parsed.Host)
+	if port := parsed.Port(); (parsed.Scheme == "http" && port == "80") || (parsed.Scheme == "https" && port == "443") {
+		host = strings.TrimSuffix(host, ":"+port)
+	}
+	if host == parsed.Host && strings.HasPrefix(rawURL, parsed.Scheme+":") {
+		return rawURL
+	}
+	parsed.Host = host
+	return parsed.String()
+}
+
+// normalize canonicalizes every destination of a request in place
+func (req *CreateURLRequest) normalize() {
+	req.URL = normalizeURL(req.URL)
+	if req.IOSURL != "" {
+		req.IOSURL = normalizeURL(req.IOSURL)
+	}
+	if req.AndroidURL != "" {
+		req.AndroidURL = normalizeURL(req.AndroidURL)
+	}
+	for i := range req.QueryRules {
+		req.QueryRules[i].Destination = normalizeURL(req.QueryRules[i].Destination)
+	}
+}
+
+// parseDuration extends time.ParseDuration with a "d" (day) suffix, e.g. "7d"
+func parseDuration(value string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(value, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// collapseSlashes replaces every run of "/" in a path with a single "/"
+func collapseSlashes(path string) string {
+	var b strings.Builder
+	b.Grow(len(path))
+	for i := 0; i < len(path); i++ {
+		if path[i] == '/' && i > 0 && path[i-1] == '/' {
+			continue
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// splitList splits a comma-separated env value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// requireAdmin guards admin routes with a bearer token; admin routes are
+// disabled entirely when no token is configured
+func requireAdmin(token string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if token == "" {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Admin API disabled"})
+		}
+		if !validAdminToken(c, token) {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+		return c.Next()
+	}
+}
+
+// validAdminToken reports whether the request carries the admin bearer token,
+// always false when no token is configured
+func validAdminToken(c *fiber.Ctx, token string) bool {
+	provided := strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	return token != "" && subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1
+}
+
+// validAPIKey reports whether the request's X-API-Key header matches one of
+// keys. Every key is compared so the time taken doesn't reveal which one came
+// closest.
+func validAPIKey(c *fiber.Ctx, keys []string) bool {
+	provided := []byte(c.Get("X-API-Key"))
+	matched := 0
+	for _, key := range keys {
+		matched |= subtle.ConstantTimeCompare(provided, []byte(key))
+	}
+	return len(provided) > 0 && matched == 1
+}
+
+// requireAPIKey guards routes with an X-API-Key header matching one of keys;
+// it lets every request through when no keys are configured
+func requireAPIKey(keys []string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if len(keys) > 0 && !validAPIKey(c, keys) {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+		return c.Next()
+	}
+}
+
+// publicAPIPaths are the API paths served without an API key: per-link info
+// and QR codes, destination validation, and admin routes, which need
+// ADMIN_TOKEN instead. Entries ending in a slash match every path below them.
+var publicAPIPaths = []string{"/api/admin/", "/api/info/", "/api/qr/", "/api/validate"}
+
+// publicAPIPath reports whether path is open without an API key
+func publicAPIPath(path string) bool {
+	for _, public := range publicAPIPaths {
+		if path == public || (strings.HasSuffix(public, "/") && strings.HasPrefix(path, public)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBaseURL validates a base URL for short links, an http(s) URL without
+// query or fragment, and returns it without a trailing slash
+func parseBaseURL(raw string) (string, bool) {
+	parsed, err := neturl.Parse(raw)
+	if err != nil || !isValidURL(raw) || parsed.RawQuery != "" || parsed.Fragment != "" {
+		return "", false
+	}
+	return strings.TrimSuffix(raw, "/"), true
+}
+
+// RetryAfterFormat selects how Retry-After header values are rendered
+type RetryAfterFormat string
+
+const (
+	RetryAfterSeconds  RetryAfterFormat = "seconds"
+	RetryAfterHTTPDate RetryAfterFormat = "http-date"
+)
+
+// retryAfterFormat is configured once at startup from RETRY_AFTER_FORMAT
+var retryAfterFormat = RetryAfterSeconds
+
+// ParseRetryAfterFormat validates a RETRY_AFTER_FORMAT value
+func ParseRetryAfterFormat(value string) (RetryAfterFormat, error) {
+	switch RetryAfterFormat(strings.ToLower(value)) {
+	case "", RetryAfterSeconds:
+		return RetryAfterSeconds, nil
+	case RetryAfterHTTPDate:
+		return RetryAfterHTTPDate, nil
+	default:
+		return "", fmt.Errorf("must be %q or %q", RetryAfterSeconds, RetryAfterHTTPDate)
+	}
+}
+
+// Value renders a wait duration as delta-seconds (rounded up) or as an HTTP-date
+func (f RetryAfterFormat) Value(wait time.Duration, now time.Time) string {
+	if wait < 0 {
+		wait = 0
+	}
+	if f == RetryAfterHTTPDate {
+		return now.Add(wait).UTC().Format(http.TimeFormat)
+	}
+	seconds := int64((wait + time.Second - 1) / time.Second)
+	return fmt.Sprintf("%d", seconds)
+}
+
+// SetRetryAfter sets the Retry-After header on a 429/503 response in the configured format
+func SetRetryAfter(c *fiber.Ctx, wait time.Duration) {
+	c.Set(fiber.HeaderRetryAfter, retryAfterFormat.Value(wait, time.Now()))
+}
+
+// URLStore is a high-performance URL storage
+type URLStore struct {
+	store      sync.Map // Use sync.Map instead of map with mutex for better concurrency
+	urlCount   atomic.Int64
+	clickCount atomic.Int64
+
+	slotsMu  sync.Mutex // Serializes ReserveSlot's check against the reservations in flight
+	reserved int64      // Slots reserved by creates that haven't been inserted yet
+
+	now       func() time.Time                                // Injectable clock, time.Now outside of tests
+	newCode   func(alphabet string, size int) (string, error) // Injectable code generator, gonanoid.Generate outside of tests
+	location  *time.Location                                  // Timezone used for time-bucketed analytics
+	retention time.Duration                                   // How long per-day analytics are kept, 0 keeps them forever
+
+	foldCase bool // Match short codes case-insensitively
+	checksum bool // Append a check character to generated short codes
+
+	codeLength   int    // Length of generated codes, excluding any check character
+	codeAlphabet string // Custom alphabet for generated codes, empty for the built-in one
+
+	codeStrategy CodeStrategy
+	codeSalt     string // Mixed into hashed codes so they can't be predicted from the URL alone
+
+	trusted   *TrustedHosts // Destinations accepted regardless of scheme on import
+	blocklist *Blocklist    // Destinations refused on import, unless trusted
+
+	persister URLPersister // Optional durable storage, written behind the in-memory store
+	lazy      bool         // URLs missing from memory are looked up in the persister
+	dirty     sync.Map     // Short code -> *URL changed since the last flush
+	deleted   sync.Map     // Short codes removed since the last flush
+
+	flushMu         sync.Mutex // Serializes flushes with closing the persister
+	persisterClosed bool       // Guarded by flushMu
+
+	byID          sync.Map // Secondary index: URL.ID -> short code
+	urlByOriginal sync.Map // Secondary index: original URL -> short code of its newest link
+
+	ownerMu sync.RWMutex
+	byOwner map[string]map[string]struct{} // Owner ID -> short codes
+}
+
+// NewURLStore creates a new URLStore
+func NewURLStore() *URLStore {
+	return &URLStore{
+		now:        time.Now,
+		newCode:    gonanoid.Generate,
+		location:   time.Local,
+		codeLength: defaultCodeLength,
+		byOwner:    make(map[string]map[string]struct{}),
+	}
+}
+
+// SetClock replaces the clock used for timestamps and analytics buckets
+func (s *URLStore) SetClock(now func() time.Time) {
+	s.now = now
+}
+
+// SetCodeGenerator replaces the random generator used for short codes
+func (s *URLStore) SetCodeGenerator(newCode func(alphabet string, size int) (string, error)) {
+	s.newCode = newCode
+}
+
+// SetLocation sets the timezone used for time-bucketed analytics
+func (s *URLStore) SetLocation(location *time.Location) {
+	s.location = location
+}
+
+// SetRetention sets how long per-day analytics are kept
+func (s *URLStore) SetRetention(retention time.Duration) {
+	s.retention = retention
+}
+
+// Retention returns how long per-day analytics are kept, 0 means forever
+func (s *URLStore) Retention() time.Duration {
+	return s.retention
+}
+
+// SetCaseInsensitive makes short code lookups ignore case. It must be set
+// before any URL is added, since keys are folded when stored.
+func (s *URLStore) SetCaseInsensitive(foldCase bool) {
+	s.foldCase = foldCase
+}
+
+// CodeAlphabet returns the alphabet new short codes should be generated
+// from: CODE_ALPHABET when set, otherwise the built-in one. Case-insensitive
+// stores only generate lowercase codes so no two codes fold to the same key.
+func (s *URLStore) CodeAlphabet() string {
+	if s.codeAlphabet != "" {
+		return s.codeAlphabet
+	}
+	if s.foldCase {
+		return lowercaseShortCodeAlphabet
+	}
+	return shortCodeAlphabet
+}
+
+// SetCodeConfig sets the length and alphabet of generated short codes
+func (s *URLStore) SetCodeConfig(config CodeConfig) {
+	s.codeLength = config.Length
+	s.codeAlphabet = config.Alphabet
+}
+
+// SetChecksum makes generated short codes end with a Luhn mod N check
+// character so mistyped codes can be detected before lookup
+func (s *URLStore) SetChecksum(checksum bool) {
+	s.checksum = checksum
+}
+
+// SetCodeStrategy selects how codes are generated for new links, with the
+// salt used by the hash strategy
+func (s *URLStore) SetCodeStrategy(strategy CodeStrategy, salt string) {
+	s.codeStrategy = strategy
+	s.codeSalt = salt
+}
+
+// SetTrustedHosts sets the hosts whose destinations are imported regardless of scheme
+func (s *URLStore) SetTrustedHosts(trusted *TrustedHosts) {
+	s.trusted = trusted
+}
+
+// SetBlocklist sets the hosts whose destinations are refused on import
+func (s *URLStore) SetBlocklist(blocklist *Blocklist) {
+	s.blocklist = blocklist
+}
+
+// NewShortCode generates a random short code, with a check character when enabled
+func (s *URLStore) NewShortCode() (string, error) {
+	shortCode, err := s.newCode(s.CodeAlphabet(), s.codeLength)
+	if err != nil {
+		return "", err
+	}
+	return s.withCheckChar(shortCode), nil
+}
+
+// withCheckChar appends the check character to a code when checksums are enabled
+func (s *URLStore) withCheckChar(shortCode string) string {
+	if !s.checksum {
+		return shortCode
+	}
+	check, _ := luhnCheckChar(shortCode, s.CodeAlphabet())
+	return shortCode + string(check)
+}
+
+// key returns the map key for a short code
+func (s *URLStore) key(shortCode string) string {
+	if s.foldCase {
+		return strings.ToLower(shortCode)
+	}
+	return shortCode
+}
+
+// Now returns the current time according to the store's clock
+func (s *URLStore) Now() time.Time {
+	return s.now()
+}
+
+// Location returns the timezone used for time-bucketed analytics
+func (s *URLStore) Location() *time.Location {
+	return s.location
+}
+
+// Add stores a URL under shortCode, returning errCodeTaken without storing
+// anything if the code (compared in folded form) is already in use
+func (s *URLStore) Add(shortCode string, url *URL) error {
+	if s.lazy {
+		s.load(shortCode) // The code may only be taken in the persister
+	}
+	if _, taken := s.store.LoadOrStore(s.key(shortCode), url); taken {
+		return errCodeTaken
+	}
+	s.index(shortCode, url)
+	return nil
+}
+
+// Insert assigns a short code to a newly created URL and stores it. With the
+// hash strategy a URL whose destination was already shortened with the same
+// settings is not stored; the existing URL is returned instead, with created
+// reporting false.
+// Protected URLs always get a random code so they are never merged with
+// another link.
+func (s *URLStore) Insert(url *URL) (stored *URL, created bool, err error) {
+	if s.codeStrategy == CodeStrategyHash && !url.Protected() {
+		if hashed, created := s.insertHashed(url); hashed != nil {
+			return hashed, created, nil
+		}
+		// Every prefix of the digest is taken, fall back to a random code
+	}
+
+	if err := s.InsertRandom(url); err != nil {
+		return nil, false, err
+	}
+	return url, true, nil
+}
+
+// InsertRandom stores a newly created URL under a random short code whatever
+// the code strategy, drawing a new code on collision up to maxCodeAttempts
+// times
+func (s *URLStore) InsertRandom(url *URL) error {
+	for attempt := 0; attempt < maxCodeAttempts; attempt++ {
+		shortCode, err := s.NewShortCode()
+		if err != nil {
+			return err
+		}
+		url.ShortCode = shortCode
+		if err := s.Add(shortCode, url); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w after %d attempts", errNoCodeAvailable, maxCodeAttempts)
+}
+
+// index counts a newly stored URL and adds it to the secondary indexes. A
+// soft-deleted URL, e.g. from a snapshot, is stored without either.
+func (s *URLStore) index(shortCode string, url *URL) {
+	s.markDirty(url)
+	if !url.Deleted() {
+		s.indexLive(shortCode, url)
+	}
+}
+
+// indexLive adds a live URL and its clicks to the counts and secondary indexes
+func (s *URLStore) indexLive(shortCode string, url *URL) {
+	s.urlCount.Add(1)
+	s.indexCounted(shortCode, url)
+}
+
+// indexCounted adds a live URL's clicks and index entries for a URL already in
+// the URL count, such as a lazily loaded one counted by LoadLazily
+func (s *URLStore) indexCounted(shortCode string, url *URL) {
+	s.clickCount.Add(atomic.LoadInt64(&url.AccessCount))
+	if url.ID != "" {
+		s.byID.Store(url.ID, shortCode)
+	}
+	s.urlByOriginal.Store(url.Destination(), shortCode)
+	s.indexOwner(shortCode, "", url.Owner())
+}
+
+// unindex takes a URL and its clicks out of the counts and secondary indexes
+func (s *URLStore) unindex(url *URL) {
+	s.urlCount.Add(-1)
+	s.clickCount.Add(-atomic.LoadInt64(&url.AccessCount))
+	if url.ID != "" {
+		s.byID.CompareAndDelete(url.ID, url.ShortCode)
+	}
+	s.urlByOriginal.CompareAndDelete(url.Destination(), url.ShortCode)
+	s.indexOwner(url.ShortCode, url.Owner(), "")
+}
+
+// GetByID looks up a URL by its internal ID
+func (s *URLStore) GetByID(id string) (*URL, bool) {
+	shortCode, exists := s.byID.Load(id)
+	if !exists {
+		return nil, false
+	}
+	return s.Get(shortCode.(string))
+}
+
+// GetByOriginal looks up the newest link to exactly this destination
+func (s *URLStore) GetByOriginal(originalURL string) (*URL, bool) {
+	shortCode, exists := s.urlByOriginal.Load(originalURL)
+	if !exists {
+		return nil, false
+	}
+	return s.Get(shortCode.(string))
+}
+
+// Repoint changes a URL's web destination, keeping the original URL index in sync
+func (s *URLStore) Repoint(url *URL, destination string) {
+	oldDestination := url.Destination()
+	url.SetDestination(destination)
+	s.urlByOriginal.CompareAndDelete(oldDestination, url.ShortCode)
+	s.urlByOriginal.Store(destination, url.ShortCode)
+	s.markDirty(url)
+}
+
+// indexOwner moves a short code between per-owner index entries
+func (s *URLStore) indexOwner(shortCode, oldOwner, newOwner string) {
+	s.ownerMu.Lock()
+	defer s.ownerMu.Unlock()
+
+	if codes, exists := s.byOwner[oldOwner]; exists && oldOwner != "" {
+		delete(codes, shortCode)
+		if len(codes) == 0 {
+			delete(s.byOwner, oldOwner)
+		}
+	}
+	if newOwner != "" {
+		if s.byOwner[newOwner] == nil {
+			s.byOwner[newOwner] = make(map[string]struct{})
+		}
+		s.byOwner[newOwner][shortCode] = struct{}{}
+	}
+}
+
+// Transfer reassigns a URL to a new owner, keeping the owner index in sync
+func (s *URLStore) Transfer(shortCode, ownerID string) (*URL, bool) {
+	url, exists := s.Get(shortCode)
+	if !exists {
+		return nil, false
+	}
+
+	url.mu.Lock()
+	oldOwner := url.OwnerID
+	url.OwnerID = ownerID
+	url.appendEvent(LinkEvent{Type: eventUpdated, At: s.now(), Detail: fmt.Sprintf("owner changed from %q to %q", oldOwner, ownerID)})
+	url.mu.Unlock()
+
+	s.indexOwner(url.ShortCode, oldOwner, ownerID)
+	s.markDirty(url)
+	return url, true
+}
+
+// ListExpiring returns URLs that have an expiry within the given window from
+// now and haven't expired yet, soonest first
+func (s *URLStore) ListExpiring(within time.Duration) []*URL {
+	now := s.now()
+	deadline := now.Add(within)
+
+	type expiring struct {
+		url       *URL
+		expiresAt time.Time
+	}
+	var matches []expiring
+	s.rangeLive(func(url *URL) bool {
+		if expiresAt := url.Expiry(); expiresAt != nil && now.Before(*expiresAt) && !expiresAt.After(deadline) {
+			matches = append(matches, expiring{url, *expiresAt})
+		}
+		return true
+	})
+
+	sort.Slice(matches, func(i, j int) bool {
+		if !matches[i].expiresAt.Equal(matches[j].expiresAt) {
+			return matches[i].expiresAt.Before(matches[j].expiresAt)
+		}
+		return matches[i].url.ShortCode < matches[j].url.ShortCode
+	})
+
+	urls := make([]*URL, 0, len(matches))
+	for _, match := range matches {
+		urls = append(urls, match.url)
+	}
+	return urls
+}
+
+// ListUnused returns URLs that have never been clicked and were created
+// before the cutoff, newest first. Expired URLs are left to the sweeper.
+func (s *URLStore) ListUnused(createdBefore time.Time) []*URL {
+	now := s.now()
+	urls := make([]*URL, 0)
+	s.rangeLive(func(url *URL) bool {
+		if atomic.LoadInt64(&url.AccessCount) == 0 && url.CreatedAt.Before(createdBefore) && !url.Expired(now) {
+			urls = append(urls, url)
+		}
+		return true
+	})
+
+	sort.Slice(urls, func(i, j int) bool {
+		return newestFirst(urls[i], urls[j])
+	})
+	return urls
+}
+
+// ListByOwner returns the URLs owned by the given owner that haven't expired
+func (s *URLStore) ListByOwner(ownerID string) []*URL {
+	s.ownerMu.RLock()
+	codes := make([]string, 0, len(s.byOwner[ownerID]))
+	for code := range s.byOwner[ownerID] {
+		codes = append(codes, code)
+	}
+	s.ownerMu.RUnlock()
+
+	urls := make([]*URL, 0, len(codes))
+	now := s.now()
+	for _, code := range codes {
+		if url, exists := s.Get(code); exists && !url.Expired(now) {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// Get a URL by short code; soft-deleted URLs are not found
+func (s *URLStore) Get(shortCode string) (*URL, bool) {
+	url, exists := s.load(shortCode)
+	if !exists || url.Deleted() {
+		return nil, false
+	}
+	return url, true
+}
+
+// load a URL by short code, including a soft-deleted one. When URLs are
+// loaded lazily a miss is looked up in the persister.
+func (s *URLStore) load(shortCode string) (*URL, bool) {
+	value, exists := s.store.Load(s.key(shortCode))
+	if !exists && s.lazy {
+		if _, err := s.fetch([]string{shortCode}); err != nil {
+			log.Printf("Persistence: loading %s failed: %v", shortCode, err)
+		}
+		value, exists = s.store.Load(s.key(shortCode))
+	}
+	if !exists {
+		return nil, false
+	}
+	return value.(*URL), true
+}
+
+// IncrementAccessCount increments the access count for a URL
+func (s *URLStore) IncrementAccessCount(shortCode string) bool {
+	return s.RecordClick(Click{ShortCode: shortCode, At: s.now()})
+}
+
+// ClaimClick reserves one of a URL's MaxClicks for a redirect about to be
+// served, returning false once they are all used. It runs before the redirect
+// rather than in RecordClick, which is applied asynchronously, and the
+// compare-and-swap keeps concurrent redirects from exceeding the limit.
+func (s *URLStore) ClaimClick(url *URL) bool {
+	if url.MaxClicks == 0 {
+		return true
+	}
+	for {
+		claimed := atomic.LoadInt64(&url.ClaimedClicks)
+		if claimed >= url.MaxClicks {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&url.ClaimedClicks, claimed, claimed+1) {
+			s.markDirty(url)
+			return true
+		}
+	}
+}
+
+// RecordClick counts a click against a URL, bucketing it by the time it
+// happened and attributing it to its referrer when one is given. Clicks on a
+// soft-deleted URL, queued before it was deleted, are dropped so they don't
+// count towards the store's total.
+func (s *URLStore) RecordClick(click Click) bool {
+	value, exists := s.store.Load(s.key(click.ShortCode))
+	if !exists {
+		return false
+	}
+
+	url := value.(*URL)
+	if url.Deleted() {
+		return false
+	}
+	s.markDirty(url)
+	if click.Preview {
+		atomic.AddInt64(&url.PreviewHits, 1)
+		return true
+	}
+
+	atomic.AddInt64(&url.AccessCount, 1)
+	s.clickCount.Add(1) // Update total click count
+
+	// Bucket the click by hour of day and by day in the configured timezone
+	at := click.At.In(s.location)
+	atomic.AddInt64(&url.HourlyClicks[at.Hour()], 1)
+
+	url.statsMu.Lock()
+	defer url.statsMu.Unlock()
+
+	if url.DailyClicks == nil {
+		url.DailyClicks = make(map[string]int64)
+	}
+	url.DailyClicks[at.Format(dayLayout)]++
+
+	minute := click.At.Unix() / 60
+	if url.MinuteClicks == nil {
+		url.MinuteClicks = make(map[int64]int64)
+	}
+	if _, exists := url.MinuteClicks[minute]; !exists && len(url.MinuteClicks) >= clickHistoryMinutes {
+		// Only scan for stale buckets once the map could hold any
+		for m := range url.MinuteClicks {
+			if m <= minute-clickHistoryMinutes {
+				delete(url.MinuteClicks, m)
+			}
+		}
+	}
+	url.MinuteClicks[minute]++
+
+	if click.Referrer != "" {
+		if url.Referrers == nil {
+			url.Referrers = make(map[string]int64)
+		}
+		host := click.Referrer
+		if _, tracked := url.Referrers[host]; !tracked && len(url.Referrers) >= maxReferrersPerURL {
+			host = otherReferrer
+		}
+		url.Referrers[host]++
+	}
+
+	if click.UserAgent != "" {
+		if url.UserAgents == nil {
+			url.UserAgents = make(map[string]int64)
+		}
+		userAgent := click.UserAgent
+		if _, tracked := url.UserAgents[userAgent]; !tracked && len(url.UserAgents) >= maxUserAgentsPerURL {
+			userAgent = otherReferrer
+		}
+		url.UserAgents[userAgent]++
+	}
+
+	// No need to store back since we're modifying the pointer's data
+	return true
+}
+
+// busiestFirst returns the keys of counts with the most clicks first, ties in
+// key order, keeping at most limit (0 keeps all)
+func busiestFirst(counts map[string]int64, limit int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+// Sources returns a URL's busiest referrer hosts and User-Agents, at most
+// limit of each
+func (u *URL) Sources(limit int) ([]ReferrerCount, []UserAgentCount) {
+	u.statsMu.Lock()
+	defer u.statsMu.Unlock()
+
+	hosts := busiestFirst(u.Referrers, limit)
+	referrers := make([]ReferrerCount, len(hosts))
+	for i, host := range hosts {
+		referrers[i] = ReferrerCount{Host: host, Clicks: u.Referrers[host]}
+	}
+
+	agents := busiestFirst(u.UserAgents, limit)
+	userAgents := make([]UserAgentCount, len(agents))
+	for i, agent := range agents {
+		userAgents[i] = UserAgentCount{UserAgent: agent, Clicks: u.UserAgents[agent]}
+	}
+	return referrers, userAgents
+}
+
+// TopReferrers aggregates referrer counts across every URL in a single pass,
+// returning the busiest hosts first
+func (s *URLStore) TopReferrers(limit int) []ReferrerCount {
+	totals := make(map[string]int64)
+	s.rangeLive(func(url *URL) bool {
+		url.statsMu.Lock()
+		for host, clicks := range url.Referrers {
+			totals[host] += clicks
+		}
+		url.statsMu.Unlock()
+		return true
+	})
+
+	referrers := make([]ReferrerCount, 0, len(totals))
+	for host, clicks := range totals {
+		referrers = append(referrers, ReferrerCount{Host: host, Clicks: clicks})
+	}
+	sort.Slice(referrers, func(i, j int) bool {
+		if referrers[i].Clicks != referrers[j].Clicks {
+			return referrers[i].Clicks > referrers[j].Clicks
+		}
+		return referrers[i].Host < referrers[j].Host
+	})
+
+	if limit > 0 && len(referrers) > limit {
+		referrers = referrers[:limit]
+	}
+	return referrers
+}
+
+// DailyClicks returns a URL's clicks on each of the last days days (today
+// included), oldest first, filling days without clicks with zero
+func (s *URLStore) DailyClicks(url *URL, days int) []DailyClickCount {
+	dates, _ := s.dayWindow(days)
+	series := make([]DailyClickCount, days)
+	url.statsMu.Lock()
+	for i, date := range dates {
+		series[i] = DailyClickCount{Date: date, Clicks: url.DailyClicks[date]}
+	}
+	url.statsMu.Unlock()
+	return series
+}
+
+// HourlyClicks returns a snapshot of the hour-of-day click histogram for a URL
+func (s *URLStore) HourlyClicks(url *URL) [24]int64 {
+	var hours [24]int64
+	for i := range hours {
+		hours[i] = atomic.LoadInt64(&url.HourlyClicks[i])
+	}
+	return hours
+}
+
+// TrimAnalytics drops per-day analytics older than the retention window
+// across all URLs, returning the number of day buckets removed. Aggregate
+// totals (access counts and the hourly histogram) are left intact.
+func (s *URLStore) TrimAnalytics() int {
+	if s.retention <= 0 {
+		return 0
+	}
+
+	// Day keys sort lexically, so anything before the cutoff day is expired
+	cutoff := s.now().Add(-s.retention).In(s.location).Format(dayLayout)
+
+	removed := 0
+	s.store.Range(func(key, value interface{}) bool {
+		url := value.(*URL)
+		url.statsMu.Lock()
+		for day := range url.DailyClicks {
+			if day < cutoff {
+				delete(url.DailyClicks, day)
+				removed++
+				s.markDirty(url)
+			}
+		}
+		url.statsMu.Unlock()
+		return true
+	})
+	return removed
+}
+
+// ClicksSince counts a URL's clicks in minutes starting at or after since
+func (s *URLStore) ClicksSince(url *URL, since time.Time) int64 {
+	// Round up so a partially elapsed minute before since isn't counted
+	from := (since.Unix() + 59) / 60
+
+	var clicks int64
+	url.statsMu.Lock()
+	for minute, count := range url.MinuteClicks {
+		if minute >= from {
+			clicks += count
+		}
+	}
+	url.statsMu.Unlock()
+	return clicks
+}
+
+// dayWindow returns the last days dates (today included, oldest first) in
+// the store's timezone, along with each date's position
+func (s *URLStore) dayWindow(days int) ([]string, map[string]int) {
+	now := s.now().In(s.location)
+	dates := make([]string, days)
+	index := make(map[string]int, days)
+	for i := range dates {
+		day := time.Date(now.Year(), now.Month(), now.Day()-(days-1-i), 0, 0, 0, 0, s.location)
+		dates[i] = day.Format(dayLayout)
+		index[dates[i]] = i
+	}
+	return dates, index
+}
+
+// CreationsPerDay counts the links created on each of the last days days
+// (today included), oldest first, filling days without new links with zero
+func (s *URLStore) CreationsPerDay(days int) []DailyCreationCount {
+	dates, index := s.dayWindow(days)
+	series := make([]DailyCreationCount, days)
+	for i, date := range dates {
+		series[i].Date = date
+	}
+
+	s.rangeLive(func(url *URL) bool {
+		created := url.CreatedAt.In(s.location).Format(dayLayout)
+		if i, inRange := index[created]; inRange {
+			series[i].Links++
+		}
+		return true
+	})
+	return series
+}
+
+// RecentCreations counts the links created within the last hour, day and
+// week in a single pass over the store
+func (s *URLStore) RecentCreations() (hour, day, week int) {
+	now := s.now()
+	hourAgo, dayAgo, weekAgo := now.Add(-time.Hour), now.Add(-24*time.Hour), now.Add(-7*24*time.Hour)
+
+	s.rangeLive(func(url *URL) bool {
+		created := url.CreatedAt
+		if created.After(weekAgo) {
+			week++
+			if created.After(dayAgo) {
+				day++
+				if created.After(hourAgo) {
+					hour++
+				}
+			}
+		}
+		return true
+	})
+	return hour, day, week
+}
+
+// CodeLengths counts stored short codes by length, shortest first, in a
+// single pass over the store. Expired links still hold their codes, so they
+// are counted.
+func (s *URLStore) CodeLengths() []CodeLengthCount {
+	counts := make(map[int]int)
+	s.rangeLive(func(url *URL) bool {
+		counts[len(url.ShortCode)]++
+		return true
+	})
+
+	lengths := make([]CodeLengthCount, 0, len(counts))
+	for length, count := range counts {
+		lengths = append(lengths, CodeLengthCount{Length: length, Count: count})
+	}
+	sort.Slice(lengths, func(i, j int) bool {
+		return lengths[i].Length < lengths[j].Length
+	})
+	return lengths
+}
+
+// CampaignTimeseries sums the per-day clicks of every link in a campaign over
+// the last days days (today included), filling days without clicks with zero.
+// It also returns how many links belong to the campaign.
+func (s *URLStore) CampaignTimeseries(campaign string, days int) ([]DailyClickCount, int) {
+	dates, index := s.dayWindow(days)
+	series := make([]DailyClickCount, days)
+	for i, date := range dates {
+		series[i].Date = date
+	}
+
+	links := 0
+	s.rangeLive(func(url *URL) bool {
+		if url.Campaign != campaign {
+			return true
+		}
+		links++
+
+		url.statsMu.Lock()
+		for day, clicks := range url.DailyClicks {
+			if i, inRange := index[day]; inRange {
+				series[i].Clicks += clicks
+			}
+		}
+		url.statsMu.Unlock()
+		return true
+	})
+	return series, links
+}
+
+// GetAll returns all URLs that haven't expired or been soft-deleted
+func (s *URLStore) GetAll() []*URL {
+	return s.all(false)
+}
+
+// all returns the URLs that haven't expired, with or without soft-deleted ones
+func (s *URLStore) all(includeDeleted bool) []*URL {
+	// Never nil, so an empty store serializes as [] rather than null
+	urls := make([]*URL, 0, s.Count())
+	now := s.now()
+
+	// Range over the sync.Map
+	s.store.Range(func(key, value interface{}) bool {
+		if url := value.(*URL); !url.Expired(now) && (includeDeleted || !url.Deleted()) {
+			urls = append(urls, url)
+		}
+		return true
+	})
+
+	return urls
+}
+
+// ListDeleted returns the soft-deleted URLs awaiting purge
+func (s *URLStore) ListDeleted() []*URL {
+	urls := make([]*URL, 0)
+	s.store.Range(func(key, value interface{}) bool {
+		if url := value.(*URL); url.Deleted() {
+			urls = append(urls, url)
+		}
+		return true
+	})
+	return urls
+}
+
+// rangeLive calls f for every URL that hasn't been soft-deleted, stopping
+// when it returns false
+func (s *URLStore) rangeLive(f func(url *URL) bool) {
+	s.store.Range(func(key, value interface{}) bool {
+		if url := value.(*URL); !url.Deleted() {
+			return f(url)
+		}
+		return true
+	})
+}
+
+// ClickCounts maps the short code of every live URL with at least minClicks
+// clicks to its click count, in a single pass over the store. Password
+// protected URLs are left out so their activity isn't revealed.
+func (s *URLStore) ClickCounts(minClicks int64) map[string]int64 {
+	counts := make(map[string]int64, s.Count())
+	now := s.now()
+
+	s.rangeLive(func(url *URL) bool {
+		if clicks := atomic.LoadInt64(&url.AccessCount); clicks >= minClicks && !url.Expired(now) && !url.Protected() {
+			counts[url.ShortCode] = clicks
+		}
+		return true
+	})
+
+	return counts
+}
+
+// remove deletes a stored URL along with its index entries and counts. It
+// returns false when the key no longer holds this URL, e.g. a concurrent
+// removal got there first.
+func (s *URLStore) remove(key string, url *URL) bool {
+	if !s.store.CompareAndDelete(key, url) {
+		return false
+	}
+	if !url.Deleted() {
+		s.unindex(url) // Already done when it was soft-deleted
+	}
+	s.forget(url)
+	return true
+}
+
+// Delete hides a URL from redirects, lookups, listings and totals while
+// keeping it, and its short code, until Restore or PurgeDeleted. It reports
+// false if there is no live URL under shortCode.
+func (s *URLStore) Delete(shortCode string) bool {
+	url, exists := s.load(shortCode)
+	return exists && s.softDelete(url)
+}
+
+// softDelete marks a stored URL deleted, reporting false if it already was
+func (s *URLStore) softDelete(url *URL) bool {
+	now := s.now()
+	url.mu.Lock()
+	if url.DeletedAt != nil {
+		url.mu.Unlock()
+		return false
+	}
+	url.DeletedAt = &now
+	url.appendEvent(LinkEvent{Type: eventDeleted, At: now})
+	url.mu.Unlock()
+
+	s.unindex(url)
+	s.markDirty(url)
+	return true
+}
+
+// Restore brings back a soft-deleted URL, reporting false if there is no
+// soft-deleted URL under shortCode
+func (s *URLStore) Restore(shortCode string) (*URL, bool) {
+	url, exists := s.load(shortCode)
+	if !exists {
+		return nil, false
+	}
+
+	url.mu.Lock()
+	if url.DeletedAt == nil {
+		url.mu.Unlock()
+		return nil, false
+	}
+	url.DeletedAt = nil
+	url.appendEvent(LinkEvent{Type: eventRestored, At: s.now()})
+	url.mu.Unlock()
+
+	s.indexLive(url.ShortCode, url)
+	s.markDirty(url)
+	return url, true
+}
+
+// PurgeDeleted removes every URL soft-deleted at least retention ago,
+// returning how many were removed
+func (s *URLStore) PurgeDeleted(retention time.Duration) int {
+	cutoff := s.now().Add(-retention)
+	removed := 0
+	s.store.Range(func(key, value interface{}) bool {
+		url := value.(*URL)
+		if deletedAt := url.DeletionTime(); deletedAt != nil && !deletedAt.After(cutoff) && s.remove(key.(string), url) {
+			removed++
+		}
+		return true
+	})
+	return removed
+}
+
+// DeleteMatching soft-deletes every live URL for which match returns true,
+// returning how many matched and how many were deleted; a URL deleted
+// concurrently matches without counting as deleted. With dryRun nothing is
+// deleted.
+func (s *URLStore) DeleteMatching(match func(*URL) bool, dryRun bool) (matched, deleted int) {
+	s.rangeLive(func(url *URL) bool {
+		if !match(url) {
+			return true
+		}
+		matched++
+		if !dryRun && s.softDelete(url) {
+			deleted++
+		}
+		return true
+	})
+	return matched, deleted
+}
+
+// SweepExpired removes every expired URL, returning how many were removed.
+// Soft-deleted URLs are left to PurgeDeleted, so they can still be restored
+// until the retention window ends.
+func (s *URLStore) SweepExpired() int {
+	now := s.now()
+	removed := 0
+	s.store.Range(func(key, value interface{}) bool {
+		if url := value.(*URL); url.Expired(now) && !url.Deleted() && s.remove(key.(string), url) {
+			removed++
+		}
+		return true
+	})
+	return removed
+}
+
+// IndexCounts reports what Reindex rebuilt
+type IndexCounts struct {
+	URLs         int64 `json:"urls"`
+	IDs          int   `json:"ids"`
+	Destinations int   `json:"destinations"`
+	Owners       int   `json:"owners"`
+	Repaired     int   `json:"repaired"` // Index entries that were missing, wrong or stale
+}
+
+// Reindex rebuilds the secondary indexes and counts from the primary store in
+// one pass. Lookups keep working throughout: correct entries are never
+// removed, and entries for links stored during the pass are kept. The counts
+// may be briefly off if links are stored or removed while it runs.
+func (s *URLStore) Reindex() IndexCounts {
+	var (
+		counts IndexCounts
+		clicks int64
+		ids    = make(map[string]string)
+		newest = make(map[string]*URL) // Destination -> newest link to it
+		owners = make(map[string]map[string]struct{})
+	)
+	s.rangeLive(func(url *URL) bool {
+		counts.URLs++
+		clicks += atomic.LoadInt64(&url.AccessCount)
+		if url.ID != "" {
+			ids[url.ID] = url.ShortCode
+		}
+		destination := url.Destination()
+		if current, exists := newest[destination]; !exists || url.CreatedAt.After(current.CreatedAt) {
+			newest[destination] = url
+		}
+		if owner := url.Owner(); owner != "" {
+			if owners[owner] == nil {
+				owners[owner] = make(map[string]struct{})
+			}
+			owners[owner][url.ShortCode] = struct{}{}
+		}
+		return true
+	})
+	destinations := make(map[string]string, len(newest))
+	for destination, url := range newest {
+		destinations[destination] = url.ShortCode
+	}
+
+	counts.Repaired += s.syncIndex(&s.byID, ids, func(url *URL, id string) bool {
+		return url.ID == id
+	})
+	counts.Repaired += s.syncIndex(&s.urlByOriginal, destinations, func(url *URL, destination string) bool {
+		return url.Destination() == destination
+	})
+
+	s.ownerMu.Lock()
+	for owner, codes := range s.byOwner {
+		for code := range codes {
+			if _, exists := owners[owner][code]; exists {
+				continue
+			}
+			if url, exists := s.Get(code); exists && url.Owner() == owner {
+				// Stored after the pass began
+				if owners[owner] == nil {
+					owners[owner] = make(map[string]struct{})
+				}
+				owners[owner][code] = struct{}{}
+				continue
+			}
+			counts.Repaired++
+		}
+	}
+	for owner, codes := range owners {
+		for code := range codes {
+			if _, exists := s.byOwner[owner][code]; !exists {
+				counts.Repaired++
+			}
+		}
+	}
+	s.byOwner = owners
+	s.ownerMu.Unlock()
+
+	if !s.lazy {
+		s.urlCount.Store(counts.URLs) // Lazily loaded stores also count the links not loaded yet
+	}
+	s.clickCount.Store(clicks)
+	counts.IDs, counts.Destinations, counts.Owners = len(ids), len(destinations), len(owners)
+	return counts
+}
+
+// syncIndex makes a key -> short code index match want, returning how many
+// entries changed. Entries are only written or dropped after checking the
+// link they point at, so changes made during the pass aren't undone.
+func (s *URLStore) syncIndex(index *sync.Map, want map[string]string, matches func(url *URL, key string) bool) int {
+	changed := 0
+	for key, shortCode := range want {
+		if url, exists := s.Get(shortCode); !exists || !matches(url, key) {
+			continue // Removed or changed after the pass
+		}
+		if previous, loaded := index.Swap(key, shortCode); !loaded || previous.(string) != shortCode {
+			changed++
+		}
+	}
+	index.Range(func(key, value interface{}) bool {
+		if _, wanted := want[key.(string)]; wanted {
+			return true
+		}
+		if url, exists := s.Get(value.(string)); exists && matches(url, key.(string)) {
+			return true // Stored after the pass began
+		}
+		if index.CompareAndDelete(key, value) {
+			changed++
+		}
+		return true
+	})
+	return changed
+}
+
+// Count returns the number of URLs in the store
+func (s *URLStore) Count() int64 {
+	return s.urlCount.Load()
+}
+
+// ReserveSlot claims room for one more URL under limit, counting the URLs in
+// the store and the slots already reserved, so concurrent creates can't both
+// take the last one. The returned release must be called once the URL has
+// been inserted, or wasn't after all.
+func (s *URLStore) ReserveSlot(limit int64) (release func(), ok bool) {
+	s.slotsMu.Lock()
+	defer s.slotsMu.Unlock()
+	if s.urlCount.Load()+s.reserved >= limit {
+		return nil, false
+	}
+	s.reserved++
+	return func() {
+		s.slotsMu.Lock()
+		s.reserved--
+		s.slotsMu.Unlock()
+	}, true
+}
+
+// TotalClicks returns the total number of clicks across all URLs
+func (s *URLStore) TotalClicks() int64 {
+	return s.clickCount.Load()
+}
+
+// indexPage holds the landing page served at "/". It is read by every request
+// to "/" and can be replaced at runtime, so the contents are swapped
+// atomically: readers never block and never observe a partial update.
+type indexPage struct {
+	path string
+	html atomic.Pointer[[]byte]
+}
+
+// newIndexPage creates an empty index page backed by the given file
+func newIndexPage(path string) *indexPage {
+	return &indexPage{path: path}
+}
+
+// HTML returns the current page contents
+func (p *indexPage) HTML() []byte {
+	if html := p.html.Load(); html != nil {
+		return *html
+	}
+	return nil
+}
+
+// Set replaces the page contents
+func (p *indexPage) Set(html []byte) {
+	p.html.Store(&html)
+}
+
+// Reload re-reads the page from disk, keeping the current contents on error
+func (p *indexPage) Reload() error {
+	html, err := os.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	p.Set(html)
+	return nil
+}
+
+// server is the configured app, along with what main needs to run it and
+// to shut it down cleanly
+type server struct {
+	app           *fiber.App
+	store         *URLStore
+	clickRecorder *ClickRecorder
+	linkChecker   *LinkChecker
+	accessLog     *AccessLog // Nil when logging to stdout
+	draining      *atomic.Bool
+
+	drainDelay      time.Duration
+	shutdownTimeout time.Duration
+	inContainer     bool
+	persistent      bool // DATABASE_PATH or SNAPSHOT_PATH is set
+
+	snapshotPath         string
+	snapshotFallbackPath string
+	snapshotFormat       SnapshotFormat
+	snapshotRetries      int
+}
+
+// newServer builds the store, background jobs and routes from the
+// environment. Invalid settings stop the process.
+func newServer() *server {
+	// Plain text logs by default, JSON lines for log aggregators
+	logFormat, err := ParseLogFormat(os.Getenv("LOG_FORMAT"))
+	if err != nil {
+		log.Fatalf("Invalid LOG_FORMAT: %v", err)
+	}
+	if logFormat == LogFormatJSON {
+		useJSONLogs()
+	}
+
+	// Initialize the URL store
+	urlStore := NewURLStore()
+
+	// Time-bucketed analytics use the configured timezone (server local time by default)
+	if tz := os.Getenv("TIMEZONE"); tz != "" {
+		location, err := time.LoadLocation(tz)
+		if err != nil {
+			log.Fatalf("Invalid TIMEZONE %q: %v", tz, err)
+		}
+		urlStore.SetLocation(location)
+	}
+
+	// Treat short codes case-insensitively, generating lowercase-only codes
+	urlStore.SetCaseInsensitive(os.Getenv("CASE_INSENSITIVE_CODES") == "true")
+
+	// Length and alphabet of generated codes, after case folding is known
+	codeConfig, err := ParseCodeConfig(os.Getenv("CODE_LENGTH"), os.Getenv("CODE_ALPHABET"), urlStore.foldCase)
+	if err != nil {
+		log.Fatalf("Invalid code config: %v", err)
+	}
+	urlStore.SetCodeConfig(codeConfig)
+
+	// Append a check character to generated short codes to catch typos
+	urlStore.SetChecksum(os.Getenv("SHORT_CODE_CHECKSUM") == "true")
+
+	// Random codes by default, or codes derived from a hash of the destination
+	codeStrategy, err := ParseCodeStrategy(os.Getenv("CODE_STRATEGY"))
+	if err != nil {
+		log.Fatalf("Invalid CODE_STRATEGY: %v", err)
+	}
+	urlStore.SetCodeStrategy(codeStrategy, os.Getenv("CODE_SALT"))
+
+	// Per-day analytics older than the retention window are trimmed in the background
+	urlStore.SetRetention(defaultAnalyticsRetention)
+	if v := os.Getenv("ANALYTICS_RETENTION"); v != "" {
+		retention, err := parseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid ANALYTICS_RETENTION: %v", err)
+		}
+		urlStore.SetRetention(retention)
+	}
+
+	// Background jobs that scan the whole store share one staggered scheduler
+	janitorJitter := 0.1
+	if v := os.Getenv("JANITOR_JITTER"); v != "" {
+		if janitorJitter, err = strconv.ParseFloat(v, 64); err != nil || janitorJitter < 0 || janitorJitter > 1 {
+			log.Fatalf("Invalid JANITOR_JITTER %q: must be between 0 and 1", v)
+		}
+	}
+	janitorStagger := 10 * time.Second
+	if v := os.Getenv("JANITOR_STAGGER"); v != "" {
+		if janitorStagger, err = time.ParseDuration(v); err != nil || janitorStagger < 0 {
+			log.Fatalf("Invalid JANITOR_STAGGER %q: must be a non-negative duration", v)
+		}
+	}
+	janitor := NewJanitor(janitorJitter, janitorStagger)
+
+	// Trim per-day analytics past the retention window
+	analyticsTrimInterval := time.Hour
+	if v := os.Getenv("ANALYTICS_TRIM_INTERVAL"); v != "" {
+		if analyticsTrimInterval, err = parseDuration(v); err != nil || analyticsTrimInterval < 0 {
+			log.Fatalf("Invalid ANALYTICS_TRIM_INTERVAL %q: must be a non-negative duration", v)
+		}
+	}
+	if urlStore.Retention() > 0 {
+		janitor.Add("analytics-trimmer", analyticsTrimInterval, func() {
+			if removed := urlStore.TrimAnalytics(); removed > 0 {
+				log.Printf("Analytics: trimmed %d day buckets older than %s", removed, urlStore.Retention())
+			}
+		})
+	}
+
+	// Remove expired links; until then they answer 410 Gone
+	expirySweepInterval := time.Minute
+	if v := os.Getenv("EXPIRY_SWEEP_INTERVAL"); v != "" {
+		if expirySweepInterval, err = time.ParseDuration(v); err != nil || expirySweepInterval < 0 {
+			log.Fatalf("Invalid EXPIRY_SWEEP_INTERVAL %q: must be a non-negative duration", v)
+		}
+	}
+	janitor.Add("expiry-sweeper", expirySweepInterval, func() {
+		if removed := urlStore.SweepExpired(); removed > 0 {
+			log.Printf("Expiry: removed %d expired URLs", removed)
+		}
+	})
+
+	// Purge soft-deleted links once they can no longer be restored
+	softDeleteRetention := 7 * 24 * time.Hour
+	if v := os.Getenv("SOFT_DELETE_RETENTION"); v != "" {
+		if softDeleteRetention, err = parseDuration(v); err != nil || softDeleteRetention < 0 {
+			log.Fatalf("Invalid SOFT_DELETE_RETENTION %q: must be a non-negative duration", v)
+		}
+	}
+	softDeletePurgeInterval := time.Hour
+	if v := os.Getenv("SOFT_DELETE_PURGE_INTERVAL"); v != "" {
+		if softDeletePurgeInterval, err = time.ParseDuration(v); err != nil || softDeletePurgeInterval < 0 {
+			log.Fatalf("Invalid SOFT_DELETE_PURGE_INTERVAL %q: must be a non-negative duration", v)
+		}
+	}
+	janitor.Add("deleted-purger", softDeletePurgeInterval, func() {
+		if removed := urlStore.PurgeDeleted(softDeleteRetention); removed > 0 {
+			log.Printf("Soft delete: purged %d URLs deleted more than %s ago", removed, softDeleteRetention)
+		}
+	})
+
+	// Clicks are applied to the store by a single worker, batched per flush window
+	clickFlushInterval := time.Duration(0)
+	if v := os.Getenv("CLICK_FLUSH_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid CLICK_FLUSH_INTERVAL %q: must be a non-negative duration", v)
+		}
+		clickFlushInterval = d
+	}
+	clickRecorder := NewClickRecorder(urlStore, clickFlushInterval)
+
+	// Trusted hosts bypass the scheme check and the blocklist, so only list
+	// internal destinations fully under your control
+	trustedHosts := NewTrustedHosts(splitList(os.Getenv("TRUSTED_HOSTS")))
+	if trustedHosts.Len() > 0 {
+		log.Printf("Warning: %d trusted hosts bypass destination validation and the blocklist", trustedHosts.Len())
+	}
+	urlStore.SetTrustedHosts(trustedHosts)
+
+	// Load links from the database and write changes back to it, if configured
+	if databasePath := os.Getenv("DATABASE_PATH"); databasePath != "" {
+		database, err := OpenSQLiteStore(databasePath)
+		if err != nil {
+			log.Fatalf("Failed to open database: %v", err)
+		}
+		// Everything is loaded up front unless disabled, in which case links are
+		// read on first use and can be preloaded with /api/admin/warm
+		if os.Getenv("DATABASE_PRELOAD") == "false" {
+			if err := urlStore.LoadLazily(database); err != nil {
+				log.Fatalf("Failed to count URLs in database: %v", err)
+			}
+			log.Printf("Loading %d URLs from %s on first use", urlStore.Count(), databasePath)
+		} else {
+			loaded, err := urlStore.LoadFrom(database)
+			if err != nil {
+				log.Fatalf("Failed to load URLs from database: %v", err)
+			}
+			log.Printf("Loaded %d URLs from %s", loaded, databasePath)
+		}
+
+		flushInterval := time.Second
+		if v := os.Getenv("DATABASE_FLUSH_INTERVAL"); v != "" {
+			if flushInterval, err = time.ParseDuration(v); err != nil || flushInterval <= 0 {
+				log.Fatalf("Invalid DATABASE_FLUSH_INTERVAL %q: must be a positive duration", v)
+			}
+		}
+		go urlStore.RunPersistence(flushInterval)
+	}
+
+	// Restore the previous snapshot, if persistence is enabled
+	snapshotPath := os.Getenv("SNAPSHOT_PATH")
+	snapshotFormat, err := ParseSnapshotFormat(os.Getenv("SNAPSHOT_FORMAT"))
+	if err != nil {
+		log.Fatalf("Invalid SNAPSHOT_FORMAT: %v", err)
+	}
+	// The shutdown snapshot is retried before falling back to a second path
+	snapshotRetries := 3
+	if v := os.Getenv("SNAPSHOT_SAVE_RETRIES"); v != "" {
+		if snapshotRetries, err = strconv.Atoi(v); err != nil || snapshotRetries < 0 {
+			log.Fatalf("Invalid SNAPSHOT_SAVE_RETRIES %q: must be a non-negative integer", v)
+		}
+	}
+	snapshotFallbackPath := ""
+	if snapshotPath != "" {
+		snapshotFallbackPath = filepath.Join(os.TempDir(), filepath.Base(snapshotPath))
+	}
+	if v, ok := os.LookupEnv("SNAPSHOT_FALLBACK_PATH"); ok {
+		snapshotFallbackPath = v
+	}
+	if snapshotPath != "" {
+		loaded, err := urlStore.LoadFromFile(snapshotPath)
+		if err != nil {
+			log.Fatalf("Failed to load snapshot: %v", err)
+		}
+		log.Printf("Loaded %d URLs from %s", loaded, snapshotPath)
+	}
+
+	// Load the index HTML
+	indexHTML := newIndexPage("static/index.html")
+	if err := indexHTML.Reload(); err != nil {
+		indexHTML.Set([]byte("<h1>Failed to load index.html</h1>"))
+	}
+
+	// Load the redirect blocklist and keep it in sync with its file
+	blocklist := NewBlocklist(os.Getenv("BLOCKLIST_FILE"), splitList(os.Getenv("BLOCKLIST")))
+	if err := blocklist.Load(); err != nil {
+		log.Printf("Failed to load blocklist: %v", err)
+	}
+	urlStore.SetBlocklist(blocklist) // Set after loading stored links, only imports are checked
+	reloadInterval := 30 * time.Second
+	if v := os.Getenv("BLOCKLIST_RELOAD_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid BLOCKLIST_RELOAD_INTERVAL %q: %v", v, err)
+		}
+		reloadInterval = d
+	}
+	go blocklist.Watch(reloadInterval)
+
+	// Periodically probe destinations for availability and latency (disabled unless an interval is set)
+	linkCheckInterval := time.Duration(0)
+	if v := os.Getenv("LINK_CHECK_INTERVAL"); v != "" {
+		if linkCheckInterval, err = parseDuration(v); err != nil || linkCheckInterval < 0 {
+			log.Fatalf("Invalid LINK_CHECK_INTERVAL %q: must be a non-negative duration", v)
+		}
+	}
+	linkCheckTimeout := 5 * time.Second
+	if v := os.Getenv("LINK_CHECK_TIMEOUT"); v != "" {
+		if linkCheckTimeout, err = time.ParseDuration(v); err != nil || linkCheckTimeout <= 0 {
+			log.Fatalf("Invalid LINK_CHECK_TIMEOUT %q: must be a positive duration", v)
+		}
+	}
+	linkChecker := NewLinkChecker(urlStore, blocklist, linkCheckTimeout)
+	janitor.Add("link-checker", linkCheckInterval, func() {
+		if checked := linkChecker.CheckAll(); checked > 0 {
+			log.Printf("Link check: probed %d destinations", checked)
+		}
+	})
+	go janitor.Run()
+
+	// Retry-After format shared by every 429/503 response
+	if retryAfterFormat, err = ParseRetryAfterFormat(os.Getenv("RETRY_AFTER_FORMAT")); err != nil {
+		log.Fatalf("Invalid RETRY_AFTER_FORMAT: %v", err)
+	}
+
+	// Redirect status for links that don't pick one
+	if v := os.Getenv("DEFAULT_REDIRECT_STATUS"); v != "" {
+		if defaultRedirectStatus, err = strconv.Atoi(v); err != nil || !isAllowedRedirectStatus(defaultRedirectStatus) {
+			log.Fatalf("Invalid DEFAULT_REDIRECT_STATUS %q: must be 301, 302, 307 or 308", v)
+		}
+	}
+
+	// Base of the short URLs in responses, parsed once for every handler
+	baseURL := "http://localhost:3000"
+	if v := os.Getenv("BASE_URL"); v != "" {
+		var ok bool
+		if baseURL, ok = parseBaseURL(v); !ok {
+			log.Fatalf("Invalid BASE_URL %q: must be an http or https URL without query or fragment", v)
+		}
+	}
+
+	// Longest custom code, generated codes keep their own length
+	if v := os.Getenv("MAX_ALIAS_LENGTH"); v != "" {
+		if maxAliasLength, err = strconv.Atoi(v); err != nil || maxAliasLength < minAliasLength {
+			log.Fatalf("Invalid MAX_ALIAS_LENGTH %q: must be a number of at least %d", v, minAliasLength)
+		}
+	}
+
+	// Length of internal link IDs, longer for deployments referencing them externally
+	if v := os.Getenv("URL_ID_LENGTH"); v != "" {
+		if idLength, err = strconv.Atoi(v); err != nil || idLength < minIDLength || idLength > maxIDLength {
+			log.Fatalf("Invalid URL_ID_LENGTH %q: must be between %d and %d", v, minIDLength, maxIDLength)
+		}
+	}
+
+	// Collapse repeated slashes in request paths (enabled unless set to false)
+	normalizeSlashes := os.Getenv("NORMALIZE_SLASHES") != "false"
+
+	// Wrap /api/urls in an object with pagination metadata instead of a bare array
+	urlListEnvelope := os.Getenv("URL_LIST_ENVELOPE") == "true"
+
+	// Temporary redirects are revalidated after this many seconds (0 means always)
+	temporaryRedirectMaxAge := 0
+	if v := os.Getenv("TEMPORARY_REDIRECT_MAX_AGE"); v != "" {
+		if temporaryRedirectMaxAge, err = strconv.Atoi(v); err != nil || temporaryRedirectMaxAge < 0 {
+			log.Fatalf("Invalid TEMPORARY_REDIRECT_MAX_AGE %q: must be a non-negative number of seconds", v)
+		}
+	}
+
+	// XFetch beta for redirect max-ages, higher values expire cached redirects earlier
+	earlyExpiryBeta := 1.0
+	if v := os.Getenv("CACHE_EARLY_EXPIRY_BETA"); v != "" {
+		if earlyExpiryBeta, err = strconv.ParseFloat(v, 64); err != nil || earlyExpiryBeta < 0 {
+			log.Fatalf("Invalid CACHE_EARLY_EXPIRY_BETA %q: must be a non-negative number", v)
+		}
+	}
+
+	// Compressed import bodies may not inflate beyond this many bytes
+	maxDecodedBodySize := int64(defaultMaxDecodedBodySize)
+	if v := os.Getenv("MAX_DECODED_BODY_SIZE"); v != "" {
+		if maxDecodedBodySize, err = strconv.ParseInt(v, 10, 64); err != nil || maxDecodedBodySize <= 0 {
+			log.Fatalf("Invalid MAX_DECODED_BODY_SIZE %q: must be a positive number of bytes", v)
+		}
+	}
+
+	// Per-link referrer and User-Agent counts, opt-in with TRACK_REFERRERS
+	trackReferrers := os.Getenv("TRACK_REFERRERS") == "true"
+
+	// Optionally count link preview crawlers separately from real clicks
+	var previewDetector *PreviewDetector
+	if os.Getenv("EXCLUDE_PREVIEW_BOTS") == "true" {
+		patterns := defaultPreviewBots
+		if v := os.Getenv("PREVIEW_BOT_USER_AGENTS"); v != "" {
+			patterns = splitList(v)
+		}
+		previewDetector = NewPreviewDetector(patterns)
+	}
+
+	// Longest accepted destination URL
+	maxURLLength := 2048
+	if v := os.Getenv("MAX_URL_LENGTH"); v != "" {
+		if maxURLLength, err = strconv.Atoi(v); err != nil || maxURLLength < 1 {
+			log.Fatalf("Invalid MAX_URL_LENGTH %q: must be a positive number", v)
+		}
+	}
+
+	// Return the existing link when a destination is shortened again
+	dedupeURLs := os.Getenv("DEDUPE_URLS") == "true"
+
+	// Refuse destinations on internal addresses, so links (and the link checker) can't be aimed inside the network
+	blockPrivateHosts := os.Getenv("BLOCK_PRIVATE_HOSTS") == "true"
+
+	// Cap on stored links, 0 means unlimited
+	var maxURLs int64
+	if v := os.Getenv("MAX_URLS"); v != "" {
+		if maxURLs, err = strconv.ParseInt(v, 10, 64); err != nil || maxURLs < 0 {
+			log.Fatalf("Invalid MAX_URLS %q: must be a non-negative number", v)
+		}
+	}
+
+	// Bounds on per-link tags
+	maxTagsPerLink, maxTagLength := 10, 32
+	if v := os.Getenv("MAX_TAGS_PER_LINK"); v != "" {
+		if maxTagsPerLink, err = strconv.Atoi(v); err != nil || maxTagsPerLink < 0 {
+			log.Fatalf("Invalid MAX_TAGS_PER_LINK %q: must be a non-negative number", v)
+		}
+	}
+	if v := os.Getenv("MAX_TAG_LENGTH"); v != "" {
+		if maxTagLength, err = strconv.Atoi(v); err != nil || maxTagLength < 1 {
+			log.Fatalf("Invalid MAX_TAG_LENGTH %q: must be a positive number", v)
+		}
+	}
+
+	// Access logs go to stdout unless a file is configured
+	var accessLog *AccessLog
+	if path := os.Getenv("ACCESS_LOG_FILE"); path != "" {
+		maxSizeMB, maxBackups, maxAgeDays := 100, 5, 0
+		if v := os.Getenv("ACCESS_LOG_MAX_SIZE_MB"); v != "" {
+			if maxSizeMB, err = strconv.Atoi(v); err != nil || maxSizeMB < 1 {
+				log.Fatalf("Invalid ACCESS_LOG_MAX_SIZE_MB %q: must be a positive number", v)
+			}
+		}
+		if v := os.Getenv("ACCESS_LOG_MAX_BACKUPS"); v != "" {
+			if maxBackups, err = strconv.Atoi(v); err != nil || maxBackups < 0 {
+				log.Fatalf("Invalid ACCESS_LOG_MAX_BACKUPS %q: must be a non-negative number", v)
+			}
+		}
+		if v := os.Getenv("ACCESS_LOG_MAX_AGE_DAYS"); v != "" {
+			if maxAgeDays, err = strconv.Atoi(v); err != nil || maxAgeDays < 0 {
+				log.Fatalf("Invalid ACCESS_LOG_MAX_AGE_DAYS %q: must be a non-negative number", v)
+			}
+		}
+		var rotateInterval time.Duration
+		if v := os.Getenv("ACCESS_LOG_ROTATE_INTERVAL"); v != "" {
+			if rotateInterval, err = parseDuration(v); err != nil || rotateInterval < 0 {
+				log.Fatalf("Invalid ACCESS_LOG_ROTATE_INTERVAL %q: must be a non-negative duration", v)
+			}
+		}
+		accessLog = NewAccessLog(path, maxSizeMB, maxBackups, maxAgeDays)
+		go accessLog.RotateEvery(rotateInterval)
+	}
+
+	// Shared secret for click nonces on links with sign_clicks enabled
+	clickSigner := NewClickSigner(os.Getenv("CLICK_NONCE_SECRET"))
+
+	// Admin routes require this token as a bearer credential
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	adminAuth := requireAdmin(adminToken)
+
+	// On shutdown, fail readiness for this long before draining connections so
+	// load balancers stop routing new requests here first
+	var drainDelay time.Duration
+	if v := os.Getenv("SHUTDOWN_DRAIN_DELAY"); v != "" {
+		if drainDelay, err = time.ParseDuration(v); err != nil || drainDelay < 0 {
+			log.Fatalf("Invalid SHUTDOWN_DRAIN_DELAY %q: must be a non-negative duration", v)
+		}
+	}
+	var draining atomic.Bool
+
+	// Upper bound on shutdown once the drain delay is over: finishing in-flight
+	// requests, applying queued clicks, flushing persistence and the snapshot
+	shutdownTimeout := 10 * time.Second
+	if v := os.Getenv("SHUTDOWN_TIMEOUT"); v != "" {
+		if shutdownTimeout, err = time.ParseDuration(v); err != nil || shutdownTimeout <= 0 {
+			log.Fatalf("Invalid SHUTDOWN_TIMEOUT %q: must be a positive duration", v)
+		}
+	}
+
+	// Server response header, set SERVER_HEADER to an empty value to omit it
+	serverHeader := "Fiber"
+	if v, ok := os.LookupEnv("SERVER_HEADER"); ok {
+		serverHeader = v
+	}
+
+	// Request counters exposed on /metrics
+	metrics := NewMetrics(urlStore)
+
+	// Redirect and shorten rates for /api/metrics/throughput, from counter
+	// readings taken every second
+	throughputWindow := time.Minute
+	if v := os.Getenv("THROUGHPUT_WINDOW"); v != "" {
+		if throughputWindow, err = time.ParseDuration(v); err != nil || throughputWindow < time.Second {
+			log.Fatalf("Invalid THROUGHPUT_WINDOW %q: must be a duration of at least 1s", v)
+		}
+	}
+	go metrics.SampleThroughput(time.Second, throughputWindow)
+
+	// Shed API requests with 503 while the estimated wait exceeds this budget (disabled when unset)
+	var responseTimeBudget time.Duration
+	if v := os.Getenv("RESPONSE_TIME_BUDGET"); v != "" {
+		if responseTimeBudget, err = time.ParseDuration(v); err != nil || responseTimeBudget <= 0 {
+			log.Fatalf("Invalid RESPONSE_TIME_BUDGET %q: must be a positive duration", v)
+		}
+	}
+
+	// Check if running in Docker or container environment
+	inContainer := os.Getenv("IN_CONTAINER") == "true"
+
+	// Prefork workers each hold their own store, so they would overwrite each
+	// other's links in the database or snapshot
+	persistent := os.Getenv("DATABASE_PATH") != "" || snapshotPath != ""
+
+	// X-Forwarded-For is only honored when the request comes from a trusted
+	// proxy, or from anyone with TRUST_PROXY when the server is only reachable
+	// through a proxy that sets it
+	trustedProxies := splitList(os.Getenv("TRUSTED_PROXIES"))
+	proxyHeader := ""
+	if len(trustedProxies) > 0 || os.Getenv("TRUST_PROXY") == "true" {
+		proxyHeader = fiber.HeaderXForwardedFor
+	}
+
+	// Per client IP limit on link creation, 0 disables it
+	shortenRateLimit := 0
+	if v := os.Getenv("SHORTEN_RATE_LIMIT"); v != "" {
+		if shortenRateLimit, err = strconv.Atoi(v); err != nil || shortenRateLimit < 0 {
+			log.Fatalf("Invalid SHORTEN_RATE_LIMIT %q: must be a non-negative number of requests", v)
+		}
+	}
+	shortenRateWindow := time.Minute
+	if v := os.Getenv("SHORTEN_RATE_WINDOW"); v != "" {
+		if shortenRateWindow, err = parseDuration(v); err != nil || shortenRateWindow < time.Second {
+			log.Fatalf("Invalid SHORTEN_RATE_WINDOW %q: must be a duration of at least 1s", v)
+		}
+	}
+
+	// Keep-alive tuning for clients holding many connections open
+	keepAlive := os.Getenv("KEEP_ALIVE") != "false"
+	idleTimeout := 10 * time.Second
+	if v := os.Getenv("IDLE_TIMEOUT"); v != "" {
+		if idleTimeout, err = time.ParseDuration(v); err != nil || idleTimeout <= 0 {
+			log.Fatalf("Invalid IDLE_TIMEOUT %q: must be a positive duration", v)
+		}
+	}
+	maxConnsPerIP := 0
+	if v := os.Getenv("MAX_CONNS_PER_IP"); v != "" {
+		if maxConnsPerIP, err = strconv.Atoi(v); err != nil || maxConnsPerIP < 0 {
+			log.Fatalf("Invalid MAX_CONNS_PER_IP %q: must be a non-negative integer", v)
+		}
+	}
+
+	// Create a new Fiber app with optimized settings
+	app := fiber.New(fiber.Config{
+		Prefork:               !inContainer && accessLog == nil && !persistent, // No prefork in containers (port conflicts), with a log file (single rotator) or with persistence (single store)
+		ServerHeader:          serverHeader,
+		StrictRouting:         true,
+		CaseSensitive:         true,
+		BodyLimit:             1 * 1024 * 1024, // 1MB
+		ReadTimeout:           5 * time.Second,
+		WriteTimeout:          5 * time.Second,
+		IdleTimeout:           idleTimeout,
+		DisableKeepalive:      !keepAlive,
+		DisableStartupMessage: true,       // Reduce startup overhead
+		ReduceMemoryUsage:     true,       // Optimize memory usage
+		Concurrency:           256 * 1024, // Higher concurrency limit
+		// Client IP resolution for c.IP()
+		EnableTrustedProxyCheck: len(trustedProxies) > 0,
+		TrustedProxies:          trustedProxies,
+		ProxyHeader:             proxyHeader,
+		EnableIPValidation:      true,
+		// JSONEncoder and JSONDecoder can be customized with custom encoders
+	})
+	app.Server().MaxConnsPerIP = maxConnsPerIP // Not exposed by fiber.Config
+
+	// Get environment variables for performance tuning
+	maxProcs := os.Getenv("GOMAXPROCS")
+	if maxProcs == "" {
+		// Default to number of CPUs
+		maxProcs = fmt.Sprintf("%d", runtime.NumCPU())
+		os.Setenv("GOMAXPROCS", maxProcs)
+	}
+
+	// Add middleware for better performance and monitoring
+	app.Use(metrics.Middleware())
+	if responseTimeBudget > 0 {
+		app.Use(metrics.ShedOverBudget(responseTimeBudget))
+	}
+	app.Use(compress.New(compress.Config{
+		Level: compress.LevelBestSpeed,
+	}))
+	app.Use(cors.New())
+	// Orchestrator probes hit these every few seconds, keep them out of the log
+	skipAccessLog := func(c *fiber.Ctx) bool {
+		path := c.Path()
+		return path == "/health" || path == "/ready" || path == "/metrics"
+	}
+	var accessLogOutput io.Writer = os.Stdout
+	if accessLog != nil {
+		accessLogOutput = accessLog
+	}
+	// Every response carries an X-Request-ID, reusing an incoming one, which
+	// is logged and added to JSON error bodies
+	app.Use(requestid.New())
+	app.Use(requestIDInErrors())
+	if logFormat == LogFormatJSON {
+		app.Use(newJSONAccessLogger(accessLogOutput, skipAccessLog))
+	} else {
+		app.Use(logger.New(logger.Config{
+			Format: "${time} | ${status} | ${latency} | ${method} | ${path} | ${respHeader:X-Request-ID}\n",
+			Next:   skipAccessLog,
+			Output: accessLogOutput,
+		}))
+	}
+
+	// Proxies sometimes forward "//abc123"; collapse repeated slashes before routing
+	if normalizeSlashes {
+		app.Use(func(c *fiber.Ctx) error {
+			if path := c.Path(); strings.Contains(path, "//") {
+				c.Path(collapseSlashes(path))
+			}
+			return c.Next()
+		})
+	}
+
+	// Browsers ask for /favicon.ico on every visit; answer it here rather than
+	// as a short code lookup, with the configured icon or 204 when there is none
+	faviconConfig := favicon.Config{File: os.Getenv("FAVICON_FILE")}
+	if faviconConfig.File == "" {
+		if _, err := os.Stat("static/favicon.ico"); err == nil {
+			faviconConfig.File = "static/favicon.ico"
+		}
+	} else if _, err := os.Stat(faviconConfig.File); err != nil {
+		log.Fatalf("Invalid FAVICON_FILE %q: %v", faviconConfig.File, err)
+	}
+	app.Use(favicon.New(faviconConfig))
+
+	// Redirects and reads are not rate limited, only link creation
+	if shortenRateLimit > 0 {
+		app.Use("/api/shorten", limiter.New(limiter.Config{
+			Max:        shortenRateLimit,
+			Expiration: shortenRateWindow,
+			KeyGenerator: func(c *fiber.Ctx) string {
+				return strings.Clone(c.IP()) // Kept by the limiter beyond the request
+			},
+			LimitReached: func(c *fiber.Ctx) error {
+				// The limiter sets the wait in seconds; re-send it in the configured format
+				wait, _ := strconv.Atoi(string(c.Response().Header.Peek(fiber.HeaderRetryAfter)))
+				SetRetryAfter(c, time.Duration(wait)*time.Second)
+				// Allowed requests get quota headers from the limiter, rejected ones don't
+				c.Set("X-RateLimit-Limit", strconv.Itoa(shortenRateLimit))
+				c.Set("X-RateLimit-Remaining", "0")
+				c.Set("X-RateLimit-Reset", strconv.Itoa(wait))
+				return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "Too many requests"})
+			},
+		}))
+	}
+
+	// The whole API needs an API key when API_KEYS is set, so new routes are
+	// covered by default; redirects and the public API paths stay open
+	apiKeys := splitList(os.Getenv("API_KEYS"))
+	apiKeyAuth := requireAPIKey(apiKeys)
+	app.Use("/api", func(c *fiber.Ctx) error {
+		if publicAPIPath(c.Path()) {
+			return c.Next()
+		}
+		return apiKeyAuth(c)
+	})
+
+	// Define routes
+	app.Get("/", func(c *fiber.Ctx) error {
+		return c.Type("html").Send(indexHTML.HTML())
+	})
+
+	app.Get("/metrics", metrics.Handler())
+
+	// Liveness stays healthy until the process exits, readiness fails as soon
+	// as shutdown begins. Both must be registered before /:shortCode.
+	app.Get("/health", func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"status": "ok"})
+	})
+	app.Get("/ready", func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		if draining.Load() {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"status": "draining"})
+		}
+		return c.JSON(fiber.Map{"status": "ready"})
+	})
+
+	// The spec is generated once from the models; like the other top-level
+	// routes the docs must be registered before /:shortCode
+	openAPISpec, err := buildOpenAPISpec(baseURL)
+	if err != nil {
+		log.Fatalf("Failed to build OpenAPI spec: %v", err)
+	}
+	app.Get("/openapi.json", func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
+		return c.Send(openAPISpec)
+	})
+	app.Get("/docs", func(c *fiber.Ctx) error {
+		return c.Type("html").SendString(docsPage)
+	})
+
+	// Shorten-style requests also depend on server configuration. Destinations
+	// are normalized in place first, so callers store the normalized form.
+	// DNS lookups stop when ctx is done.
+	validateRequest := func(ctx context.Context, req *CreateURLRequest) error {
+		req.normalize()
+		if err := validateCreateURLRequest(req, trustedHosts); err != nil {
+			return err
+		}
+		if req.SignClicks && clickSigner == nil {
+			return &ValidationError{Field: "sign_clicks", Message: "Click signing is not configured on this server"}
+		}
+		if req.ExpiresAt != nil && !req.ExpiresAt.After(urlStore.Now()) {
+			return &ValidationError{Field: "expires_at", Message: "Expiration must be in the future"}
+		}
+		if len(req.Tags) > maxTagsPerLink {
+			return &ValidationError{Field: "tags", Message: fmt.Sprintf("At most %d tags per link", maxTagsPerLink)}
+		}
+		for _, tag := range req.Tags {
+			if tag == "" || len(tag) > maxTagLength {
+				return &ValidationError{Field: "tags", Message: fmt.Sprintf("Tags must be between 1 and %d characters", maxTagLength)}
+			}
+		}
+		// Every destination the link can redirect to must fit and not be blocked
+		type destination struct{ field, url string }
+		destinations := []destination{{"url", req.URL}, {"ios_url", req.IOSURL}, {"android_url", req.AndroidURL}}
+		for i, rule := range req.QueryRules {
+			destinations = append(destinations, destination{fmt.Sprintf("query_rules[%d].destination", i), rule.Destination})
+		}
+		for _, d := range destinations {
+			if len(d.url) > maxURLLength {
+				return &ValidationError{Field: d.field, Message: fmt.Sprintf("URLs must be at most %d characters", maxURLLength)}
+			}
+			if d.url == "" || trustedHosts.Trusts(d.url) {
+				continue
+			}
+			if blocklist.IsBlocked(d.url) {
+				return &ValidationError{Field: d.field, Message: "Destination host is blocked"}
+			}
+			if blockPrivateHosts {
+				lookupCtx, cancel := context.WithTimeout(ctx, privateHostLookupTimeout)
+				private, err := resolvesToPrivate(lookupCtx, d.url)
+				cancel()
+				if err != nil {
+					return &ValidationError{Field: d.field, Message: "Destination host could not be resolved"}
+				}
+				if private {
+					return &ValidationError{Field: d.field, Message: "Destination host is a loopback, link-local or private address"}
+				}
+			}
+		}
+		// Redirects reject codes shaped like generated ones whose check character is wrong
+		if req.CustomCode != "" && !urlStore.ValidChecksum(req.CustomCode) {
+			return &ValidationError{Field: "custom_code", Message: "Custom code would be rejected as mistyped, choose another length"}
+		}
+		return nil
+	}
+
+	// Use a pooled object for request/response to reduce allocations
+	type pooledURLResponse struct {
+		resp URLResponse
+		req  CreateURLRequest
+	}
+
+	// Set up a sync.Pool for URLResponse objects to reduce garbage collection
+	urlRespPool := sync.Pool{
+		New: func() interface{} {
+			return new(pooledURLResponse)
+		},
+	}
+
+	// shortLinkBase returns the base for short URLs in a shorten response.
+	// Multi-brand setups pick the short link domain per request, but only
+	// callers we trust may do so: requests via a trusted proxy or with a valid API key.
+	shortLinkBase := func(c *fiber.Ctx) (string, bool) {
+		if override := c.Get("X-Base-URL"); override != "" {
+			viaTrustedProxy := len(trustedProxies) > 0 && c.IsProxyTrusted()
+			if viaTrustedProxy || (len(apiKeys) > 0 && validAPIKey(c, apiKeys)) {
+				return parseBaseURL(override)
+			}
+		}
+		return baseURL, true
+	}
+
+	// createLink stores a link for a validated request. With DEDUPE_URLS a
+	// live link to the same destination and with the same settings is
+	// returned instead. Failures carry the status to answer with.
+	createLink := func(req *CreateURLRequest, clientIP string) (*URL, *fiber.Error) {
+		// Create URL object
+		now := urlStore.Now()
+		url := newShortURL(req, now)
+		url.CreatedByIP = clientIP
+
+		// Resubmitting a destination returns its live link instead of minting another
+		// Protected links are never shared with a request for a different password
+		if dedupeURLs && req.CustomCode == "" && req.Password == "" {
+			if existing, found := urlStore.GetByOriginal(req.URL); found && existing.Shareable(now) && existing.SameSettings(url) {
+				return existing, nil
+			}
+		}
+
+		if maxURLs > 0 {
+			release, ok := urlStore.ReserveSlot(maxURLs)
+			if !ok {
+				return nil, fiber.NewError(fiber.StatusInsufficientStorage, "URL limit reached")
+			}
+			defer release()
+		}
+
+		// Save to in-memory store, reusing the existing link for hashed codes
+		if req.CustomCode != "" {
+			if !urlStore.InsertCustom(url, req.CustomCode) {
+				return nil, fiber.NewError(fiber.StatusConflict, "Custom code is already taken")
+			}
+			return url, nil
+		}
+		url, _, err := urlStore.Insert(url)
+		if err != nil {
+			log.Printf("Failed to generate a short code: %v", err)
+			return nil, fiber.NewError(fiber.StatusInternalServerError, "Could not generate a short code")
+		}
+		return url, nil
+	}
+
+	app.Post("/api/shorten", func(c *fiber.Ctx) error {
+		// Get object from pool
+		pooled := urlRespPool.Get().(*pooledURLResponse)
+		defer urlRespPool.Put(pooled)
+
+		// Reset values
+		pooled.req = CreateURLRequest{}
+
+		if err := c.BodyParser(&pooled.req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request"})
+		}
+
+		if err := validateRequest(context.Background(), &pooled.req); err != nil {
+			return sendValidationError(c, err)
+		}
+
+		baseURL, ok := shortLinkBase(c)
+		if !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid X-Base-URL header"})
+		}
+
+		// Opt-in since it adds a round trip to the destination to every create
+		if c.QueryBool("verify") {
+			// The upstream status isn't echoed, so the probe can't be used to map other hosts
+			if check := linkChecker.Check(pooled.req.URL); !check.Reachable() {
+				return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"error": "Destination is unreachable"})
+			}
+		}
+
+		// Request values are only valid during the handler, so the stored IP is a copy
+		url, ferr := createLink(&pooled.req, strings.Clone(c.IP()))
+		if ferr != nil {
+			return c.Status(ferr.Code).JSON(fiber.Map{"error": ferr.Message})
+		}
+
+		// Prepare response using the pooled object
+		pooled.resp = newURLResponse(url, baseURL)
+
+		// Return the shortened URL
+		return c.JSON(pooled.resp)
+	})
+
+	// Items are URL strings or full shorten request objects, as a bare array
+	// or {"urls": [...]}. Each item succeeds or fails on its own.
+	app.Post("/api/shorten/batch", func(c *fiber.Ctx) error {
+		body, err := decodedBody(c, maxDecodedBodySize)
+		if err != nil {
+			return sendBodyError(c, err)
+		}
+		var items []json.RawMessage
+		if body = bytes.TrimSpace(body); len(body) > 0 && body[0] == '[' {
+			if err := json.Unmarshal(body, &items); err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request"})
+			}
+		} else {
+			var req struct {
+				URLs []json.RawMessage `json:"urls"`
+			}
+			if err := json.Unmarshal(body, &req); err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request"})
+			}
+			items = req.URLs
+		}
+		if len(items) > maxBatchSize {
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": fmt.Sprintf("At most %d URLs per request", maxBatchSize)})
+		}
+
+		baseURL, ok := shortLinkBase(c)
+		if !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid X-Base-URL header"})
+		}
+		clientIP := strings.Clone(c.IP())
+
+		// Never nil, so an empty batch answers [] rather than null
+		results := make([]interface{}, 0, len(items))
+		for i, item := range items {
+			var req CreateURLRequest
+			if err := json.Unmarshal(item, &req.URL); err != nil {
+				if err := json.Unmarshal(item, &req); err != nil {
+					results = append(results, BatchShortenError{Index: i, Error: ErrorDetail{Code: errorCodeValidation, Message: "Item must be a URL or a shorten request object"}})
+					continue
+				}
+			}
+			if err := validateRequest(context.Background(), &req); err != nil {
+				results = append(results, BatchShortenError{Index: i, URL: req.URL, Error: validationDetail(err)})
+				continue
+			}
+			url, ferr := createLink(&req, clientIP)
+			if ferr != nil {
+				results = append(results, BatchShortenError{Index: i, URL: req.URL, Error: createErrorDetail(ferr)})
+				continue
+			}
+			results = append(results, newURLResponse(url, baseURL))
+		}
+		return c.JSON(results)
+	})
+
+	app.Get("/:shortCode", func(c *fiber.Ctx) error {
+		shortCode := c.Params("shortCode", "")
+		if shortCode == "" {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "URL not found"})
+		}
+
+		// Reject mistyped codes before lookup, pointing at the likely intended link
+		if !urlStore.ValidChecksum(shortCode) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error":        "URL not found, the short code looks mistyped",
+				"did_you_mean": urlStore.SuggestCodes(shortCode),
+			})
+		}
+
+		// Get URL from store
+		url, exists := urlStore.Get(shortCode)
+		if !exists {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "URL not found"})
+		}
+		if now := urlStore.Now(); url.Expired(now) {
+			if url.NoteExpiry(now) {
+				urlStore.Touch(url)
+			}
+			return c.Status(fiber.StatusGone).JSON(fiber.Map{"error": "URL has expired"})
+		}
+
+		// Protected links need their password from ?pw= or X-Link-Password.
+		// Browsers get a form asking for it, API clients a 401.
+		query := string(c.Request().URI().QueryString())
+		if url.Protected() {
+			password := c.Get(LinkPasswordHeader)
+			if password == "" {
+				password = c.Query(LinkPasswordParam)
+			}
+			if password == "" || !url.CheckPassword(password) {
+				c.Set(fiber.HeaderCacheControl, "no-store")
+				c.Vary(fiber.HeaderAccept)
+				c.Status(fiber.StatusUnauthorized)
+				if c.Accepts(fiber.MIMEApplicationJSON, fiber.MIMETextHTML) == fiber.MIMETextHTML {
+					others, _ := neturl.ParseQuery(withoutQueryParam(query, LinkPasswordParam))
+					c.Type("html")
+					return passwordPage.Execute(c, passwordPageData{Incorrect: password != "", Query: others})
+				}
+				if password != "" {
+					return c.JSON(fiber.Map{"error": "Incorrect password"})
+				}
+				return c.JSON(fiber.Map{"error": "Password required"})
+			}
+			query = withoutQueryParam(query, LinkPasswordParam) // Never forwarded to the destination
+		}
+
+		// Pick the destination for the request's query and the client's platform
+		destination := url.ResolveDestination(ClassifyPlatform(c.Get(fiber.HeaderUserAgent)), query)
+
+		// Destinations flagged after creation must not be redirected to
+		if blocklist.IsBlocked(destination) && !trustedHosts.Trusts(destination) {
+			c.Set(fiber.HeaderCacheControl, "no-store")
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Destination has been blocked"})
+		}
+
+		// Links limited to N clicks claim one before redirecting; preview
+		// crawlers don't use one up but are turned away once none are left
+		preview := previewDetector.IsPreview(c.Method(), c.Get(fiber.HeaderUserAgent))
+		if (preview && url.ClicksExhausted()) || (!preview && !urlStore.ClaimClick(url)) {
+			c.Set(fiber.HeaderCacheControl, "no-store")
+			return c.Status(fiber.StatusGone).JSON(fiber.Map{"error": "URL has reached its click limit"})
+		}
+
+		// Signed links carry a fresh nonce, so the redirect must never be cached,
+		// and neither may a redirect that is limited or needs a password
+		cacheControl := redirectCacheControl(url.StatusCode(), temporaryRedirectMaxAge, earlyExpiryBeta)
+		if url.MaxClicks > 0 || url.Protected() {
+			cacheControl = "no-store"
+		}
+		if url.SignClicks && clickSigner != nil {
+			nonce := clickSigner.Nonce(url.ShortCode, urlStore.Now())
+			destination = appendQuery(destination, neturl.Values{ClickNonceParam: {nonce}})
+			cacheControl = "no-store"
+		}
+
+		// Hand the click to the recorder so counting doesn't block the redirect.
+		// Request values are only valid during the handler, so it gets the stored
+		// short code and a copy of the referrer.
+		click := Click{
+			ShortCode: url.ShortCode,
+			At:        urlStore.Now(),
+			Preview:   preview,
+		}
+		if trackReferrers {
+			click.Referrer = strings.Clone(referrerHost(c.Get(fiber.HeaderReferer)))
+			click.UserAgent = strings.Clone(truncateUserAgent(c.Get(fiber.HeaderUserAgent)))
+		}
+		clickRecorder.Record(click)
+
+		if url.HasPlatformOverrides() {
+			// Keep shared caches from serving one platform's destination to another
+			c.Vary(fiber.HeaderUserAgent)
+		}
+		c.Vary(fiber.HeaderAccept) // Redirect and JSON responses share the URL
+		c.Set(fiber.HeaderCacheControl, cacheControl)
+
+		// Single-page apps can ask for the destination as JSON and navigate themselves
+		if c.Query("mode") == "json" || c.Accepts(fiber.MIMETextHTML, fiber.MIMEApplicationJSON) == fiber.MIMEApplicationJSON {
+			return c.JSON(RedirectTargetResponse{
+				OriginalURL: destination,
+				ShortCode:   url.ShortCode,
+			})
+		}
+
+		// Contexts that can't follow redirects get a page that navigates itself
+		if c.Query("mode") == "html" {
+			c.Type("html")
+			return metaRefreshPage.Execute(c, destination)
+		}
+
+		// Redirect to original URL
+		return c.Redirect(destination, url.StatusCode())
+	})
+
+	app.Get("/api/urls", func(c *fiber.Ctx) error {
+		// Get all URLs, or only those belonging to the requested owner
+		var urls []*URL
+		if owner := c.Query("owner_id"); owner != "" {
+			urls = urlStore.ListByOwner(owner)
+		} else {
+			urls = urlStore.GetAll()
+		}
+		if domain := c.Query("domain"); domain != "" {
+			site := siteHost(domain)
+			matching := urls[:0]
+			for _, url := range urls {
+				if !url.Protected() && url.OnSite(site) { // Would reveal a protected destination's host
+					matching = append(matching, url)
+				}
+			}
+			urls = matching
+		}
+
+		// Listings are only paged when a limit or cursor is passed, which
+		// always returns the envelope; otherwise every URL is returned
+		paginated := c.Query("cursor") != "" || c.Query("limit") != ""
+		envelope := paginated || c.QueryBool("envelope", urlListEnvelope)
+		limit := c.QueryInt("limit", defaultPageLimit)
+		if limit < 1 || limit > maxPageLimit {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("limit must be between 1 and %d", maxPageLimit)})
+		}
+		total := len(urls)
+		if !paginated {
+			limit = max(total, 1)
+		}
+		if raw := c.Query("cursor"); raw != "" {
+			cursor, err := decodeURLCursor(raw)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid cursor"})
+			}
+
+			// Keep only URLs that sort after the cursor
+			remaining := urls[:0]
+			for _, url := range urls {
+				if cursor.precedes(url) {
+					remaining = append(remaining, url)
+				}
+			}
+			urls = remaining
+		}
+
+		// Sort by creation date descending, with the short code as a tie-breaker.
+		// Pages only sort what they return, plus one URL to tell if more follow.
+		nextCursor := ""
+		urls = newestURLs(urls, limit+1)
+		if len(urls) > limit {
+			urls = urls[:limit]
+			nextCursor = encodeURLCursor(urls[limit-1])
+		}
+
+		// Pre-allocate the exact size needed to avoid resizing
+		responses := make([]URLResponse, 0, len(urls))
+
+		// Process in batches for better cache locality
+		const batchSize = 64
+		for i := 0; i < len(urls); i += batchSize {
+			end := i + batchSize
+			if end > len(urls) {
+				end = len(urls)
+			}
+
+			// Process this batch
+			for j := i; j < end; j++ {
+				responses = append(responses, newURLResponse(urls[j], baseURL))
+			}
+		}
+
+		// Set cache headers for better client-side caching
+		c.Set(fiber.HeaderCacheControl, "private, max-age=10") // Cache for 10 seconds
+		if envelope {
+			return sendNegotiated(c, URLPageResponse{
+				URLs:       responses,
+				Count:      len(responses),
+				Total:      total,
+				NextCursor: nextCursor,
+			})
+		}
+		return sendNegotiated(c, responses)
+	})
+
+	app.Get("/api/urls/expiring", func(c *fiber.Ctx) error {
+		within := 24 * time.Hour
+		if v := c.Query("within"); v != "" {
+			d, err := parseDuration(v)
+			if err != nil || d <= 0 {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid within duration"})
+			}
+			within = d
+		}
+
+		urls := urlStore.ListExpiring(within)
+		responses := make([]URLResponse, 0, len(urls))
+		for _, url := range urls {
+			responses = append(responses, newURLResponse(url, baseURL))
+		}
+		return c.JSON(responses)
+	})
+
+	// Never-clicked links older than ?older_than=, for pruning. Always paged
+	// with the same cursors as /api/urls.
+	app.Get("/api/urls/unused", func(c *fiber.Ctx) error {
+		olderThan := 7 * 24 * time.Hour
+		if v := c.Query("older_than"); v != "" {
+			d, err := parseDuration(v)
+			if err != nil || d < 0 {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid older_than duration"})
+			}
+			olderThan = d
+		}
+		limit := c.QueryInt("limit", defaultPageLimit)
+		if limit < 1 || limit > maxPageLimit {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("limit must be between 1 and %d", maxPageLimit)})
+		}
+
+		urls := urlStore.ListUnused(urlStore.Now().Add(-olderThan))
+		if raw := c.Query("cursor"); raw != "" {
+			cursor, err := decodeURLCursor(raw)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid cursor"})
+			}
+
+			// Keep only URLs that sort after the cursor
+			remaining := urls[:0]
+			for _, url := range urls {
+				if cursor.precedes(url) {
+					remaining = append(remaining, url)
+				}
+			}
+			urls = remaining
+		}
+		total := len(urls)
+
+		nextCursor := ""
+		if len(urls) > limit {
+			urls = urls[:limit]
+			nextCursor = encodeURLCursor(urls[limit-1])
+		}
+
+		responses := make([]URLResponse, 0, len(urls))
+		for _, url := range urls {
+			responses = append(responses, newURLResponse(url, baseURL))
+		}
+		return c.JSON(URLPageResponse{
+			URLs:       responses,
+			Count:      len(responses),
+			Total:      total,
+			NextCursor: nextCursor,
+		})
+	})
+
+	app.Post("/api/validate", func(c *fiber.Ctx) error {
+		body, err := decodedBody(c, maxValidateBodySize)
+		if err != nil {
+			return sendBodyError(c, err)
+		}
+		var req ValidateURLsRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request"})
+		}
+		if len(req.URLs) > maxBatchSize {
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": fmt.Sprintf("At most %d URLs per request", maxBatchSize)})
+		}
+
+		// Run each URL through the same checks as /api/shorten without storing
+		// anything. A few at a time, and every DNS lookup shares the batch's
+		// deadline; hosts not resolved by then are reported as unresolvable.
+		ctx, cancel := context.WithTimeout(context.Background(), validateBatchTimeout)
+		defer cancel()
+		resp := ValidateURLsResponse{Results: make([]URLValidationResult, len(req.URLs))}
+		var (
+			wg      sync.WaitGroup
+			pending = make(chan int)
+		)
+		for i := 0; i < validateConcurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range pending {
+					result := URLValidationResult{URL: req.URLs[i], Valid: true}
+					if err := validateRequest(ctx, &CreateURLRequest{URL: req.URLs[i]}); err != nil {
+						result.Valid = false
+						result.Reason = err.Error()
+					}
+					resp.Results[i] = result
+				}
+			}()
+		}
+		for i := range req.URLs {
+			pending <- i
+		}
+		close(pending)
+		wg.Wait()
+
+		for _, result := range resp.Results {
+			if result.Valid {
+				resp.Valid++
+			} else {
+				resp.Invalid++
+			}
+		}
+		return c.JSON(resp)
+	})
+
+	app.Post("/api/qr/metadata", func(c *fiber.Ctx) error {
+		body, err := decodedBody(c, maxQRMetadataBodySize)
+		if err != nil {
+			return sendBodyError(c, err)
+		}
+		var req QRMetadataRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request"})
+		}
+		if len(req.ShortCodes) > maxBatchSize {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("At most %d short codes per request", maxBatchSize)})
+		}
+
+		// Unknown and expired codes are skipped, the rest keep the requested order
+		now := urlStore.Now()
+		metadata := make([]QRMetadata, 0, len(req.ShortCodes))
+		for _, shortCode := range req.ShortCodes {
+			url, exists := urlStore.Get(shortCode)
+			if !exists || url.Expired(now) {
+				continue
+			}
+			metadata = append(metadata, QRMetadata{
+				ShortCode: url.ShortCode,
+				ShortURL:  fmt.Sprintf("%s/%s", baseURL, url.ShortCode),
+			})
+		}
+		return c.JSON(metadata)
+	})
+
+	// QR handlers are shared by the format-specific routes and /api/urls/:shortCode/qr
+	qrPNGHandler := func(c *fiber.Ctx) error {
+		size := c.QueryInt("size", defaultQRSize)
+		if size < minQRSize || size > maxQRSize {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("size must be between %d and %d", minQRSize, maxQRSize)})
+		}
+
+		url, exists := urlStore.Get(c.Params("shortCode"))
+		if !exists || url.Expired(urlStore.Now()) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "URL not found"})
+		}
+
+		// Render once, then serve the whole image or the requested byte range
+		png, err := qrPNG(fmt.Sprintf("%s/%s", baseURL, url.ShortCode), size)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to render QR code"})
+		}
+
+		c.Set(fiber.HeaderContentType, "image/png")
+		c.Set(fiber.HeaderAcceptRanges, "bytes")
+		c.Set(fiber.HeaderCacheControl, "public, max-age=3600") // Cache for 1 hour
+
+		start, end, partial, err := parseByteRange(c.Get(fiber.HeaderRange), len(png))
+		if err != nil {
+			c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%d", len(png)))
+			return c.SendStatus(fiber.StatusRequestedRangeNotSatisfiable)
+		}
+		if !partial {
+			return c.Send(png)
+		}
+		c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes %d-%d/%d", start, end, len(png)))
+		return c.Status(fiber.StatusPartialContent).Send(png[start : end+1])
+	}
+
+	qrSVGHandler := func(c *fiber.Ctx) error {
+		moduleSize := c.QueryInt("module_size", defaultQRModuleSize)
+		if moduleSize < 1 || moduleSize > maxQRModuleSize {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("module_size must be between 1 and %d", maxQRModuleSize)})
+		}
+
+		url, exists := urlStore.Get(c.Params("shortCode"))
+		if !exists || url.Expired(urlStore.Now()) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "URL not found"})
+		}
+
+		svg, err := qrSVG(fmt.Sprintf("%s/%s", baseURL, url.ShortCode), moduleSize)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to render QR code"})
+		}
+
+		c.Set(fiber.HeaderContentType, "image/svg+xml")
+		c.Set(fiber.HeaderCacheControl, "public, max-age=3600") // Cache for 1 hour
+		return c.SendString(svg)
+	}
+
+	app.Get("/api/qr/:shortCode.png", qrPNGHandler)
+	app.Get("/api/info/:shortCode/qr.svg", qrSVGHandler)
+	app.Get("/api/urls/:shortCode/qr", func(c *fiber.Ctx) error {
+		switch c.Query("format", "png") {
+		case "png":
+			return qrPNGHandler(c)
+		case "svg":
+			return qrSVGHandler(c)
+		default:
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "format must be png or svg"})
+		}
+	})
+
+	app.Get("/api/analytics", func(c *fiber.Ctx) error {
+		// Get all URLs
+		urls := urlStore.GetAll()
+
+		// Pre-allocate the exact size needed
+		responses := make([]URLResponse, 0, len(urls))
+
+		// Convert to response DTOs with better batch processing
+		const batchSize = 64
+		for i := 0; i < len(urls); i += batchSize {
+			end := i + batchSize
+			if end > len(urls) {
+				end = len(urls)
+			}
+
+			for j := i; j < end; j++ {
+				responses = append(responses, newURLResponse(urls[j], baseURL))
+			}
+		}
+
+		// Sort by access count descending - use more efficient sort if possible
+		if len(responses) > 0 {
+			sort.Slice(responses, func(i, j int) bool {
+				return responses[i].AccessCount > responses[j].AccessCount
+			})
+		}
+
+		// Use cached count values for better performance
+		analytics := AnalyticsResponse{
+			TotalURLs:   urlStore.Count(),
+			TotalClicks: urlStore.TotalClicks(),
+			URLs:        responses,
+		}
+
+		// Set cache headers
+		c.Set(fiber.HeaderCacheControl, "private, max-age=5") // Cache for 5 seconds
+		return sendNegotiated(c, analytics)
+	})
+
+	app.Get("/api/analytics.ndjson", func(c *fiber.Ctx) error {
+		sortBy := c.Query("sort", "clicks")
+		less, ok := analyticsRecordOrders[sortBy]
+		if !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "sort must be clicks, created or code"})
+		}
+
+		// Counts are read once so the order can't shift while sorting
+		urls := urlStore.GetAll()
+		records := make([]AnalyticsRecord, len(urls))
+		for i, url := range urls {
+			records[i] = AnalyticsRecord{
+				ShortCode:   url.ShortCode,
+				OriginalURL: url.PublicDestination(),
+				AccessCount: atomic.LoadInt64(&url.AccessCount),
+				CreatedAt:   url.CreatedAt,
+			}
+		}
+		sort.SliceStable(records, func(i, j int) bool {
+			return less(&records[i], &records[j])
+		})
+
+		c.Set(fiber.HeaderContentType, "application/x-ndjson")
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		// Written to the connection as it is encoded rather than buffered whole
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			enc := json.NewEncoder(w)
+			for i := range records {
+				if err := enc.Encode(&records[i]); err != nil {
+					return // Client went away
+				}
+			}
+		})
+		return nil
+	})
+
+	app.Get("/api/by-id/:id", func(c *fiber.Ctx) error {
+		url, exists := urlStore.GetByID(c.Params("id"))
+		if !exists {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "URL not found"})
+		}
+
+		return c.JSON(newURLResponse(url, baseURL))
+	})
+
+	app.Post("/api/urls/:shortCode/clone", func(c *fiber.Ctx) error {
+		source, exists := urlStore.Get(c.Params("shortCode"))
+		if !exists {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "URL not found"})
+		}
+
+		// A clone of a protected link would reveal its destination, so it needs
+		// the link's password or the admin token
+		if source.Protected() && !validAdminToken(c, adminToken) && !source.CheckPassword(c.Get(LinkPasswordHeader)) {
+			c.Set(fiber.HeaderCacheControl, "no-store")
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Password required"})
+		}
+
+		// Overrides are optional, an empty body clones the link as-is
+		var overrides CloneURLRequest
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&overrides); err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request"})
+			}
+		}
+		if overrides.Password != nil && *overrides.Password == "" {
+			if source.Protected() {
+				return sendValidationError(c, &ValidationError{Field: "password", Message: "The clone of a protected link must keep a password", Reason: "password required"})
+			}
+			overrides.Password = nil // Nothing to remove
+		}
+
+		// Copy destinations and settings; stats and CreatedAt start fresh
+		req := CreateURLRequest{
+			URL:            source.Destination(),
+			IOSURL:         source.IOSURL,
+			AndroidURL:     source.AndroidURL,
+			OwnerID:        source.Owner(),
+			QueryRules:     append([]QueryRule(nil), source.QueryRules...),
+			RedirectStatus: source.RedirectStatus,
+			SignClicks:     source.SignClicks,
+			MaxClicks:      source.MaxClicks,
+			Campaign:       source.Campaign,
+			ForwardQuery:   source.ForwardQuery,
+			Tags:           append([]string(nil), source.Tags...),
+		}
+		if overrides.URL != nil {
+			req.URL = *overrides.URL
+		}
+		if overrides.IOSURL != nil {
+			req.IOSURL = *overrides.IOSURL
+		}
+		if overrides.AndroidURL != nil {
+			req.AndroidURL = *overrides.AndroidURL
+		}
+		if overrides.OwnerID != nil {
+			req.OwnerID = *overrides.OwnerID
+		}
+		if overrides.QueryRules != nil {
+			req.QueryRules = *overrides.QueryRules
+		}
+		if overrides.RedirectStatus != nil {
+			req.RedirectStatus = *overrides.RedirectStatus
+		}
+		if overrides.SignClicks != nil {
+			req.SignClicks = *overrides.SignClicks
+		}
+		if overrides.MaxClicks != nil {
+			req.MaxClicks = *overrides.MaxClicks
+		}
+		if overrides.Password != nil {
+			req.Password = *overrides.Password
+		}
+		if overrides.Campaign != nil {
+			req.Campaign = *overrides.Campaign
+		}
+		if overrides.ForwardQuery != nil {
+			req.ForwardQuery = *overrides.ForwardQuery
+		}
+		if overrides.Tags != nil {
+			req.Tags = *overrides.Tags
+		}
+
+		if err := validateRequest(context.Background(), &req); err != nil {
+			return sendValidationError(c, err)
+		}
+		if maxURLs > 0 {
+			release, ok := urlStore.ReserveSlot(maxURLs)
+			if !ok {
+				return c.Status(fiber.StatusInsufficientStorage).JSON(fiber.Map{"error": "URL limit reached"})
+			}
+			defer release()
+		}
+
+		url := newShortURL(&req, urlStore.Now())
+		url.CreatedByIP = strings.Clone(c.IP()) // Request values are only valid during the handler
+		url.History[0].Detail = "cloned from " + source.ShortCode
+		if overrides.Password == nil {
+			url.PasswordHash = source.PasswordHash // Only the hash is kept, copy it as is
+		}
+		// A clone is always a new link, even where hashed codes would reuse the source
+		if err := urlStore.InsertRandom(url); err != nil {
+			log.Printf("Failed to generate a short code: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Could not generate a short code"})
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(newURLResponse(url, baseURL))
+	})
+
+	app.Post("/api/urls/expire", adminAuth, func(c *fiber.Ctx) error {
+		body, err := decodedBody(c, maxDecodedBodySize)
+		if err != nil {
+			return sendBodyError(c, err)
+		}
+		var req ExpireURLsRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request"})
+		}
+		if len(req.ShortCodes) == 0 || len(req.ShortCodes) > maxBatchSize {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("Between 1 and %d short codes are required", maxBatchSize)})
+		}
+		if (req.TTLSeconds == nil) == (req.ExpiresAt == nil) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Exactly one of ttl_seconds and expires_at is required"})
+		}
+
+		// Resolve the new expiry once so every link in the set gets the same one
+		now := urlStore.Now()
+		expiresAt := req.ExpiresAt
+		if req.TTLSeconds != nil {
+			if *req.TTLSeconds < 0 {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "ttl_seconds must not be negative"})
+			}
+			if *req.TTLSeconds > 0 {
+				t := now.Add(time.Duration(*req.TTLSeconds) * time.Second)
+				expiresAt = &t
+			}
+		} else if !expiresAt.After(now) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Expiration must be in the future"})
+		}
+
+		results := make([]ExpireURLResult, 0, len(req.ShortCodes))
+		for _, shortCode := range req.ShortCodes {
+			url, exists := urlStore.Get(shortCode)
+			if !exists {
+				results = append(results, ExpireURLResult{ShortCode: shortCode, Error: "URL not found"})
+				continue
+			}
+			url.SetExpiry(expiresAt)
+			if expiresAt != nil {
+				url.RecordEvent(eventUpdated, now, "expiry set to "+expiresAt.UTC().Format(time.RFC3339))
+			} else {
+				url.RecordEvent(eventUpdated, now, "expiry removed")
+			}
+			urlStore.Touch(url)
+			results = append(results, ExpireURLResult{ShortCode: url.ShortCode, Updated: true, ExpiresAt: expiresAt})
+		}
+		return c.JSON(fiber.Map{"results": results})
+	})
+
+	app.Post("/api/urls/delete-by-filter", adminAuth, func(c *fiber.Ctx) error {
+		var req DeleteByFilterRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request"})
+		}
+		if req.OlderThan == "" && !req.ZeroClicks && req.Domain == "" && req.Tag == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "At least one of older_than, zero_clicks, domain and tag is required"})
+		}
+		if !req.Confirm && !req.DryRun {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Set confirm to true to delete, or dry_run to preview"})
+		}
+
+		var createdBefore time.Time
+		if req.OlderThan != "" {
+			age, err := parseDuration(req.OlderThan)
+			if err != nil || age <= 0 {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "older_than must be a positive duration, e.g. 30d or 12h"})
+			}
+			createdBefore = urlStore.Now().Add(-age)
+		}
+		site := ""
+		if req.Domain != "" {
+			site = siteHost(req.Domain)
+		}
+
+		matched, deleted := urlStore.DeleteMatching(func(url *URL) bool {
+			return (req.OlderThan == "" || url.CreatedAt.Before(createdBefore)) &&
+				(!req.ZeroClicks || atomic.LoadInt64(&url.AccessCount) == 0) &&
+				(site == "" || url.OnSite(site)) &&
+				(req.Tag == "" || slices.Contains(url.Tags, req.Tag))
+		}, req.DryRun)
+		return c.JSON(DeleteByFilterResponse{Matched: matched, Deleted: deleted, DryRun: req.DryRun})
+	})
+
+	app.Put("/api/urls/:shortCode", adminAuth, func(c *fiber.Ctx) error {
+		var req UpdateURLRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request"})
+		}
+
+		url, exists := urlStore.Get(c.Params("shortCode"))
+		if !exists {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "URL not found"})
+		}
+
+		// The new destination goes through the same checks (and normalization) as on creation
+		update := CreateURLRequest{URL: req.URL}
+		if err := validateRequest(context.Background(), &update); err != nil {
+			return sendValidationError(c, err)
+		}
+		req.URL = update.URL
 
-	url := value.(*URL)
-	newCount := atomic.AddInt64(&url.AccessCount, 1)
-	s.clickCount.Add(1) // Update total click count
+		// History is public, the new destination may be behind a password
+		url.RecordEvent(eventUpdated, urlStore.Now(), "destination changed")
+		urlStore.Repoint(url, req.URL)
 
-	// No need to store back since we're modifying the pointer's data
-	_ = newCount
-	return true
-}
+		return c.JSON(newURLResponse(url, baseURL))
+	})
 
-// GetAll returns all URLs
-func (s *URLStore) GetAll() []*URL {
-	var urls []*URL
+	// Deletion is soft: the link answers 404 but can be restored until the
+	// purge job removes it after SOFT_DELETE_RETENTION
+	app.Delete("/api/urls/:shortCode", func(c *fiber.Ctx) error {
+		if !urlStore.Delete(c.Params("shortCode")) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "URL not found"})
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
 
-	// Range over the sync.Map
-	s.store.Range(func(key, value interface{}) bool {
-		urls = append(urls, value.(*URL))
-		return true
+	app.Post("/api/urls/:shortCode/restore", adminAuth, func(c *fiber.Ctx) error {
+		url, restored := urlStore.Restore(c.Params("shortCode"))
+		if !restored {
+			if _, live := urlStore.Get(c.Params("shortCode")); live {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "URL is not deleted"})
+			}
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "URL not found"})
+		}
+
+		return c.JSON(newURLResponse(url, baseURL))
 	})
 
-	return urls
-}
+	app.Post("/api/urls/:shortCode/transfer", adminAuth, func(c *fiber.Ctx) error {
+		var req TransferURLRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request"})
+		}
+		if req.OwnerID = strings.TrimSpace(req.OwnerID); req.OwnerID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "owner_id is required"})
+		}
 
-// Count returns the number of URLs in the store
-func (s *URLStore) Count() int64 {
-	return s.urlCount.Load()
-}
+		url, exists := urlStore.Transfer(c.Params("shortCode"), req.OwnerID)
+		if !exists {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "URL not found"})
+		}
 
-// TotalClicks returns the total number of clicks across all URLs
-func (s *URLStore) TotalClicks() int64 {
-	return s.clickCount.Load()
-}
+		return c.JSON(newURLResponse(url, baseURL))
+	})
 
-func main() {
-	// Initialize the URL store
-	urlStore := NewURLStore()
+	app.Get("/api/analytics/referrers", func(c *fiber.Ctx) error {
+		limit := c.QueryInt("limit", 10)
+		if limit < 1 || limit > maxPageLimit {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("limit must be between 1 and %d", maxPageLimit)})
+		}
 
-	// Load the index HTML
-	indexHTML, err := os.ReadFile("static/index.html")
-	if err != nil {
-		indexHTML = []byte("<h1>Failed to load index.html</h1>")
-	}
+		c.Set(fiber.HeaderCacheControl, "private, max-age=5") // Cache for 5 seconds
+		return c.JSON(ReferrersResponse{Referrers: urlStore.TopReferrers(limit)})
+	})
 
-	// Check if running in Docker or container environment
-	inContainer := os.Getenv("IN_CONTAINER") == "true"
+	app.Get("/api/store/growth", func(c *fiber.Ctx) error {
+		hour, day, week := urlStore.RecentCreations()
+		resp := StoreGrowthResponse{
+			Total:    urlStore.Count(),
+			LastHour: hour,
+			LastDay:  day,
+			LastWeek: week,
+			PerHour:  float64(week) / (7 * 24),
+		}
 
-	// Create a new Fiber app with optimized settings
-	app := fiber.New(fiber.Config{
-		Prefork:               !inContainer, // Disable prefork in container to prevent port conflicts
-		ServerHeader:          "Fiber",
-		StrictRouting:         true,
-		CaseSensitive:         true,
-		BodyLimit:             1 * 1024 * 1024, // 1MB
-		ReadTimeout:           5 * time.Second,
-		WriteTimeout:          5 * time.Second,
-		IdleTimeout:           10 * time.Second,
-		DisableStartupMessage: true,       // Reduce startup overhead
-		ReduceMemoryUsage:     true,       // Optimize memory usage
-		Concurrency:           256 * 1024, // Higher concurrency limit
-		// JSONEncoder and JSONDecoder can be customized with custom encoders
+		if maxURLs > 0 {
+			remaining := max(maxURLs-resp.Total, 0)
+			resp.MaxURLs = maxURLs
+			resp.Remaining = &remaining
+			if resp.PerHour > 0 {
+				seconds := int64(float64(remaining) / resp.PerHour * 3600)
+				fullAt := urlStore.Now().Add(time.Duration(seconds) * time.Second)
+				resp.ProjectedSecondsToLimit = &seconds
+				resp.ProjectedFullAt = &fullAt
+			}
+		}
+
+		c.Set(fiber.HeaderCacheControl, "private, max-age=5") // Cache for 5 seconds
+		return c.JSON(resp)
 	})
 
-	// Get environment variables for performance tuning
-	maxProcs := os.Getenv("GOMAXPROCS")
-	if maxProcs == "" {
-		// Default to number of CPUs
-		maxProcs = fmt.Sprintf("%d", runtime.NumCPU())
-		os.Setenv("GOMAXPROCS", maxProcs)
-	}
+	app.Get("/api/store/code-lengths", func(c *fiber.Ctx) error {
+		resp := CodeLengthsResponse{Lengths: urlStore.CodeLengths()}
+		for _, length := range resp.Lengths {
+			resp.Total += length.Count
+		}
+		c.Set(fiber.HeaderCacheControl, "private, max-age=5") // Cache for 5 seconds
+		return c.JSON(resp)
+	})
 
-	// Add middleware for better performance and monitoring
-	app.Use(compress.New(compress.Config{
-		Level: compress.LevelBestSpeed,
-	}))
-	app.Use(cors.New())
-	app.Use(logger.New(logger.Config{
-		Format: "${time} | ${status} | ${latency} | ${method} | ${path}\n",
-	}))
+	app.Get("/api/metrics/throughput", func(c *fiber.Ctx) error {
+		redirects, shortens, span := metrics.Throughput()
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		return c.JSON(ThroughputResponse{
+			RedirectsPerSecond: redirects,
+			ShortensPerSecond:  shortens,
+			WindowSeconds:      span.Seconds(),
+		})
+	})
 
-	// Define routes
-	app.Get("/", func(c *fiber.Ctx) error {
-		return c.Type("html").Send(indexHTML)
+	// Compact counts for dashboards polling every link
+	app.Get("/api/clicks", func(c *fiber.Ctx) error {
+		minClicks := c.QueryInt("min_clicks", 0)
+		if minClicks < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "min_clicks must not be negative"})
+		}
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		return c.JSON(urlStore.ClickCounts(int64(minClicks)))
 	})
 
-	// Use a pooled object for request/response to reduce allocations
-	type pooledURLResponse struct {
-		resp URLResponse
-		req  CreateURLRequest
-	}
+	app.Get("/api/analytics/creations", func(c *fiber.Ctx) error {
+		days := c.QueryInt("days", 30)
+		if days < 1 || days > maxTimeseriesDays {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("days must be between 1 and %d", maxTimeseriesDays)})
+		}
 
-	// Set up a sync.Pool for URLResponse objects to reduce garbage collection
-	urlRespPool := sync.Pool{
-		New: func() interface{} {
-			return new(pooledURLResponse)
-		},
-	}
+		series := urlStore.CreationsPerDay(days)
+		total := 0
+		for _, day := range series {
+			total += day.Links
+		}
 
-	app.Post("/api/shorten", func(c *fiber.Ctx) error {
-		// Get object from pool
-		pooled := urlRespPool.Get().(*pooledURLResponse)
-		defer urlRespPool.Put(pooled)
+		c.Set(fiber.HeaderCacheControl, "private, max-age=5") // Cache for 5 seconds
+		return c.JSON(CreationsResponse{
+			Timezone: urlStore.Location().String(),
+			Total:    total,
+			Series:   series,
+		})
+	})
 
-		// Reset values
-		pooled.req.URL = ""
+	app.Get("/api/analytics/slow-destinations", func(c *fiber.Ctx) error {
+		limit := c.QueryInt("limit", 10)
+		if limit < 1 || limit > maxPageLimit {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("limit must be between 1 and %d", maxPageLimit)})
+		}
 
-		if err := c.BodyParser(&pooled.req); err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request"})
+		// Served from the last link check, never probes destinations itself
+		c.Set(fiber.HeaderCacheControl, "private, max-age=5") // Cache for 5 seconds
+		return c.JSON(SlowDestinationsResponse{Destinations: linkChecker.Slowest(limit)})
+	})
+
+	app.Get("/api/campaigns/:name/timeseries", func(c *fiber.Ctx) error {
+		days := c.QueryInt("days", 30)
+		if days < 1 || days > maxTimeseriesDays {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("days must be between 1 and %d", maxTimeseriesDays)})
 		}
 
-		// Basic URL validation
-		if !strings.HasPrefix(pooled.req.URL, "http://") && !strings.HasPrefix(pooled.req.URL, "https://") {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid URL provided"})
+		campaign := c.Params("name")
+		series, links := urlStore.CampaignTimeseries(campaign, days)
+		if links == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Campaign not found"})
 		}
 
-		// Generate short code
-		shortCode, _ := gonanoid.New(6)
+		var total int64
+		for _, day := range series {
+			total += day.Clicks
+		}
+		return c.JSON(CampaignTimeseriesResponse{
+			Campaign: campaign,
+			Links:    links,
+			Total:    total,
+			Series:   series,
+		})
+	})
 
-		// Generate unique ID
-		id, _ := gonanoid.New(10)
+	app.Get("/api/urls/:shortCode/referrers", func(c *fiber.Ctx) error {
+		limit := c.QueryInt("limit", 10)
+		if limit < 1 || limit > maxPageLimit {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("limit must be between 1 and %d", maxPageLimit)})
+		}
 
-		// Create URL object
-		url := &URL{
-			ID:          id,
-			OriginalURL: pooled.req.URL,
-			ShortCode:   shortCode,
-			CreatedAt:   time.Now(),
-			AccessCount: 0,
+		url, exists := urlStore.Get(c.Params("shortCode"))
+		if !exists {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "URL not found"})
 		}
+		referrers, userAgents := url.Sources(limit)
+		return c.JSON(URLReferrersResponse{
+			ShortCode:  url.ShortCode,
+			Referrers:  referrers,
+			UserAgents: userAgents,
+		})
+	})
 
-		// Save to in-memory store
-		urlStore.Add(shortCode, url)
+	app.Get("/api/urls/:shortCode/stats", func(c *fiber.Ctx) error {
+		days := c.QueryInt("days", 30)
+		if days < 1 || days > maxTimeseriesDays {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("days must be between 1 and %d", maxTimeseriesDays)})
+		}
 
-		// Get base URL from environment or use default
-		baseURL := os.Getenv("BASE_URL")
-		if baseURL == "" {
-			baseURL = "http://localhost:3000"
+		url, exists := urlStore.Get(c.Params("shortCode"))
+		if !exists {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "URL not found"})
 		}
+		return c.JSON(URLStatsResponse{
+			ShortCode: url.ShortCode,
+			Total:     atomic.LoadInt64(&url.AccessCount),
+			Series:    urlStore.DailyClicks(url, days),
+		})
+	})
 
-		// Prepare response using the pooled object
-		pooled.resp.OriginalURL = url.OriginalURL
-		pooled.resp.ShortCode = url.ShortCode
-		pooled.resp.ShortURL = fmt.Sprintf("%s/%s", baseURL, url.ShortCode)
-		pooled.resp.CreatedAt = url.CreatedAt
-		pooled.resp.AccessCount = url.AccessCount
+	app.Get("/api/info/:shortCode/clicks/since", func(c *fiber.Ctx) error {
+		since, err := time.Parse(time.RFC3339, c.Query("ts"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "ts must be an RFC 3339 timestamp"})
+		}
+		if since.Before(urlStore.Now().Add(-clickHistoryMinutes * time.Minute)) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "ts is older than the 7 day click history"})
+		}
 
-		// Return the shortened URL
-		return c.JSON(pooled.resp)
+		url, exists := urlStore.Get(c.Params("shortCode"))
+		if !exists {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "URL not found"})
+		}
+
+		return c.JSON(ClicksSinceResponse{
+			ShortCode: url.ShortCode,
+			Since:     since,
+			Clicks:    urlStore.ClicksSince(url, since),
+		})
 	})
 
-	app.Get("/:shortCode", func(c *fiber.Ctx) error {
-		shortCode := c.Params("shortCode", "")
-		if shortCode == "" {
+	app.Get("/api/info/:shortCode/history", func(c *fiber.Ctx) error {
+		url, exists := urlStore.Get(c.Params("shortCode"))
+		if !exists {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "URL not found"})
 		}
+		if url.NoteExpiry(urlStore.Now()) {
+			urlStore.Touch(url)
+		}
 
-		// Get URL from store
-		url, exists := urlStore.Get(shortCode)
+		return c.JSON(LinkHistoryResponse{
+			ShortCode: url.ShortCode,
+			Events:    url.LifecycleHistory(),
+		})
+	})
+
+	// Dry run of the redirect for debugging destination rules: same decisions
+	// as GET /:shortCode, but nothing is redirected or counted
+	app.Post("/api/info/:shortCode/simulate", adminAuth, func(c *fiber.Ctx) error {
+		// Inputs the simulation can't take into account, such as a country,
+		// are refused rather than silently ignored
+		var req SimulateRedirectRequest
+		if len(c.Body()) > 0 {
+			decoder := json.NewDecoder(bytes.NewReader(c.Body()))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&req); err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request: " + strings.TrimPrefix(err.Error(), "json: ")})
+			}
+		}
+
+		url, exists := urlStore.Get(c.Params("shortCode"))
 		if !exists {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "URL not found"})
 		}
 
-		// Increment access count asynchronously to avoid blocking
-		go urlStore.IncrementAccessCount(shortCode)
+		at := urlStore.Now()
+		if req.At != nil {
+			at = *req.At
+		}
+		platform := ClassifyPlatform(req.UserAgent)
+		resp := SimulateRedirectResponse{ShortCode: url.ShortCode, Platform: platform.String()}
 
-		// Redirect to original URL
-		c.Set(fiber.HeaderCacheControl, "public, max-age=86400") // Cache for 24 hours
-		return c.Redirect(url.OriginalURL, fiber.StatusMovedPermanently)
+		switch destination := url.ResolveDestination(platform, strings.TrimPrefix(req.Query, "?")); {
+		case url.Expired(at):
+			resp.Status, resp.Outcome = fiber.StatusGone, "expired"
+		case url.Protected():
+			resp.Status, resp.Outcome = fiber.StatusUnauthorized, "password_required"
+		case blocklist.IsBlocked(destination) && !trustedHosts.Trusts(destination):
+			resp.Status, resp.Outcome, resp.Destination = fiber.StatusForbidden, "blocked", destination
+		case url.ClicksExhausted():
+			resp.Status, resp.Outcome = fiber.StatusGone, "click_limit_reached"
+		default:
+			resp.Status, resp.Outcome, resp.Destination = url.StatusCode(), "redirect", destination
+		}
+		return c.JSON(resp)
 	})
 
-	app.Get("/api/urls", func(c *fiber.Ctx) error {
-		// Get all URLs
-		urls := urlStore.GetAll()
+	app.Get("/api/info/:shortCode/hourly", func(c *fiber.Ctx) error {
+		url, exists := urlStore.Get(c.Params("shortCode"))
+		if !exists {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "URL not found"})
+		}
 
-		// Get base URL from environment or use default
-		baseURL := os.Getenv("BASE_URL")
-		if baseURL == "" {
-			baseURL = "http://localhost:3000"
+		hours := urlStore.HourlyClicks(url)
+		var total int64
+		for _, clicks := range hours {
+			total += clicks
 		}
 
-		// Pre-allocate the exact size needed to avoid resizing
-		responses := make([]URLResponse, 0, len(urls))
+		return c.JSON(HourlyClicksResponse{
+			ShortCode: url.ShortCode,
+			Timezone:  urlStore.Location().String(),
+			Hours:     hours,
+			Total:     total,
+		})
+	})
 
-		// Process in batches for better cache locality
-		const batchSize = 64
-		for i := 0; i < len(urls); i += batchSize {
-			end := i + batchSize
-			if end > len(urls) {
-				end = len(urls)
-			}
+	app.Post("/api/admin/reload-index", adminAuth, func(c *fiber.Ctx) error {
+		if err := indexHTML.Reload(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": fmt.Sprintf("Failed to reload index: %v", err)})
+		}
+		return c.JSON(fiber.Map{"status": "reloaded", "bytes": len(indexHTML.HTML())})
+	})
 
-			// Process this batch
-			for j := i; j < end; j++ {
-				url := urls[j]
-				responses = append(responses, URLResponse{
-					OriginalURL: url.OriginalURL,
-					ShortCode:   url.ShortCode,
-					ShortURL:    fmt.Sprintf("%s/%s", baseURL, url.ShortCode),
-					CreatedAt:   url.CreatedAt,
-					AccessCount: url.AccessCount,
-				})
+	app.Get("/api/admin/routes", adminAuth, func(c *fiber.Ctx) error {
+		routes := app.GetRoutes(true) // Skip app.Use middleware entries
+		sort.Slice(routes, func(i, j int) bool {
+			if routes[i].Path != routes[j].Path {
+				return routes[i].Path < routes[j].Path
 			}
+			return routes[i].Method < routes[j].Method
+		})
+
+		list := make([]RouteInfo, 0, len(routes))
+		for _, route := range routes {
+			list = append(list, RouteInfo{Method: route.Method, Path: route.Path})
 		}
+		return c.JSON(list)
+	})
 
-		// Sort by creation date descending - use more efficient sort if possible
-		if len(responses) > 0 {
-			sort.Slice(responses, func(i, j int) bool {
-				return responses[i].CreatedAt.After(responses[j].CreatedAt)
-			})
+	// Recovers lookups after secondary indexes drift from the primary store
+	app.Post("/api/admin/reindex", adminAuth, func(c *fiber.Ctx) error {
+		return c.JSON(urlStore.Reindex())
+	})
+
+	app.Get("/api/admin/config", adminAuth, func(c *fiber.Ctx) error {
+		config := app.Config()
+		return c.JSON(ServerConfigResponse{
+			Prefork:       config.Prefork,
+			KeepAlive:     !config.DisableKeepalive,
+			IdleTimeout:   config.IdleTimeout.String(),
+			ReadTimeout:   config.ReadTimeout.String(),
+			WriteTimeout:  config.WriteTimeout.String(),
+			MaxConnsPerIP: app.Server().MaxConnsPerIP,
+			Concurrency:   config.Concurrency,
+			BodyLimit:     config.BodyLimit,
+		})
+	})
+
+	app.Get("/api/admin/jobs", adminAuth, func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		return c.JSON(janitor.Jobs())
+	})
+
+	app.Get("/api/admin/urls", adminAuth, func(c *fiber.Ctx) error {
+		urls := urlStore.GetAll()
+		if c.QueryBool("deleted") {
+			urls = urlStore.ListDeleted()
 		}
+		sort.Slice(urls, func(i, j int) bool {
+			return newestFirst(urls[i], urls[j])
+		})
 
-		// Set cache headers for better client-side caching
-		c.Set(fiber.HeaderCacheControl, "private, max-age=10") // Cache for 10 seconds
+		responses := make([]AdminURLResponse, 0, len(urls))
+		for _, url := range urls {
+			responses = append(responses, AdminURLResponse{
+				URLResponse: newURLResponse(url, baseURL),
+				CreatedByIP: url.CreatedByIP,
+				DeletedAt:   url.DeletionTime(),
+			})
+		}
 		return c.JSON(responses)
 	})
 
-	app.Get("/api/analytics", func(c *fiber.Ctx) error {
-		// Get all URLs
-		urls := urlStore.GetAll()
+	app.Post("/api/admin/warm", adminAuth, func(c *fiber.Ctx) error {
+		body, err := decodedBody(c, maxDecodedBodySize)
+		if err != nil {
+			return sendBodyError(c, err)
+		}
+		var req WarmCacheRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request"})
+		}
+		if (len(req.ShortCodes) > 0) == (req.Top != 0) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Exactly one of short_codes and top is required"})
+		}
+		if len(req.ShortCodes) > maxBatchSize || req.Top < 0 || req.Top > maxBatchSize {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("At most %d links per request", maxBatchSize)})
+		}
 
-		// Get base URL from environment or use default
-		baseURL := os.Getenv("BASE_URL")
-		if baseURL == "" {
-			baseURL = "http://localhost:3000"
+		var loaded int
+		if req.Top > 0 {
+			loaded, err = urlStore.WarmTop(req.Top)
+		} else {
+			loaded, err = urlStore.Warm(req.ShortCodes)
+		}
+		if err != nil {
+			log.Printf("Warm: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load URLs"})
 		}
+		return c.JSON(WarmCacheResponse{Loaded: loaded})
+	})
 
-		// Pre-allocate the exact size needed
-		responses := make([]URLResponse, 0, len(urls))
+	app.Post("/api/admin/import", adminAuth, func(c *fiber.Ctx) error {
+		body, err := decodedBody(c, maxDecodedBodySize)
+		if err != nil {
+			return sendBodyError(c, err)
+		}
 
-		// Convert to response DTOs with better batch processing
-		const batchSize = 64
-		for i := 0; i < len(urls); i += batchSize {
-			end := i + batchSize
-			if end > len(urls) {
-				end = len(urls)
-			}
+		// Same shape as a JSON snapshot, so an export can be imported as-is
+		var urls []*URL
+		if err := json.Unmarshal(body, &urls); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request"})
+		}
 
-			for j := i; j < end; j++ {
-				url := urls[j]
-				responses = append(responses, URLResponse{
-					OriginalURL: url.OriginalURL,
-					ShortCode:   url.ShortCode,
-					ShortURL:    fmt.Sprintf("%s/%s", baseURL, url.ShortCode),
-					CreatedAt:   url.CreatedAt,
-					AccessCount: url.AccessCount,
-				})
-			}
+		imported, skipped := urlStore.Import(urls)
+		resp := ImportResponse{Imported: imported, Skipped: len(skipped), Errors: make([]ImportError, len(skipped))}
+		for i, skip := range skipped {
+			log.Printf("Import: skipping entry %d: %s", skip.Index, skip.Err.Message)
+			resp.Errors[i] = ImportError{Index: skip.Index, Error: validationDetail(skip.Err)}
 		}
+		return c.JSON(resp)
+	})
 
-		// Sort by access count descending - use more efficient sort if possible
-		if len(responses) > 0 {
-			sort.Slice(responses, func(i, j int) bool {
-				return responses[i].AccessCount > responses[j].AccessCount
-			})
+	app.Get("/api/export.sqlite", adminAuth, func(c *fiber.Ctx) error {
+		tmp, err := os.CreateTemp("", "url-export-*.sqlite")
+		if err != nil {
+			log.Printf("SQLite export: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Export failed"})
 		}
+		tmp.Close()
+		defer os.Remove(tmp.Name()) // Still readable while streaming once unlinked
 
-		// Use cached count values for better performance
-		analytics := AnalyticsResponse{
-			TotalURLs:   urlStore.Count(),
-			TotalClicks: urlStore.TotalClicks(),
-			URLs:        responses,
+		if _, err := urlStore.ExportSQLite(tmp.Name()); err != nil {
+			log.Printf("SQLite export: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Export failed"})
 		}
 
-		// Set cache headers
-		c.Set(fiber.HeaderCacheControl, "private, max-age=5") // Cache for 5 seconds
-		return c.JSON(analytics)
+		f, err := os.Open(tmp.Name())
+		if err != nil {
+			log.Printf("SQLite export: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Export failed"})
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			log.Printf("SQLite export: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Export failed"})
+		}
+
+		c.Set(fiber.HeaderContentType, "application/vnd.sqlite3")
+		c.Set(fiber.HeaderContentDisposition, `attachment; filename="urls.sqlite"`)
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		return c.SendStream(f, int(info.Size())) // Closed by fasthttp once sent
+	})
+
+	app.Get("/api/admin/blocklist", adminAuth, func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"hosts": blocklist.Hosts()})
+	})
+
+	app.Post("/api/admin/blocklist", adminAuth, func(c *fiber.Ctx) error {
+		var req struct {
+			Host string `json:"host"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request"})
+		}
+		if !blocklist.Add(req.Host) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid host provided"})
+		}
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{"hosts": blocklist.Hosts()})
+	})
+
+	app.Delete("/api/admin/blocklist/:host", adminAuth, func(c *fiber.Ctx) error {
+		if !blocklist.Remove(strings.Clone(c.Params("host"))) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Host not in blocklist"})
+		}
+		return c.SendStatus(fiber.StatusNoContent)
 	})
 
+	return &server{
+		app:                  app,
+		store:                urlStore,
+		clickRecorder:        clickRecorder,
+		linkChecker:          linkChecker,
+		accessLog:            accessLog,
+		draining:             &draining,
+		drainDelay:           drainDelay,
+		shutdownTimeout:      shutdownTimeout,
+		inContainer:          inContainer,
+		persistent:           persistent,
+		snapshotPath:         snapshotPath,
+		snapshotFallbackPath: snapshotFallbackPath,
+		snapshotFormat:       snapshotFormat,
+		snapshotRetries:      snapshotRetries,
+	}
+}
+
+// drain fails readiness and waits out the drain delay, so load balancers
+// stop routing new requests before connections are closed
+func (s *server) drain() {
+	s.draining.Store(true)
+	if s.drainDelay > 0 {
+		log.Printf("Draining for %s before shutdown...", s.drainDelay)
+		time.Sleep(s.drainDelay)
+	}
+}
+
+func main() {
+	srv := newServer()
+	app, urlStore, clickRecorder := srv.app, srv.store, srv.clickRecorder
+
 	// Setup graceful shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 
+	// Listen returns as soon as the listener closes, before in-flight requests
+	// finish; the deadline is handed over once they have
+	shutdownDeadline := make(chan time.Time, 1)
 	go func() {
 		<-quit
-		fmt.Println("Shutting down server...")
-		if err := app.Shutdown(); err != nil {
-			fmt.Printf("Error shutting down server: %v\n", err)
+		srv.drain()
+		log.Println("Shutting down server...")
+		deadline := time.Now().Add(srv.shutdownTimeout)
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		if err := app.ShutdownWithContext(ctx); err != nil {
+			log.Printf("Error shutting down server: %v", err)
 		}
+		shutdownDeadline <- deadline
 	}()
 
 	// Start the server
@@ -374,8 +4657,10 @@ func main() {
 	if isPrefork {
 		log.Printf("Starting in prefork mode with %d CPU cores", cpuCount)
 	} else {
-		if inContainer {
+		if srv.inContainer {
 			log.Printf("Starting in single process mode (prefork disabled in container environment)")
+		} else if srv.persistent {
+			log.Printf("Starting in single process mode (prefork disabled with DATABASE_PATH or SNAPSHOT_PATH)")
 		} else {
 			log.Printf("Starting in single process mode (prefork disabled)")
 		}
@@ -385,4 +4670,38 @@ func main() {
 	if err := app.Listen(fmt.Sprintf("0.0.0.0:%s", port)); err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
+
+	// No more redirects can be served; apply every queued click before
+	// persisting the store, giving up at the shutdown deadline
+	ctx, cancel := context.WithDeadline(context.Background(), <-shutdownDeadline)
+	defer cancel()
+	flushed := make(chan struct{})
+	go func() {
+		defer close(flushed)
+		clickRecorder.Close()
+		if err := urlStore.ClosePersistence(); err != nil {
+			log.Printf("Failed to flush URLs to database: %v", err)
+		}
+	}()
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		log.Printf("Shutdown timed out after %s with %d clicks and %d URL writes still pending",
+			srv.shutdownTimeout, clickRecorder.Pending(), urlStore.PendingWrites())
+	}
+	if srv.accessLog != nil {
+		if err := srv.accessLog.Close(); err != nil {
+			log.Printf("Failed to close access log: %v", err)
+		}
+	}
+	if srv.snapshotPath != "" {
+		savedPath, err := urlStore.SaveSnapshot(ctx, srv.snapshotPath, srv.snapshotFallbackPath, srv.snapshotFormat, srv.snapshotRetries)
+		if err != nil {
+			log.Fatalf("Failed to save snapshot: %v", err)
+		}
+		log.Printf("Saved %d URLs to %s (%s)", urlStore.Count(), savedPath, srv.snapshotFormat)
+		if savedPath != srv.snapshotPath {
+			log.Printf("Snapshot is not at SNAPSHOT_PATH; move %s to %s before restarting to restore it", savedPath, srv.snapshotPath)
+		}
+	}
 }
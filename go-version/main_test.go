@@ -0,0 +1,2608 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// newTestServer builds the app with env set as key, value pairs. Settings
+// newServer writes to package variables are restored afterwards.
+func newTestServer(t *testing.T, env ...string) *server {
+	t.Helper()
+	for i := 0; i+1 < len(env); i += 2 {
+		t.Setenv(env[i], env[i+1])
+	}
+	retryAfter, redirectStatus, aliasLength, ids := retryAfterFormat, defaultRedirectStatus, maxAliasLength, idLength
+	t.Cleanup(func() {
+		retryAfterFormat, defaultRedirectStatus, maxAliasLength, idLength = retryAfter, redirectStatus, aliasLength, ids
+	})
+	return newServer()
+}
+
+// do sends a request to the app, with headers as key, value pairs. A body
+// is sent as JSON.
+func (s *server) do(t *testing.T, method, path, body string, headers ...string) *http.Response {
+	t.Helper()
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := s.app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return resp
+}
+
+// decode reads a JSON response body into v
+func decode(t *testing.T, resp *http.Response, v interface{}) {
+	t.Helper()
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+}
+
+// settleClicks waits until the click recorder has applied every click
+func (s *server) settleClicks(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.clickRecorder.Pending() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clicks still pending", s.clickRecorder.Pending())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// shorten creates a link through the API and returns it
+func (s *server) shorten(t *testing.T, body string) URLResponse {
+	t.Helper()
+	resp := s.do(t, "POST", "/api/shorten", body)
+	if resp.StatusCode != http.StatusOK {
+		payload, _ := io.ReadAll(resp.Body)
+		t.Fatalf("POST /api/shorten %s: status %d: %s", body, resp.StatusCode, payload)
+	}
+	var url URLResponse
+	decode(t, resp, &url)
+	return url
+}
+
+func TestRedirectPicksPlatformDestination(t *testing.T) {
+	srv := newTestServer(t)
+	link := srv.shorten(t, `{"url": "https://example.com/web", "ios_url": "https://apps.apple.com/app/id1", "android_url": "https://play.google.com/store/apps/details?id=app"}`)
+
+	tests := []struct {
+		name, userAgent, want string
+	}{
+		{"iOS", "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148", "https://apps.apple.com/app/id1"},
+		{"Android", "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 Chrome/120.0 Mobile Safari/537.36", "https://play.google.com/store/apps/details?id=app"},
+		{"desktop", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/120.0 Safari/537.36", "https://example.com/web"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := srv.do(t, "GET", "/"+link.ShortCode, "", "User-Agent", tt.userAgent)
+			if resp.StatusCode != http.StatusMovedPermanently {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusMovedPermanently)
+			}
+			if got := resp.Header.Get("Location"); got != tt.want {
+				t.Errorf("Location = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryAfterFormats(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.FixedZone("CET", 3600))
+	if got := RetryAfterSeconds.Value(1500*time.Millisecond, now); got != "2" {
+		t.Errorf("seconds: Value = %q, want %q (rounded up)", got, "2")
+	}
+	if got := RetryAfterSeconds.Value(-time.Second, now); got != "0" {
+		t.Errorf("seconds: Value of a past wait = %q, want %q", got, "0")
+	}
+	if got := RetryAfterHTTPDate.Value(90*time.Second, now); got != "Sun, 01 Mar 2026 11:01:30 GMT" {
+		t.Errorf("http-date: Value = %q, want the UTC time in IMF-fixdate", got)
+	}
+	if _, err := ParseRetryAfterFormat("minutes"); err == nil {
+		t.Error("ParseRetryAfterFormat accepted an unknown format")
+	}
+}
+
+func TestRetryAfterOnRateLimitedRequests(t *testing.T) {
+	for _, format := range []RetryAfterFormat{RetryAfterSeconds, RetryAfterHTTPDate} {
+		t.Run(string(format), func(t *testing.T) {
+			srv := newTestServer(t, "SHORTEN_RATE_LIMIT", "1", "RETRY_AFTER_FORMAT", string(format))
+			srv.shorten(t, `{"url": "https://example.com/"}`)
+			resp := srv.do(t, "POST", "/api/shorten", `{"url": "https://example.com/"}`)
+			if resp.StatusCode != http.StatusTooManyRequests {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+			}
+
+			value := resp.Header.Get("Retry-After")
+			if format == RetryAfterHTTPDate {
+				at, err := http.ParseTime(value)
+				if err != nil || !strings.HasSuffix(value, " GMT") {
+					t.Fatalf("Retry-After = %q, want an HTTP-date", value)
+				}
+				if wait := time.Until(at); wait < -time.Second || wait > time.Minute {
+					t.Errorf("Retry-After = %q, want a time within the rate window", value)
+				}
+				return
+			}
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds < 1 || seconds > 60 {
+				t.Errorf("Retry-After = %q, want delta-seconds within the rate window", value)
+			}
+		})
+	}
+}
+
+func TestHourlyClicksUseConfiguredTimezone(t *testing.T) {
+	srv := newTestServer(t, "TIMEZONE", "America/New_York")
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	srv.store.SetClock(func() time.Time { return now })
+	link := srv.shorten(t, `{"url": "https://example.com/"}`)
+
+	// 13:30 and 13:59 UTC are 09:xx in New York (EDT), 02:00 UTC is 22:00 the day before
+	for _, at := range []string{"13:30", "13:59", "02:00", "02:00", "02:00"} {
+		clock, _ := time.Parse("15:04", at)
+		now = time.Date(2026, 6, 2, clock.Hour(), clock.Minute(), 0, 0, time.UTC)
+		srv.do(t, "GET", "/"+link.ShortCode, "")
+	}
+	srv.settleClicks(t)
+
+	var hourly HourlyClicksResponse
+	decode(t, srv.do(t, "GET", "/api/info/"+link.ShortCode+"/hourly", ""), &hourly)
+	var want [24]int64
+	want[9], want[22] = 2, 3
+	if hourly.Hours != want || hourly.Total != 5 {
+		t.Errorf("hours = %v (total %d), want %v (total 5)", hourly.Hours, hourly.Total, want)
+	}
+	if hourly.Timezone != "America/New_York" {
+		t.Errorf("timezone = %q, want America/New_York", hourly.Timezone)
+	}
+
+	if resp := srv.do(t, "GET", "/api/info/missing/hourly", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown code: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestHourlyClicksReportStoredCode(t *testing.T) {
+	srv := newTestServer(t, "CASE_INSENSITIVE_CODES", "true")
+	link := srv.shorten(t, `{"url": "https://example.com/"}`)
+
+	var hourly HourlyClicksResponse
+	decode(t, srv.do(t, "GET", "/api/info/"+strings.ToUpper(link.ShortCode)+"/hourly", ""), &hourly)
+	if hourly.ShortCode != link.ShortCode {
+		t.Errorf("short code = %q, want the stored %q", hourly.ShortCode, link.ShortCode)
+	}
+}
+
+// listCodes returns the short codes GET path lists, in order
+func (s *server) listCodes(t *testing.T, path string) []string {
+	t.Helper()
+	var urls []URLResponse
+	decode(t, s.do(t, "GET", path, ""), &urls)
+	codes := make([]string, len(urls))
+	for i, url := range urls {
+		codes[i] = url.ShortCode
+	}
+	return codes
+}
+
+func TestTransferMovesLinkBetweenOwners(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN", "secret")
+	link := srv.shorten(t, `{"url": "https://example.com/a", "owner_id": "team-a"}`)
+	kept := srv.shorten(t, `{"url": "https://example.com/b", "owner_id": "team-a"}`)
+
+	resp := srv.do(t, "POST", "/api/urls/"+link.ShortCode+"/transfer", `{"owner_id": "team-b"}`, "Authorization", "Bearer secret")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("transfer: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	if got := srv.listCodes(t, "/api/urls?owner_id=team-b"); !reflect.DeepEqual(got, []string{link.ShortCode}) {
+		t.Errorf("team-b links = %v, want [%s]", got, link.ShortCode)
+	}
+	if got := srv.listCodes(t, "/api/urls?owner_id=team-a"); !reflect.DeepEqual(got, []string{kept.ShortCode}) {
+		t.Errorf("team-a links = %v, want only [%s]", got, kept.ShortCode)
+	}
+
+	tests := []struct {
+		name, code, body string
+		status           int
+	}{
+		{"missing owner", link.ShortCode, `{"owner_id": "  "}`, http.StatusBadRequest},
+		{"unknown link", "missing", `{"owner_id": "team-b"}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		resp := srv.do(t, "POST", "/api/urls/"+tt.code+"/transfer", tt.body, "Authorization", "Bearer secret")
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+	}
+	if resp := srv.do(t, "POST", "/api/urls/"+link.ShortCode+"/transfer", `{"owner_id": "team-c"}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without the admin token: status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestQueryRulesSelectDestination(t *testing.T) {
+	srv := newTestServer(t)
+	link := srv.shorten(t, `{"url": "https://example.com/default", "query_rules": [
+		{"param": "lang", "value": "de", "destination": "https://example.de/"},
+		{"param": "lang", "value": "fr", "destination": "https://example.fr/"}
+	]}`)
+
+	tests := []struct {
+		query, want string
+	}{
+		{"?lang=de", "https://example.de/"},
+		{"?lang=fr&utm_source=mail", "https://example.fr/?utm_source=mail"},
+		{"?lang=it", "https://example.com/default"},
+		{"?other=de", "https://example.com/default?other=de"},
+		{"", "https://example.com/default"},
+	}
+	for _, tt := range tests {
+		resp := srv.do(t, "GET", "/"+link.ShortCode+tt.query, "")
+		if got := resp.Header.Get("Location"); got != tt.want {
+			t.Errorf("%q: Location = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestTrimAnalyticsDropsOnlyOldDays(t *testing.T) {
+	now := time.Date(2026, 6, 15, 12, 0, 0, 0, time.UTC)
+	clock := now
+	store := NewURLStore()
+	store.SetLocation(time.UTC)
+	store.SetClock(func() time.Time { return clock })
+	store.SetRetention(30 * 24 * time.Hour)
+
+	url := &URL{ShortCode: "trim", OriginalURL: "https://example.com/", CreatedAt: now}
+	store.Add(url.ShortCode, url)
+	for _, age := range []time.Duration{100 * 24 * time.Hour, 31 * 24 * time.Hour, 29 * 24 * time.Hour, time.Hour} {
+		clock = now.Add(-age)
+		store.IncrementAccessCount(url.ShortCode)
+	}
+	clock = now
+
+	if removed := store.TrimAnalytics(); removed != 2 {
+		t.Errorf("TrimAnalytics() = %d, want 2 day buckets", removed)
+	}
+	want := map[string]int64{"2026-05-17": 1, "2026-06-15": 1}
+	if !reflect.DeepEqual(url.DailyClicks, want) {
+		t.Errorf("DailyClicks = %v, want %v", url.DailyClicks, want)
+	}
+	if url.AccessCount != 4 || store.TotalClicks() != 4 {
+		t.Errorf("AccessCount = %d, TotalClicks = %d; totals must be kept at 4", url.AccessCount, store.TotalClicks())
+	}
+	var hourly int64
+	for _, clicks := range url.HourlyClicks {
+		hourly += clicks
+	}
+	if hourly != 4 {
+		t.Errorf("hourly histogram holds %d clicks, want 4", hourly)
+	}
+
+	store.SetRetention(0)
+	clock = now.Add(365 * 24 * time.Hour)
+	if removed := store.TrimAnalytics(); removed != 0 {
+		t.Errorf("TrimAnalytics() without retention = %d, want 0", removed)
+	}
+}
+
+func TestReserveSlotHonorsLimitUnderConcurrency(t *testing.T) {
+	const limit = 10
+	store := NewURLStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, ok := store.ReserveSlot(limit)
+			if !ok {
+				return
+			}
+			defer release()
+			if _, _, err := store.Insert(newShortURL(&CreateURLRequest{URL: "https://example.com/"}, time.Now())); err != nil {
+				t.Errorf("Insert: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if count := store.Count(); count != limit {
+		t.Errorf("Count() = %d, want the limit of %d", count, limit)
+	}
+	if _, ok := store.ReserveSlot(limit); ok {
+		t.Error("ReserveSlot succeeded on a full store")
+	}
+}
+
+func TestRepeatedDestinationReusesLinkWithSameSettings(t *testing.T) {
+	for _, env := range [][]string{{"DEDUPE_URLS", "true"}, {"CODE_STRATEGY", "hash"}} {
+		t.Run(env[0], func(t *testing.T) {
+			srv := newTestServer(t, env...)
+			first := srv.shorten(t, `{"url": "https://example.com/same"}`)
+			if again := srv.shorten(t, `{"url": "https://example.com/same"}`); again.ShortCode != first.ShortCode {
+				t.Errorf("bare repeat got %s, want the existing %s", again.ShortCode, first.ShortCode)
+			}
+
+			for _, body := range []string{
+				`{"url": "https://example.com/same", "max_clicks": 5}`,
+				`{"url": "https://example.com/same", "owner_id": "team-b"}`,
+			} {
+				if other := srv.shorten(t, body); other.ShortCode == first.ShortCode {
+					t.Errorf("%s reused %s, want a new code", body, first.ShortCode)
+				}
+			}
+		})
+	}
+}
+
+func TestCloneCreatesNewLinkWithOverrides(t *testing.T) {
+	for _, strategy := range []string{"random", "hash"} {
+		t.Run(strategy, func(t *testing.T) {
+			srv := newTestServer(t, "CODE_STRATEGY", strategy)
+			source := srv.shorten(t, `{"url": "https://example.com/a", "owner_id": "team-a", "tags": ["docs"]}`)
+			srv.do(t, "GET", "/"+source.ShortCode, "")
+			srv.settleClicks(t)
+
+			resp := srv.do(t, "POST", "/api/urls/"+source.ShortCode+"/clone", `{"owner_id": "team-b"}`)
+			if resp.StatusCode != http.StatusCreated {
+				t.Fatalf("clone: status = %d, want %d", resp.StatusCode, http.StatusCreated)
+			}
+			var clone URLResponse
+			decode(t, resp, &clone)
+			if clone.ShortCode == source.ShortCode {
+				t.Fatalf("clone reused the source code %s", source.ShortCode)
+			}
+			if clone.OriginalURL != source.OriginalURL || clone.OwnerID != "team-b" || !reflect.DeepEqual(clone.Tags, []string{"docs"}) {
+				t.Errorf("clone = %+v, want the source destination and tags with owner team-b", clone)
+			}
+			if clone.AccessCount != 0 {
+				t.Errorf("clone access count = %d, want 0", clone.AccessCount)
+			}
+
+			var history LinkHistoryResponse
+			decode(t, srv.do(t, "GET", "/api/info/"+clone.ShortCode+"/history", ""), &history)
+			if len(history.Events) != 1 || history.Events[0].Detail != "cloned from "+source.ShortCode {
+				t.Errorf("clone history = %+v, want a created event naming the source", history.Events)
+			}
+		})
+	}
+}
+
+func TestCloneOfProtectedLinkNeedsPassword(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN", "secret")
+	source := srv.shorten(t, `{"url": "https://example.com/secret", "password": "hunter2"}`)
+
+	tests := []struct {
+		name, body string
+		headers    []string
+		status     int
+	}{
+		{"no password", "", nil, http.StatusUnauthorized},
+		{"wrong password", "", []string{"X-Link-Password", "nope"}, http.StatusUnauthorized},
+		{"removing the password", `{"password": ""}`, []string{"X-Link-Password", "hunter2"}, http.StatusBadRequest},
+		{"link password", "", []string{"X-Link-Password", "hunter2"}, http.StatusCreated},
+		{"admin token", "", []string{"Authorization", "Bearer secret"}, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		resp := srv.do(t, "POST", "/api/urls/"+source.ShortCode+"/clone", tt.body, tt.headers...)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.StatusCode, tt.status)
+			continue
+		}
+		if resp.StatusCode == http.StatusCreated {
+			var clone URLResponse
+			decode(t, resp, &clone)
+			if !clone.Protected || clone.OriginalURL != "" {
+				t.Errorf("%s: clone = %+v, want it protected with the destination hidden", tt.name, clone)
+			}
+		}
+	}
+}
+
+func TestTemporaryRedirectMaxAge(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    []string
+		status int
+		want   string
+	}{
+		{"temporary, default", nil, http.StatusFound, "no-cache"},
+		{"temporary, configured", []string{"TEMPORARY_REDIRECT_MAX_AGE", "60"}, http.StatusFound, "public, max-age=60, must-revalidate"},
+		{"307, configured", []string{"TEMPORARY_REDIRECT_MAX_AGE", "60"}, http.StatusTemporaryRedirect, "public, max-age=60, must-revalidate"},
+		{"permanent", []string{"TEMPORARY_REDIRECT_MAX_AGE", "60"}, http.StatusMovedPermanently, "public, max-age=86400"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, append([]string{"CACHE_EARLY_EXPIRY_BETA", "0"}, tt.env...)...)
+			link := srv.shorten(t, `{"url": "https://example.com/", "redirect_status": `+strconv.Itoa(tt.status)+`}`)
+			resp := srv.do(t, "GET", "/"+link.ShortCode, "")
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := resp.Header.Get("Cache-Control"); got != tt.want {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCursorPagesAreStableAcrossInserts(t *testing.T) {
+	srv := newTestServer(t)
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	srv.store.SetClock(func() time.Time { return now })
+	var want []string
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Minute)
+		want = append([]string{srv.shorten(t, `{"url": "https://example.com/`+strconv.Itoa(i)+`"}`).ShortCode}, want...)
+	}
+
+	var got []string
+	path := "/api/urls?limit=2"
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("cursor never ran out")
+		}
+		var page URLPageResponse
+		decode(t, srv.do(t, "GET", path, ""), &page)
+		if page.Count != len(page.URLs) {
+			t.Errorf("count = %d, want %d", page.Count, len(page.URLs))
+		}
+		for _, url := range page.URLs {
+			got = append(got, url.ShortCode)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		path = "/api/urls?limit=2&cursor=" + page.NextCursor
+
+		// A newer link sorts before the cursor and must not shift the pages
+		now = now.Add(time.Minute)
+		srv.shorten(t, `{"url": "https://example.com/new`+strconv.Itoa(pages)+`"}`)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("paged codes = %v, want %v newest first", got, want)
+	}
+
+	for _, query := range []string{"limit=0", "limit=501", "cursor=not-a-cursor"} {
+		if resp := srv.do(t, "GET", "/api/urls?"+query, ""); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", query, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestCreatorIPOnlyInAdminListing(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN", "secret", "TRUST_PROXY", "true")
+	resp := srv.do(t, "POST", "/api/shorten", `{"url": "https://example.com/"}`, "X-Forwarded-For", "203.0.113.7")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || strings.Contains(string(body), "created_by_ip") || strings.Contains(string(body), "203.0.113.7") {
+		t.Fatalf("shorten: status %d, body %s; want 200 without the creator IP", resp.StatusCode, body)
+	}
+
+	resp = srv.do(t, "GET", "/api/urls", "")
+	body, _ = io.ReadAll(resp.Body)
+	if strings.Contains(string(body), "203.0.113.7") {
+		t.Errorf("public listing reveals the creator IP: %s", body)
+	}
+
+	var admin []AdminURLResponse
+	decode(t, srv.do(t, "GET", "/api/admin/urls", "", "Authorization", "Bearer secret"), &admin)
+	if len(admin) != 1 || admin[0].CreatedByIP != "203.0.113.7" {
+		t.Errorf("admin listing = %+v, want one link created by 203.0.113.7", admin)
+	}
+	if resp := srv.do(t, "GET", "/api/admin/urls", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("admin listing without the token: status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestEarlyExpiryMaxAge(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     int
+		beta, u float64
+		want    int
+	}{
+		{"disabled", 3600, 0, 0.01, 3600},
+		{"u of 1 keeps the ttl", 3600, 1, 1, 3600},
+		{"jittered", 3600, 1, math.Exp(-1), 3240},
+		{"never below half", 3600, 10, 1e-9, 1800},
+		{"u out of range", 3600, 1, 0, 3600},
+		{"one second ttl", 1, 1, 0.01, 1},
+	}
+	for _, tt := range tests {
+		if got := earlyExpiryMaxAge(tt.ttl, tt.beta, tt.u); got != tt.want {
+			t.Errorf("%s: earlyExpiryMaxAge(%d, %v, %v) = %d, want %d", tt.name, tt.ttl, tt.beta, tt.u, got, tt.want)
+		}
+	}
+}
+
+func TestRedirectMaxAgeIsJitteredWithinBounds(t *testing.T) {
+	srv := newTestServer(t, "CACHE_EARLY_EXPIRY_BETA", "2")
+	link := srv.shorten(t, `{"url": "https://example.com/"}`)
+	for i := 0; i < 50; i++ {
+		cacheControl := srv.do(t, "GET", "/"+link.ShortCode, "").Header.Get("Cache-Control")
+		maxAge, err := strconv.Atoi(strings.TrimPrefix(cacheControl, "public, max-age="))
+		if err != nil || maxAge < 43200 || maxAge > 86400 {
+			t.Fatalf("Cache-Control = %q, want a max-age between half a day and a day", cacheControl)
+		}
+	}
+}
+
+func TestLookupByID(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN", "secret")
+	link := srv.shorten(t, `{"url": "https://example.com/by-id"}`)
+
+	var found URLResponse
+	decode(t, srv.do(t, "GET", "/api/by-id/"+link.ID, ""), &found)
+	if found.ShortCode != link.ShortCode || found.OriginalURL != link.OriginalURL {
+		t.Errorf("by-id = %+v, want %s", found, link.ShortCode)
+	}
+
+	if resp := srv.do(t, "GET", "/api/by-id/missing", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown id: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	srv.do(t, "DELETE", "/api/urls/"+link.ShortCode, "", "Authorization", "Bearer secret")
+	if resp := srv.do(t, "GET", "/api/by-id/"+link.ID, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("deleted link: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestEmptyListingShapes(t *testing.T) {
+	tests := []struct {
+		name, path string
+		env        []string
+		want       string
+	}{
+		{"bare array", "/api/urls", nil, `[]`},
+		{"envelope by query", "/api/urls?envelope=true", nil, `{"urls":[],"count":0,"total":0}`},
+		{"envelope by default", "/api/urls", []string{"URL_LIST_ENVELOPE", "true"}, `{"urls":[],"count":0,"total":0}`},
+		{"envelope turned off", "/api/urls?envelope=false", []string{"URL_LIST_ENVELOPE", "true"}, `[]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, tt.env...)
+			body, _ := io.ReadAll(srv.do(t, "GET", tt.path, "").Body)
+			if got := strings.TrimSpace(string(body)); got != tt.want {
+				t.Errorf("GET %s = %s, want %s", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTopReferrersAcrossLinks(t *testing.T) {
+	srv := newTestServer(t, "TRACK_REFERRERS", "true")
+	first := srv.shorten(t, `{"url": "https://example.com/1"}`)
+	second := srv.shorten(t, `{"url": "https://example.com/2"}`)
+
+	for _, click := range []struct{ code, referer string }{
+		{first.ShortCode, "https://www.News.example/story"},
+		{second.ShortCode, "https://news.example:8443/other"},
+		{second.ShortCode, "https://blog.example/"},
+		{first.ShortCode, ""},
+		{second.ShortCode, "https://news.example/"},
+	} {
+		srv.do(t, "GET", "/"+click.code, "", "Referer", click.referer)
+	}
+	srv.settleClicks(t)
+
+	var resp ReferrersResponse
+	decode(t, srv.do(t, "GET", "/api/analytics/referrers?limit=2", ""), &resp)
+	want := []ReferrerCount{{Host: "news.example", Clicks: 3}, {Host: "blog.example", Clicks: 1}}
+	if !reflect.DeepEqual(resp.Referrers, want) {
+		t.Errorf("referrers = %+v, want %+v", resp.Referrers, want)
+	}
+
+	if resp := srv.do(t, "GET", "/api/analytics/referrers?limit=0", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("limit=0: status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestClicksAreAppliedPerFlushWindow(t *testing.T) {
+	srv := newTestServer(t, "CLICK_FLUSH_INTERVAL", "1h")
+	link := srv.shorten(t, `{"url": "https://example.com/"}`)
+	for i := 0; i < 3; i++ {
+		srv.do(t, "GET", "/"+link.ShortCode, "")
+	}
+
+	if pending := srv.clickRecorder.Pending(); pending != 3 {
+		t.Errorf("Pending() = %d within the window, want 3", pending)
+	}
+	if clicks := srv.store.TotalClicks(); clicks != 0 {
+		t.Errorf("TotalClicks() = %d within the window, want 0", clicks)
+	}
+
+	// Closing flushes what the window still holds
+	srv.clickRecorder.Close()
+	var analytics AnalyticsResponse
+	decode(t, srv.do(t, "GET", "/api/analytics", ""), &analytics)
+	if analytics.TotalClicks != 3 || len(analytics.URLs) != 1 || analytics.URLs[0].AccessCount != 3 {
+		t.Errorf("analytics after the flush = %+v, want 3 clicks on the link", analytics)
+	}
+}
+
+func TestReloadIndexServesNewPage(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "static"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	page := filepath.Join(dir, "static", "index.html")
+	if err := os.WriteFile(page, []byte("<h1>v1</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	srv := newTestServer(t, "ADMIN_TOKEN", "secret")
+	if err := os.WriteFile(page, []byte("<h1>v2</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(srv.do(t, "GET", "/", "").Body); string(body) != "<h1>v1</h1>" {
+		t.Errorf("before reloading: / = %q, want the page read at startup", body)
+	}
+
+	if resp := srv.do(t, "POST", "/api/admin/reload-index", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("reload without the admin token: status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	if resp := srv.do(t, "POST", "/api/admin/reload-index", "", "Authorization", "Bearer secret"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("reload: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if body, _ := io.ReadAll(srv.do(t, "GET", "/", "").Body); string(body) != "<h1>v2</h1>" {
+		t.Errorf("after reloading: / = %q, want the new page", body)
+	}
+
+	// A failed reload keeps serving the current page
+	os.Remove(page)
+	if resp := srv.do(t, "POST", "/api/admin/reload-index", "", "Authorization", "Bearer secret"); resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("reload of a missing file: status = %d, want %d", resp.StatusCode, http.StatusInternalServerError)
+	}
+	if body, _ := io.ReadAll(srv.do(t, "GET", "/", "").Body); string(body) != "<h1>v2</h1>" {
+		t.Errorf("after a failed reload: / = %q, want the last good page", body)
+	}
+}
+
+func TestIndexPageReadsNeverSeePartialUpdates(t *testing.T) {
+	pages := [][]byte{[]byte(strings.Repeat("a", 4096)), []byte(strings.Repeat("b", 8192))}
+	page := newIndexPage("")
+	page.Set(pages[0])
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if html := page.HTML(); string(html) != string(pages[0]) && string(html) != string(pages[1]) {
+					t.Errorf("HTML() returned a page that was never set (%d bytes)", len(html))
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		page.Set(pages[i%2])
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestSignedClicksCarryVerifiableNonce(t *testing.T) {
+	srv := newTestServer(t, "CLICK_NONCE_SECRET", "nonce-secret")
+	link := srv.shorten(t, `{"url": "https://example.com/landing?ref=mail", "sign_clicks": true}`)
+
+	resp := srv.do(t, "GET", "/"+link.ShortCode, "")
+	if got := resp.Header.Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", got)
+	}
+	location, err := neturl.Parse(resp.Header.Get("Location"))
+	if err != nil || location.Query().Get("ref") != "mail" {
+		t.Fatalf("Location = %q, want the destination with its own query", resp.Header.Get("Location"))
+	}
+	signer := NewClickSigner("nonce-secret")
+	nonce := location.Query().Get(ClickNonceParam)
+	if code, ok := signer.Verify(nonce, time.Now(), time.Minute); !ok || code != link.ShortCode {
+		t.Errorf("nonce %q verifies as %q, %v; want %s", nonce, code, ok, link.ShortCode)
+	}
+	if _, ok := NewClickSigner("other-secret").Verify(nonce, time.Now(), time.Minute); ok {
+		t.Error("nonce verifies under another secret")
+	}
+	if _, ok := signer.Verify(nonce, time.Now().Add(time.Hour), time.Minute); ok {
+		t.Error("nonce verifies after maxAge")
+	}
+
+	plain := srv.shorten(t, `{"url": "https://example.com/plain"}`)
+	if location := srv.do(t, "GET", "/"+plain.ShortCode, "").Header.Get("Location"); strings.Contains(location, ClickNonceParam) {
+		t.Errorf("unsigned link redirects to %q, want no nonce", location)
+	}
+}
+
+func TestSignClicksNeedsSecret(t *testing.T) {
+	srv := newTestServer(t)
+	resp := srv.do(t, "POST", "/api/shorten", `{"url": "https://example.com/", "sign_clicks": true}`)
+	var body ErrorResponse
+	decode(t, resp, &body)
+	if resp.StatusCode != http.StatusBadRequest || len(body.Error.Fields) != 1 || body.Error.Fields[0].Field != "sign_clicks" {
+		t.Errorf("status = %d, error = %+v; want 400 on sign_clicks", resp.StatusCode, body.Error)
+	}
+}
+
+func TestDuplicateSlashesInPaths(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    []string
+		status int
+	}{
+		{"collapsed by default", nil, http.StatusMovedPermanently},
+		{"left alone when disabled", []string{"NORMALIZE_SLASHES", "false"}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, tt.env...)
+			link := srv.shorten(t, `{"url": "https://example.com/"}`)
+			resp := srv.do(t, "GET", "//"+link.ShortCode, "")
+			if resp.StatusCode != tt.status {
+				t.Errorf("GET //%s: status = %d, want %d", link.ShortCode, resp.StatusCode, tt.status)
+			}
+		})
+	}
+
+	srv := newTestServer(t)
+	if resp := srv.do(t, "GET", "/api//urls", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /api//urls: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestRouteListIsSortedAndComplete(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN", "secret")
+	if resp := srv.do(t, "GET", "/api/admin/routes", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without the admin token: status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	var routes []RouteInfo
+	decode(t, srv.do(t, "GET", "/api/admin/routes", "", "Authorization", "Bearer secret"), &routes)
+	for _, want := range []RouteInfo{
+		{Method: "GET", Path: "/:shortCode"},
+		{Method: "POST", Path: "/api/shorten"},
+		{Method: "GET", Path: "/api/admin/routes"},
+	} {
+		found := false
+		for _, route := range routes {
+			found = found || route == want
+		}
+		if !found {
+			t.Errorf("routes are missing %s %s", want.Method, want.Path)
+		}
+	}
+	if !sort.SliceIsSorted(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		return routes[i].Method < routes[j].Method
+	}) {
+		t.Error("routes are not sorted by path, then method")
+	}
+}
+
+func TestPermanentRedirect308(t *testing.T) {
+	srv := newTestServer(t, "CACHE_EARLY_EXPIRY_BETA", "0")
+	link := srv.shorten(t, `{"url": "https://example.com/", "redirect_status": 308}`)
+	if link.RedirectStatus != http.StatusPermanentRedirect {
+		t.Errorf("redirect_status = %d, want 308", link.RedirectStatus)
+	}
+
+	resp := srv.do(t, "GET", "/"+link.ShortCode, "")
+	if resp.StatusCode != http.StatusPermanentRedirect || resp.Header.Get("Location") != "https://example.com/" {
+		t.Errorf("status = %d, Location = %q; want 308 to the destination", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if got := resp.Header.Get("Cache-Control"); got != "public, max-age=86400" {
+		t.Errorf("Cache-Control = %q, want it cached like a 301", got)
+	}
+
+	for _, status := range []string{"200", "303", "399"} {
+		if resp := srv.do(t, "POST", "/api/shorten", `{"url": "https://example.com/", "redirect_status": `+status+`}`); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("redirect_status %s: status = %d, want %d", status, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+// gzipString compresses s for request bodies sent with Content-Encoding: gzip
+func gzipString(t *testing.T, s string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestImportLimitsDecompressedBody(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN", "secret", "MAX_DECODED_BODY_SIZE", "1024")
+
+	// Compresses to a few dozen bytes, well under the wire limit
+	bomb := gzipString(t, "["+strings.Repeat(" ", 64*1024)+"]")
+	resp := srv.do(t, "POST", "/api/admin/import", bomb, "Authorization", "Bearer secret", "Content-Encoding", "gzip")
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: status = %d, want %d", resp.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+
+	body := gzipString(t, `[{"short_code": "imp001", "original_url": "https://example.com/"}]`)
+	resp = srv.do(t, "POST", "/api/admin/import", body, "Authorization", "Bearer secret", "Content-Encoding", "gzip")
+	var imported ImportResponse
+	decode(t, resp, &imported)
+	if resp.StatusCode != http.StatusOK || imported.Imported != 1 {
+		t.Errorf("body within the limit: status = %d, imported = %d; want 200 with 1 imported", resp.StatusCode, imported.Imported)
+	}
+
+	if resp := srv.do(t, "POST", "/api/admin/import", "[]", "Authorization", "Bearer secret", "Content-Encoding", "compress"); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("unknown encoding: status = %d, want %d", resp.StatusCode, http.StatusUnsupportedMediaType)
+	}
+}
+
+func TestBatchShortenLimitsDecompressedBody(t *testing.T) {
+	srv := newTestServer(t, "MAX_DECODED_BODY_SIZE", "1024")
+
+	bomb := gzipString(t, `["https://example.com/"`+strings.Repeat(" ", 64*1024)+`]`)
+	if resp := srv.do(t, "POST", "/api/shorten/batch", bomb, "Content-Encoding", "gzip"); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: status = %d, want %d", resp.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+	if srv.store.Count() != 0 {
+		t.Errorf("oversized body stored %d links", srv.store.Count())
+	}
+
+	var results []URLResponse
+	decode(t, srv.do(t, "POST", "/api/shorten/batch", gzipString(t, `["https://example.com/"]`), "Content-Encoding", "gzip"), &results)
+	if len(results) != 1 || results[0].OriginalURL != "https://example.com/" {
+		t.Errorf("body within the limit: results = %+v, want the one link", results)
+	}
+}
+
+func TestAdminBatchRoutesLimitDecompressedBody(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN", "secret", "MAX_DECODED_BODY_SIZE", "1024")
+
+	bomb := gzipString(t, `{"short_codes": [`+strings.Repeat(" ", 64*1024)+`]}`)
+	for _, path := range []string{"/api/urls/expire", "/api/admin/warm"} {
+		resp := srv.do(t, "POST", path, bomb, "Authorization", "Bearer secret", "Content-Encoding", "gzip")
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("POST %s with an oversized body: status = %d, want %d", path, resp.StatusCode, http.StatusRequestEntityTooLarge)
+		}
+	}
+}
+
+func TestExpiringListsLinksInWindowSoonestFirst(t *testing.T) {
+	srv := newTestServer(t)
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	srv.store.SetClock(func() time.Time { return now })
+
+	twoHours := srv.shorten(t, `{"url": "https://example.com/2h", "expires_in": 7200}`)
+	oneHour := srv.shorten(t, `{"url": "https://example.com/1h", "expires_in": 3600}`)
+	srv.shorten(t, `{"url": "https://example.com/3d", "expires_in": 259200}`)
+	srv.shorten(t, `{"url": "https://example.com/forever"}`)
+	srv.shorten(t, `{"url": "https://example.com/gone", "expires_in": 60}`)
+	now = now.Add(2 * time.Minute)
+
+	resp := srv.do(t, "GET", "/api/urls/expiring?within=24h", "")
+	var expiring []URLResponse
+	decode(t, resp, &expiring)
+	var codes []string
+	for _, url := range expiring {
+		codes = append(codes, url.ShortCode)
+	}
+	if want := []string{oneHour.ShortCode, twoHours.ShortCode}; !reflect.DeepEqual(codes, want) {
+		t.Errorf("expiring within 24h = %v, want %v", codes, want)
+	}
+
+	resp = srv.do(t, "GET", "/api/urls/expiring?within=7d", "")
+	decode(t, resp, &expiring)
+	if len(expiring) != 3 {
+		t.Errorf("expiring within 7d: got %d links, want 3", len(expiring))
+	}
+
+	if resp := srv.do(t, "GET", "/api/urls/expiring?within=soon", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid within: status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestPreviewBotsCountedSeparately(t *testing.T) {
+	const slackbot = "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)"
+	const browser = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/120.0 Safari/537.36"
+
+	tests := []struct {
+		name                string
+		env                 []string
+		wantClicks, wantHit int64
+	}{
+		{"excluded", []string{"EXCLUDE_PREVIEW_BOTS", "true"}, 1, 2},
+		{"custom list", []string{"EXCLUDE_PREVIEW_BOTS", "true", "PREVIEW_BOT_USER_AGENTS", "chrome"}, 1, 2},
+		{"disabled", nil, 3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, tt.env...)
+			link := srv.shorten(t, `{"url": "https://example.com/"}`)
+
+			// With the custom list the browser is the crawler and Slackbot a reader
+			for _, ua := range []string{slackbot, browser} {
+				if resp := srv.do(t, "GET", "/"+link.ShortCode, "", "User-Agent", ua); resp.StatusCode != http.StatusMovedPermanently {
+					t.Fatalf("GET with %q: status = %d, want a redirect", ua, resp.StatusCode)
+				}
+			}
+			if resp := srv.do(t, "HEAD", "/"+link.ShortCode, "", "User-Agent", browser); resp.StatusCode != http.StatusMovedPermanently {
+				t.Fatalf("HEAD: status = %d, want a redirect", resp.StatusCode)
+			}
+			srv.settleClicks(t)
+
+			var info URLResponse
+			decode(t, srv.do(t, "GET", "/api/by-id/"+link.ID, ""), &info)
+			if info.AccessCount != tt.wantClicks || info.PreviewHits != tt.wantHit {
+				t.Errorf("access_count = %d, preview_hits = %d; want %d and %d", info.AccessCount, info.PreviewHits, tt.wantClicks, tt.wantHit)
+			}
+		})
+	}
+}
+
+func TestChecksumDetectsTypos(t *testing.T) {
+	srv := newTestServer(t, "SHORT_CODE_CHECKSUM", "true")
+	link := srv.shorten(t, `{"url": "https://example.com/"}`)
+	if len(link.ShortCode) != defaultCodeLength+1 {
+		t.Fatalf("short code %q should be one character longer than %d", link.ShortCode, defaultCodeLength)
+	}
+	if !hasValidChecksum(link.ShortCode, shortCodeAlphabet) {
+		t.Fatalf("short code %q doesn't end in its check character", link.ShortCode)
+	}
+
+	if resp := srv.do(t, "GET", "/"+link.ShortCode, ""); resp.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("correct code: status = %d, want %d", resp.StatusCode, http.StatusMovedPermanently)
+	}
+
+	// Substitute the first character with its neighbour in the alphabet
+	typo := []byte(link.ShortCode)
+	typo[0] = shortCodeAlphabet[(strings.IndexByte(shortCodeAlphabet, typo[0])+1)%len(shortCodeAlphabet)]
+	resp := srv.do(t, "GET", "/"+string(typo), "")
+	var body struct {
+		Error      string   `json:"error"`
+		DidYouMean []string `json:"did_you_mean"`
+	}
+	decode(t, resp, &body)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("mistyped code: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	if !reflect.DeepEqual(body.DidYouMean, []string{link.ShortCode}) {
+		t.Errorf("did_you_mean = %v, want [%s]", body.DidYouMean, link.ShortCode)
+	}
+}
+
+func TestQRMetadataSkipsUnknownCodes(t *testing.T) {
+	srv := newTestServer(t, "BASE_URL", "https://sho.rt")
+	first := srv.shorten(t, `{"url": "https://example.com/1"}`)
+	second := srv.shorten(t, `{"url": "https://example.com/2"}`)
+
+	resp := srv.do(t, "POST", "/api/qr/metadata", `{"short_codes": ["`+second.ShortCode+`", "missing", "`+first.ShortCode+`"]}`)
+	var metadata []QRMetadata
+	decode(t, resp, &metadata)
+	want := []QRMetadata{
+		{ShortCode: second.ShortCode, ShortURL: "https://sho.rt/" + second.ShortCode},
+		{ShortCode: first.ShortCode, ShortURL: "https://sho.rt/" + first.ShortCode},
+	}
+	if !reflect.DeepEqual(metadata, want) {
+		t.Errorf("metadata = %+v, want %+v", metadata, want)
+	}
+
+	resp = srv.do(t, "POST", "/api/qr/metadata", `{"short_codes": ["missing"]}`)
+	body, _ := io.ReadAll(resp.Body)
+	if strings.TrimSpace(string(body)) != "[]" {
+		t.Errorf("only unknown codes: body = %s, want []", body)
+	}
+
+	bomb := gzipString(t, `{"short_codes": [`+strings.Repeat(" ", maxQRMetadataBodySize)+`]}`)
+	if resp := srv.do(t, "POST", "/api/qr/metadata", bomb, "Content-Encoding", "gzip"); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: status = %d, want %d", resp.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestReadinessFailsWhileDraining(t *testing.T) {
+	srv := newTestServer(t, "SHUTDOWN_DRAIN_DELAY", "500ms")
+	if resp := srv.do(t, "GET", "/ready", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("before shutdown: /ready status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		srv.drain()
+		close(drained)
+	}()
+	for !srv.draining.Load() {
+		time.Sleep(time.Millisecond)
+	}
+
+	if resp := srv.do(t, "GET", "/ready", ""); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("draining: /ready status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if resp := srv.do(t, "GET", "/health", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("draining: /health status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	select {
+	case <-drained:
+		t.Error("drain returned before the drain delay was over")
+	default:
+	}
+	<-drained
+}
+
+func TestValidateBatchReportsEachURL(t *testing.T) {
+	srv := newTestServer(t, "BLOCK_PRIVATE_HOSTS", "true")
+
+	// IP literals, so the private address check needs no DNS
+	urls := []string{"not a url", "ftp://93.184.216.34/file", "http://127.0.0.1/admin", "https://93.184.216.34/"}
+	body, _ := json.Marshal(ValidateURLsRequest{URLs: urls})
+	resp := srv.do(t, "POST", "/api/validate", string(body))
+	var validated ValidateURLsResponse
+	decode(t, resp, &validated)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if validated.Valid != 1 || validated.Invalid != 3 || len(validated.Results) != len(urls) {
+		t.Fatalf("valid = %d, invalid = %d with %d results; want 1, 3 and %d", validated.Valid, validated.Invalid, len(validated.Results), len(urls))
+	}
+	for i, result := range validated.Results {
+		if result.URL != urls[i] {
+			t.Errorf("result %d is for %q, want %q", i, result.URL, urls[i])
+		}
+		if result.Valid != (i == 3) || result.Valid != (result.Reason == "") {
+			t.Errorf("result %d: valid = %v, reason = %q", i, result.Valid, result.Reason)
+		}
+	}
+	if !strings.Contains(validated.Results[2].Reason, "private") {
+		t.Errorf("loopback reason = %q, want it to mention private addresses", validated.Results[2].Reason)
+	}
+	if srv.store.Count() != 0 {
+		t.Errorf("validating stored %d links", srv.store.Count())
+	}
+
+	body, _ = json.Marshal(ValidateURLsRequest{URLs: make([]string, maxBatchSize+1)})
+	if resp := srv.do(t, "POST", "/api/validate", string(body)); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized batch: status = %d, want %d", resp.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+	bomb := gzipString(t, `{"urls": [`+strings.Repeat(" ", maxValidateBodySize)+`]}`)
+	if resp := srv.do(t, "POST", "/api/validate", bomb, "Content-Encoding", "gzip"); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: status = %d, want %d", resp.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestServerHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		env  []string
+		want []string
+	}{
+		{"default", nil, []string{"Fiber"}},
+		{"custom", []string{"SERVER_HEADER", "edge"}, []string{"edge"}},
+		{"omitted", []string{"SERVER_HEADER", ""}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, tt.env...)
+			resp := srv.do(t, "GET", "/health", "")
+			if got := resp.Header.Values("Server"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Server headers = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCampaignTimeseriesSumsMembers(t *testing.T) {
+	srv := newTestServer(t, "TIMEZONE", "UTC")
+	now := time.Date(2026, 6, 10, 12, 0, 0, 0, time.UTC)
+	srv.store.SetClock(func() time.Time { return now })
+	first := srv.shorten(t, `{"url": "https://example.com/a", "campaign": "spring"}`)
+	second := srv.shorten(t, `{"url": "https://example.com/b", "campaign": "spring"}`)
+	other := srv.shorten(t, `{"url": "https://example.com/c", "campaign": "autumn"}`)
+
+	clicks := []struct {
+		day  int
+		code string
+	}{
+		{8, first.ShortCode}, {8, second.ShortCode}, {8, other.ShortCode},
+		{10, first.ShortCode}, {10, first.ShortCode}, {10, second.ShortCode},
+		{1, first.ShortCode}, // Outside the window
+	}
+	for _, click := range clicks {
+		now = time.Date(2026, 6, click.day, 12, 0, 0, 0, time.UTC)
+		srv.do(t, "GET", "/"+click.code, "")
+	}
+	srv.settleClicks(t)
+	now = time.Date(2026, 6, 10, 18, 0, 0, 0, time.UTC)
+
+	var series CampaignTimeseriesResponse
+	decode(t, srv.do(t, "GET", "/api/campaigns/spring/timeseries?days=3", ""), &series)
+	want := CampaignTimeseriesResponse{
+		Campaign: "spring",
+		Links:    2,
+		Total:    5,
+		Series: []DailyClickCount{
+			{Date: "2026-06-08", Clicks: 2},
+			{Date: "2026-06-09", Clicks: 0},
+			{Date: "2026-06-10", Clicks: 3},
+		},
+	}
+	if !reflect.DeepEqual(series, want) {
+		t.Errorf("timeseries = %+v, want %+v", series, want)
+	}
+
+	if resp := srv.do(t, "GET", "/api/campaigns/winter/timeseries", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown campaign: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestEmptyStoreAnalyticsShapes(t *testing.T) {
+	srv := newTestServer(t)
+	tests := []struct{ path, want string }{
+		{"/api/analytics", `{"total_urls":0,"total_clicks":0,"urls":[]}`},
+		{"/api/analytics/referrers", `{"referrers":[]}`},
+		{"/api/analytics/slow-destinations", `{"destinations":[]}`},
+		{"/api/urls/expiring", `[]`},
+	}
+	for _, tt := range tests {
+		body, _ := io.ReadAll(srv.do(t, "GET", tt.path, "").Body)
+		if got := strings.TrimSpace(string(body)); got != tt.want {
+			t.Errorf("GET %s = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestForwardQueryMergesIncomingParameters(t *testing.T) {
+	srv := newTestServer(t)
+	forwarding := srv.shorten(t, `{"url": "https://example.com/page?lang=en&ref=site", "forward_query": true}`)
+	plain := srv.shorten(t, `{"url": "https://example.com/plain?lang=en"}`)
+
+	tests := []struct {
+		name, path, want string
+	}{
+		{"forwarded and merged", "/" + forwarding.ShortCode + "?lang=de&utm_source=mail", "https://example.com/page?lang=de&ref=site&utm_source=mail"},
+		{"no query", "/" + forwarding.ShortCode, "https://example.com/page?lang=en&ref=site"},
+		{"not forwarding", "/" + plain.ShortCode + "?lang=de", "https://example.com/plain?lang=en"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := srv.do(t, "GET", tt.path, "")
+			if got := resp.Header.Get("Location"); got != tt.want {
+				t.Errorf("Location = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExportSQLiteDownloadsEveryLink(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN", "secret")
+	first := srv.shorten(t, `{"url": "https://example.com/1"}`)
+	second := srv.shorten(t, `{"url": "https://example.com/2", "campaign": "spring"}`)
+
+	if resp := srv.do(t, "GET", "/api/export.sqlite", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without a token: status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	resp := srv.do(t, "GET", "/api/export.sqlite", "", "Authorization", "Bearer secret")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/vnd.sqlite3" {
+		t.Fatalf("status = %d, Content-Type = %q; want 200 and application/vnd.sqlite3", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "urls.sqlite")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("opening the export: %v", err)
+	}
+	defer db.Close()
+	urls, err := db.LoadAll()
+	if err != nil {
+		t.Fatalf("LoadAll: %v", err)
+	}
+	got := make(map[string]*URL, len(urls))
+	for _, url := range urls {
+		got[url.ShortCode] = url
+	}
+	if len(got) != 2 || got[first.ShortCode] == nil || got[second.ShortCode] == nil {
+		t.Fatalf("exported codes = %v, want %s and %s", got, first.ShortCode, second.ShortCode)
+	}
+	if url := got[second.ShortCode]; url.OriginalURL != "https://example.com/2" || url.Campaign != "spring" {
+		t.Errorf("exported link = %+v, want the stored destination and campaign", url)
+	}
+}
+
+func TestTagLimits(t *testing.T) {
+	srv := newTestServer(t, "MAX_TAGS_PER_LINK", "2", "MAX_TAG_LENGTH", "5")
+	link := srv.shorten(t, `{"url": "https://example.com/", "tags": ["news", "promo"]}`)
+	if !reflect.DeepEqual(link.Tags, []string{"news", "promo"}) {
+		t.Errorf("tags = %v, want [news promo]", link.Tags)
+	}
+
+	tests := []struct {
+		name, path, body string
+	}{
+		{"too many", "/api/shorten", `{"url": "https://example.com/", "tags": ["a", "b", "c"]}`},
+		{"too long", "/api/shorten", `{"url": "https://example.com/", "tags": ["longer"]}`},
+		{"empty", "/api/shorten", `{"url": "https://example.com/", "tags": [""]}`},
+		{"clone with too many", "/api/urls/" + link.ShortCode + "/clone", `{"tags": ["a", "b", "c"]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp := srv.do(t, "POST", tt.path, tt.body); resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestClicksSinceCountsWholeMinutes(t *testing.T) {
+	srv := newTestServer(t)
+	now := time.Date(2026, 6, 1, 10, 0, 0, 0, time.UTC)
+	srv.store.SetClock(func() time.Time { return now })
+	link := srv.shorten(t, `{"url": "https://example.com/"}`)
+
+	for _, at := range []string{"10:00:30", "10:05:10", "10:10:00", "10:20:00"} {
+		clock, _ := time.Parse("15:04:05", at)
+		now = time.Date(2026, 6, 1, clock.Hour(), clock.Minute(), clock.Second(), 0, time.UTC)
+		srv.do(t, "GET", "/"+link.ShortCode, "")
+	}
+	srv.settleClicks(t)
+	now = time.Date(2026, 6, 1, 11, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		ts   string
+		want int64
+	}{
+		{"2026-06-01T09:00:00Z", 4},
+		{"2026-06-01T10:05:00Z", 3},
+		{"2026-06-01T10:05:30Z", 2}, // Mid-minute, so 10:05 is left out
+		{"2026-06-01T12:10:00+02:00", 2},
+		{"2026-06-01T10:30:00Z", 0},
+	}
+	for _, tt := range tests {
+		var since ClicksSinceResponse
+		decode(t, srv.do(t, "GET", "/api/info/"+link.ShortCode+"/clicks/since?ts="+neturl.QueryEscape(tt.ts), ""), &since)
+		if since.Clicks != tt.want {
+			t.Errorf("clicks since %s = %d, want %d", tt.ts, since.Clicks, tt.want)
+		}
+	}
+
+	for _, path := range []string{
+		"/api/info/" + link.ShortCode + "/clicks/since?ts=yesterday",
+		"/api/info/" + link.ShortCode + "/clicks/since?ts=2026-05-01T10:00:00Z",
+	} {
+		if resp := srv.do(t, "GET", path, ""); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET %s: status = %d, want %d", path, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+	if resp := srv.do(t, "GET", "/api/info/missing/clicks/since?ts=2026-06-01T10:00:00Z", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown code: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestClicksSinceReportsStoredCode(t *testing.T) {
+	srv := newTestServer(t, "CASE_INSENSITIVE_CODES", "true")
+	link := srv.shorten(t, `{"url": "https://example.com/"}`)
+
+	var since ClicksSinceResponse
+	ts := neturl.QueryEscape(time.Now().Add(-time.Hour).Format(time.RFC3339))
+	decode(t, srv.do(t, "GET", "/api/info/"+strings.ToUpper(link.ShortCode)+"/clicks/since?ts="+ts, ""), &since)
+	if since.ShortCode != link.ShortCode {
+		t.Errorf("short code = %q, want the stored %q", since.ShortCode, link.ShortCode)
+	}
+}
+
+func TestJSONModeReturnsDestination(t *testing.T) {
+	srv := newTestServer(t)
+	link := srv.shorten(t, `{"url": "https://example.com/app"}`)
+
+	tests := []struct {
+		name, path string
+		headers    []string
+	}{
+		{"Accept header", "/" + link.ShortCode, []string{"Accept", "application/json"}},
+		{"mode query", "/" + link.ShortCode + "?mode=json", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := srv.do(t, "GET", tt.path, "", tt.headers...)
+			var target RedirectTargetResponse
+			decode(t, resp, &target)
+			if resp.StatusCode != http.StatusOK || resp.Header.Get("Location") != "" {
+				t.Errorf("status = %d, Location = %q; want 200 without a redirect", resp.StatusCode, resp.Header.Get("Location"))
+			}
+			if want := (RedirectTargetResponse{OriginalURL: "https://example.com/app", ShortCode: link.ShortCode}); target != want {
+				t.Errorf("body = %+v, want %+v", target, want)
+			}
+		})
+	}
+
+	// Browsers list HTML first and still get the redirect
+	resp := srv.do(t, "GET", "/"+link.ShortCode, "", "Accept", "text/html,application/xhtml+xml,application/json;q=0.9,*/*;q=0.8")
+	if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "https://example.com/app" {
+		t.Errorf("browser: status = %d, Location = %q; want a redirect", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	srv.settleClicks(t)
+	var info URLResponse
+	decode(t, srv.do(t, "GET", "/api/by-id/"+link.ID, ""), &info)
+	if info.AccessCount != 3 {
+		t.Errorf("access_count = %d, want 3 (JSON mode still counts)", info.AccessCount)
+	}
+}
+
+func TestBulkExpirySetsExtendsAndClears(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN", "secret")
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	srv.store.SetClock(func() time.Time { return now })
+	first := srv.shorten(t, `{"url": "https://example.com/1"}`)
+	second := srv.shorten(t, `{"url": "https://example.com/2", "expires_in": 60}`)
+	codes := `["` + first.ShortCode + `", "` + second.ShortCode + `", "missing"]`
+
+	expire := func(body string) []ExpireURLResult {
+		t.Helper()
+		resp := srv.do(t, "POST", "/api/urls/expire", body, "Authorization", "Bearer secret")
+		var out struct {
+			Results []ExpireURLResult `json:"results"`
+		}
+		decode(t, resp, &out)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("POST /api/urls/expire %s: status %d", body, resp.StatusCode)
+		}
+		return out.Results
+	}
+	expiresAt := func(code string) *time.Time {
+		t.Helper()
+		url, _ := srv.store.Get(code)
+		return url.ExpiresAt
+	}
+
+	// Set on a link without expiry and extend the one expiring in a minute
+	results := expire(`{"short_codes": ` + codes + `, "ttl_seconds": 3600}`)
+	want := now.Add(time.Hour)
+	if len(results) != 3 || !results[0].Updated || !results[1].Updated || results[2].Updated || results[2].Error == "" {
+		t.Fatalf("results = %+v, want two updates and an error for the unknown code", results)
+	}
+	for _, code := range []string{first.ShortCode, second.ShortCode} {
+		if got := expiresAt(code); got == nil || !got.Equal(want) {
+			t.Errorf("%s expires at %v, want %v", code, got, want)
+		}
+	}
+
+	absolute := now.Add(48 * time.Hour)
+	expire(`{"short_codes": ` + codes + `, "expires_at": "` + absolute.Format(time.RFC3339) + `"}`)
+	if got := expiresAt(second.ShortCode); got == nil || !got.Equal(absolute) {
+		t.Errorf("after expires_at: %v, want %v", got, absolute)
+	}
+
+	expire(`{"short_codes": ` + codes + `, "ttl_seconds": 0}`)
+	for _, code := range []string{first.ShortCode, second.ShortCode} {
+		if got := expiresAt(code); got != nil {
+			t.Errorf("%s still expires at %v after clearing", code, got)
+		}
+	}
+
+	for _, body := range []string{
+		`{"short_codes": ` + codes + `}`,
+		`{"short_codes": ` + codes + `, "ttl_seconds": 60, "expires_at": "` + absolute.Format(time.RFC3339) + `"}`,
+		`{"short_codes": ` + codes + `, "expires_at": "2020-01-01T00:00:00Z"}`,
+		`{"short_codes": [], "ttl_seconds": 60}`,
+	} {
+		if resp := srv.do(t, "POST", "/api/urls/expire", body, "Authorization", "Bearer secret"); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("POST %s: status = %d, want %d", body, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestCreationsPerDayUseConfiguredTimezone(t *testing.T) {
+	srv := newTestServer(t, "TIMEZONE", "Asia/Tokyo")
+	var now time.Time
+	srv.store.SetClock(func() time.Time { return now })
+
+	// Tokyo is UTC+9: 16:00 UTC on the 8th is already the 9th there
+	for _, at := range []string{"2026-06-08T10:00:00Z", "2026-06-08T16:00:00Z", "2026-06-09T01:00:00Z", "2026-06-10T02:00:00Z", "2026-05-01T00:00:00Z"} {
+		now, _ = time.Parse(time.RFC3339, at)
+		srv.shorten(t, `{"url": "https://example.com/"}`)
+	}
+	now = time.Date(2026, 6, 10, 3, 0, 0, 0, time.UTC)
+
+	var creations CreationsResponse
+	decode(t, srv.do(t, "GET", "/api/analytics/creations?days=4", ""), &creations)
+	want := CreationsResponse{
+		Timezone: "Asia/Tokyo",
+		Total:    4,
+		Series: []DailyCreationCount{
+			{Date: "2026-06-07", Links: 0},
+			{Date: "2026-06-08", Links: 1},
+			{Date: "2026-06-09", Links: 2},
+			{Date: "2026-06-10", Links: 1},
+		},
+	}
+	if !reflect.DeepEqual(creations, want) {
+		t.Errorf("creations = %+v, want %+v", creations, want)
+	}
+
+	if resp := srv.do(t, "GET", "/api/analytics/creations?days=0", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("days=0: status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestAccessLogWritesToFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	srv := newTestServer(t, "ACCESS_LOG_FILE", path)
+	link := srv.shorten(t, `{"url": "https://example.com/"}`)
+	srv.do(t, "GET", "/"+link.ShortCode, "")
+	srv.do(t, "GET", "/health", "") // Probes aren't logged
+	if err := srv.accessLog.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading the access log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("access log has %d lines, want 2:\n%s", len(lines), data)
+	}
+	for i, want := range []string{"POST | /api/shorten", "GET | /" + link.ShortCode} {
+		if !strings.Contains(lines[i], want) {
+			t.Errorf("line %d = %q, want it to contain %q", i+1, lines[i], want)
+		}
+	}
+}
+
+func TestHistoryRecordsLifecycleInOrder(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN", "secret")
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	srv.store.SetClock(func() time.Time { return now })
+	link := srv.shorten(t, `{"url": "https://example.com/old"}`)
+	admin := []string{"Authorization", "Bearer secret"}
+
+	steps := []struct{ method, path, body string }{
+		{"PUT", "/api/urls/" + link.ShortCode, `{"url": "https://example.com/new"}`},
+		{"DELETE", "/api/urls/" + link.ShortCode, ""},
+		{"POST", "/api/urls/" + link.ShortCode + "/restore", ""},
+		{"POST", "/api/urls/expire", `{"short_codes": ["` + link.ShortCode + `"], "ttl_seconds": 60}`},
+	}
+	for _, step := range steps {
+		now = now.Add(time.Second)
+		if resp := srv.do(t, step.method, step.path, step.body, admin...); resp.StatusCode >= 300 {
+			t.Fatalf("%s %s: status %d", step.method, step.path, resp.StatusCode)
+		}
+	}
+	now = now.Add(2 * time.Minute)
+
+	var history LinkHistoryResponse
+	decode(t, srv.do(t, "GET", "/api/info/"+link.ShortCode+"/history", ""), &history)
+	var types []string
+	for i, event := range history.Events {
+		types = append(types, event.Type)
+		if i > 0 && event.At.Before(history.Events[i-1].At) {
+			t.Errorf("event %d (%s) at %v is before the previous one", i, event.Type, event.At)
+		}
+	}
+	want := []string{eventCreated, eventUpdated, eventDeleted, eventRestored, eventUpdated, eventExpired}
+	if !reflect.DeepEqual(types, want) {
+		t.Errorf("history = %v, want %v", types, want)
+	}
+
+	// The oldest events make room for new ones past the cap
+	url, _ := srv.store.Get(link.ShortCode)
+	for i := 0; i < maxLinkHistory; i++ {
+		url.RecordEvent(eventUpdated, now, strconv.Itoa(i))
+	}
+	events := url.LifecycleHistory()
+	if len(events) != maxLinkHistory || events[0].Detail != "0" || events[len(events)-1].Detail != strconv.Itoa(maxLinkHistory-1) {
+		t.Errorf("after %d more events: %d kept from %q to %q", maxLinkHistory, len(events), events[0].Detail, events[len(events)-1].Detail)
+	}
+}
+
+func TestDefaultRedirectStatus(t *testing.T) {
+	srv := newTestServer(t, "DEFAULT_REDIRECT_STATUS", "302")
+	plain := srv.shorten(t, `{"url": "https://example.com/"}`)
+	permanent := srv.shorten(t, `{"url": "https://example.com/", "redirect_status": 301}`)
+
+	if plain.RedirectStatus != http.StatusFound {
+		t.Errorf("redirect_status of a link without one = %d, want %d", plain.RedirectStatus, http.StatusFound)
+	}
+	tests := []struct {
+		code string
+		want int
+	}{
+		{plain.ShortCode, http.StatusFound},
+		{permanent.ShortCode, http.StatusMovedPermanently},
+	}
+	for _, tt := range tests {
+		if resp := srv.do(t, "GET", "/"+tt.code, ""); resp.StatusCode != tt.want {
+			t.Errorf("GET /%s: status = %d, want %d", tt.code, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestQRPNGRangeRequests(t *testing.T) {
+	srv := newTestServer(t)
+	link := srv.shorten(t, `{"url": "https://example.com/"}`)
+	path := "/api/qr/" + link.ShortCode + ".png?size=400"
+
+	resp := srv.do(t, "GET", path, "")
+	full, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("full request: status = %d, Accept-Ranges = %q; want 200 and bytes", resp.StatusCode, resp.Header.Get("Accept-Ranges"))
+	}
+	img, err := png.Decode(bytes.NewReader(full))
+	if err != nil {
+		t.Fatalf("decoding the PNG: %v", err)
+	}
+	if bounds := img.Bounds(); bounds.Dx() != 400 || bounds.Dy() != 400 {
+		t.Errorf("image is %dx%d, want 400x400", bounds.Dx(), bounds.Dy())
+	}
+
+	tests := []struct {
+		rangeHeader, contentRange string
+		want                      []byte
+	}{
+		{"bytes=0-7", fmt.Sprintf("bytes 0-7/%d", len(full)), full[:8]},
+		{"bytes=-4", fmt.Sprintf("bytes %d-%d/%d", len(full)-4, len(full)-1, len(full)), full[len(full)-4:]},
+		{fmt.Sprintf("bytes=%d-", len(full)-10), fmt.Sprintf("bytes %d-%d/%d", len(full)-10, len(full)-1, len(full)), full[len(full)-10:]},
+	}
+	for _, tt := range tests {
+		resp := srv.do(t, "GET", path, "", "Range", tt.rangeHeader)
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Range") != tt.contentRange || !bytes.Equal(body, tt.want) {
+			t.Errorf("Range %s: status = %d, Content-Range = %q, %d bytes; want 206, %q and %d bytes",
+				tt.rangeHeader, resp.StatusCode, resp.Header.Get("Content-Range"), len(body), tt.contentRange, len(tt.want))
+		}
+	}
+
+	resp = srv.do(t, "GET", path, "", "Range", fmt.Sprintf("bytes=%d-", len(full)))
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get("Content-Range") != fmt.Sprintf("bytes */%d", len(full)) {
+		t.Errorf("range past the end: status = %d, Content-Range = %q; want 416", resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+
+	for _, size := range []string{"10", "5000"} {
+		if resp := srv.do(t, "GET", "/api/qr/"+link.ShortCode+".png?size="+size, ""); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("size=%s: status = %d, want %d", size, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestStoreGrowthRatesAndProjection(t *testing.T) {
+	srv := newTestServer(t, "MAX_URLS", "100")
+	now := time.Date(2026, 6, 10, 12, 0, 0, 0, time.UTC)
+	var clock time.Time
+	srv.store.SetClock(func() time.Time { return clock })
+
+	for _, age := range []time.Duration{30 * time.Minute, 5 * time.Hour, 20 * time.Hour, 3 * 24 * time.Hour, 4 * 24 * time.Hour, 6 * 24 * time.Hour, 10 * 24 * time.Hour} {
+		clock = now.Add(-age)
+		srv.shorten(t, `{"url": "https://example.com/"}`)
+	}
+	clock = now
+
+	var growth StoreGrowthResponse
+	decode(t, srv.do(t, "GET", "/api/store/growth", ""), &growth)
+	if growth.Total != 7 || growth.LastHour != 1 || growth.LastDay != 3 || growth.LastWeek != 6 {
+		t.Errorf("total = %d, last hour/day/week = %d/%d/%d; want 7, 1/3/6", growth.Total, growth.LastHour, growth.LastDay, growth.LastWeek)
+	}
+	perHour := 6.0 / (7 * 24)
+	if math.Abs(growth.PerHour-perHour) > 1e-9 {
+		t.Errorf("per_hour = %v, want %v", growth.PerHour, perHour)
+	}
+	if growth.MaxURLs != 100 || growth.Remaining == nil || *growth.Remaining != 93 {
+		t.Fatalf("max_urls = %d, remaining = %v; want 100 and 93", growth.MaxURLs, growth.Remaining)
+	}
+	// 93 links at 6 a week take 15.5 weeks
+	wantSeconds := int64(93.0 / 6 * 7 * 24 * 3600)
+	if growth.ProjectedSecondsToLimit == nil || math.Abs(float64(*growth.ProjectedSecondsToLimit-wantSeconds)) > 1 {
+		t.Fatalf("projected_seconds_to_limit = %v, want about %d", growth.ProjectedSecondsToLimit, wantSeconds)
+	}
+	if want := now.Add(time.Duration(*growth.ProjectedSecondsToLimit) * time.Second); growth.ProjectedFullAt == nil || !growth.ProjectedFullAt.Equal(want) {
+		t.Errorf("projected_full_at = %v, want %v", growth.ProjectedFullAt, want)
+	}
+
+	// No links in the last week, so no projection
+	clock = now.Add(30 * 24 * time.Hour)
+	growth = StoreGrowthResponse{}
+	decode(t, srv.do(t, "GET", "/api/store/growth", ""), &growth)
+	if growth.LastWeek != 0 || growth.ProjectedFullAt != nil || growth.Remaining == nil {
+		t.Errorf("without recent growth: %+v, want remaining capacity but no projection", growth)
+	}
+}
+
+func TestStoreGrowthCountsUnloadedLinks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.db")
+	database, err := OpenSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("OpenSQLiteStore: %v", err)
+	}
+	deletedAt := time.Now()
+	deleted := &URL{ID: "id-3", ShortCode: "gone01", OriginalURL: "https://example.com/3", CreatedAt: time.Now(), DeletedAt: &deletedAt}
+	err = database.Save([]*URL{
+		{ID: "id-1", ShortCode: "keep01", OriginalURL: "https://example.com/1", CreatedAt: time.Now()},
+		{ID: "id-2", ShortCode: "keep02", OriginalURL: "https://example.com/2", CreatedAt: time.Now()},
+		deleted,
+	})
+	if err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	database.Close()
+
+	srv := newTestServer(t, "DATABASE_PATH", path, "DATABASE_PRELOAD", "false", "MAX_URLS", "3")
+	t.Cleanup(func() { srv.store.ClosePersistence() })
+
+	var growth StoreGrowthResponse
+	decode(t, srv.do(t, "GET", "/api/store/growth", ""), &growth)
+	if growth.Total != 2 || growth.Remaining == nil || *growth.Remaining != 1 {
+		t.Errorf("total = %d, remaining = %v; want the 2 live stored links and 1 left", growth.Total, growth.Remaining)
+	}
+	srv.shorten(t, `{"url": "https://example.com/new"}`)
+	if resp := srv.do(t, "POST", "/api/shorten", `{"url": "https://example.com/full"}`); resp.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("over MAX_URLS: status = %d, want %d", resp.StatusCode, http.StatusInsufficientStorage)
+	}
+}
+
+func TestRepointValidatesNewDestination(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN", "secret", "BLOCKLIST", "spam.example")
+	link := srv.shorten(t, `{"url": "https://example.com/old"}`)
+	admin := []string{"Authorization", "Bearer secret"}
+
+	for _, body := range []string{
+		`{"url": "javascript:alert(1)"}`,
+		`{"url": "https://spam.example/offer"}`,
+		`{"url": ""}`,
+	} {
+		if resp := srv.do(t, "PUT", "/api/urls/"+link.ShortCode, body, admin...); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("PUT %s: status = %d, want %d", body, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+	if resp := srv.do(t, "GET", "/"+link.ShortCode, ""); resp.Header.Get("Location") != "https://example.com/old" {
+		t.Fatalf("after rejected updates: Location = %q, want the old destination", resp.Header.Get("Location"))
+	}
+
+	if resp := srv.do(t, "PUT", "/api/urls/"+link.ShortCode, `{"url": "https://example.com/new"}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without a token: status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	resp := srv.do(t, "PUT", "/api/urls/"+link.ShortCode, `{"url": "https://EXAMPLE.com/new"}`, admin...)
+	var updated URLResponse
+	decode(t, resp, &updated)
+	if resp.StatusCode != http.StatusOK || updated.OriginalURL != "https://example.com/new" {
+		t.Fatalf("PUT: status = %d, original_url = %q; want 200 and the normalized destination", resp.StatusCode, updated.OriginalURL)
+	}
+	if resp := srv.do(t, "GET", "/"+link.ShortCode, ""); resp.Header.Get("Location") != "https://example.com/new" {
+		t.Errorf("after the update: Location = %q, want the new destination", resp.Header.Get("Location"))
+	}
+	if resp := srv.do(t, "PUT", "/api/urls/missing", `{"url": "https://example.com/"}`, admin...); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown code: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestListingsNegotiateMessagePack(t *testing.T) {
+	srv := newTestServer(t)
+	link := srv.shorten(t, `{"url": "https://example.com/", "tags": ["news"]}`)
+
+	resp := srv.do(t, "GET", "/api/urls", "", "Accept", "application/msgpack")
+	if resp.Header.Get("Content-Type") != "application/msgpack" || !strings.Contains(resp.Header.Get("Vary"), "Accept") {
+		t.Fatalf("Content-Type = %q, Vary = %q; want application/msgpack varying on Accept", resp.Header.Get("Content-Type"), resp.Header.Get("Vary"))
+	}
+	// Decoded by field name, so keys must match the JSON ones
+	var urls []map[string]interface{}
+	if err := msgpack.NewDecoder(resp.Body).Decode(&urls); err != nil {
+		t.Fatalf("decoding MessagePack: %v", err)
+	}
+	if len(urls) != 1 || urls[0]["short_code"] != link.ShortCode || urls[0]["original_url"] != "https://example.com/" {
+		t.Errorf("urls = %v, want the link under its JSON keys", urls)
+	}
+	if created, ok := urls[0]["created_at"].(time.Time); !ok || !created.Equal(link.CreatedAt) {
+		t.Errorf("created_at = %#v, want a timestamp equal to %v", urls[0]["created_at"], link.CreatedAt)
+	}
+
+	resp = srv.do(t, "GET", "/api/analytics", "", "Accept", "application/msgpack")
+	var analytics struct {
+		TotalURLs int64 `msgpack:"total_urls"`
+	}
+	if err := msgpack.NewDecoder(resp.Body).Decode(&analytics); err != nil || analytics.TotalURLs != 1 {
+		t.Errorf("analytics: total_urls = %d, err = %v; want 1", analytics.TotalURLs, err)
+	}
+
+	for _, accept := range []string{"", "application/json", "text/html"} {
+		resp := srv.do(t, "GET", "/api/urls", "", "Accept", accept)
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+			t.Errorf("Accept %q: Content-Type = %q, want JSON", accept, resp.Header.Get("Content-Type"))
+		}
+	}
+}
+
+func TestUnusedListsNeverClickedOldLinks(t *testing.T) {
+	srv := newTestServer(t)
+	now := time.Date(2026, 6, 10, 12, 0, 0, 0, time.UTC)
+	var clock time.Time
+	srv.store.SetClock(func() time.Time { return clock })
+
+	create := func(age time.Duration) URLResponse {
+		clock = now.Add(-age)
+		return srv.shorten(t, `{"url": "https://example.com/"}`)
+	}
+	oldest := create(30 * 24 * time.Hour)
+	old := create(10 * 24 * time.Hour)
+	clicked := create(20 * 24 * time.Hour)
+	create(2 * 24 * time.Hour) // Too recent
+	clock = now
+	srv.do(t, "GET", "/"+clicked.ShortCode, "")
+	srv.settleClicks(t)
+
+	var page URLPageResponse
+	decode(t, srv.do(t, "GET", "/api/urls/unused?older_than=7d&limit=1", ""), &page)
+	if page.Total != 2 || len(page.URLs) != 1 || page.URLs[0].ShortCode != old.ShortCode || page.NextCursor == "" {
+		t.Fatalf("first page = %+v, want %s of 2 with a next cursor", page, old.ShortCode)
+	}
+	cursor := page.NextCursor
+	page = URLPageResponse{}
+	decode(t, srv.do(t, "GET", "/api/urls/unused?older_than=7d&limit=1&cursor="+neturl.QueryEscape(cursor), ""), &page)
+	if len(page.URLs) != 1 || page.URLs[0].ShortCode != oldest.ShortCode || page.NextCursor != "" {
+		t.Errorf("second page = %+v, want only %s", page, oldest.ShortCode)
+	}
+
+	decode(t, srv.do(t, "GET", "/api/urls/unused", ""), &page)
+	if page.Total != 2 {
+		t.Errorf("default older_than of 7d: total = %d, want 2", page.Total)
+	}
+	if resp := srv.do(t, "GET", "/api/urls/unused?older_than=soon", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid older_than: status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestQRSVGScalesWithModuleSize(t *testing.T) {
+	srv := newTestServer(t)
+	link := srv.shorten(t, `{"url": "https://example.com/print"}`)
+	path := "/api/info/" + link.ShortCode + "/qr.svg"
+
+	width := func(query string) int {
+		t.Helper()
+		resp := srv.do(t, "GET", path+query, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s%s: status = %d, want %d", path, query, resp.StatusCode, http.StatusOK)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "image/svg+xml" {
+			t.Errorf("GET %s%s: Content-Type = %q, want image/svg+xml", path, query, ct)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_, rest, found := strings.Cut(string(body), `<svg xmlns="http://www.w3.org/2000/svg" width="`)
+		if !found {
+			t.Fatalf("GET %s%s: no svg element in %q", path, query, body)
+		}
+		w, err := strconv.Atoi(rest[:strings.IndexByte(rest, '"')])
+		if err != nil {
+			t.Fatalf("GET %s%s: width: %v", path, query, err)
+		}
+		return w
+	}
+
+	modules := width("?module_size=1")
+	if got := width("?module_size=4"); got != 4*modules {
+		t.Errorf("module_size=4: width = %d, want %d", got, 4*modules)
+	}
+	if got := width(""); got != defaultQRModuleSize*modules {
+		t.Errorf("default module size: width = %d, want %d", got, defaultQRModuleSize*modules)
+	}
+	for _, size := range []string{"0", "101"} {
+		if resp := srv.do(t, "GET", path+"?module_size="+size, ""); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("module_size=%s: status = %d, want %d", size, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestShortenVerifiesDestination(t *testing.T) {
+	srv := newTestServer(t)
+	// The public client refuses loopback addresses, the test servers need a plain one
+	srv.linkChecker.client = &http.Client{Timeout: time.Second}
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ok" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer destination.Close()
+
+	resp := srv.do(t, "POST", "/api/shorten?verify=true", `{"url": "`+destination.URL+`/ok"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("reachable destination: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	resp = srv.do(t, "POST", "/api/shorten?verify=true", `{"url": "`+destination.URL+`/missing"}`)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("destination answering 404: status = %d, want %d", resp.StatusCode, http.StatusUnprocessableEntity)
+	}
+	if count := srv.store.Count(); count != 1 {
+		t.Errorf("store holds %d links, want only the verified one", count)
+	}
+
+	// Without verify the destination isn't probed
+	if resp := srv.do(t, "POST", "/api/shorten", `{"url": "`+destination.URL+`/missing"}`); resp.StatusCode != http.StatusOK {
+		t.Errorf("unverified create: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestReindexRepairsCorruptedIndexes(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN", "secret")
+	now := time.Date(2026, 6, 10, 12, 0, 0, 0, time.UTC)
+	srv.store.SetClock(func() time.Time { return now })
+	link := srv.shorten(t, `{"url": "https://example.com/a", "owner_id": "team-a"}`)
+	now = now.Add(time.Second)
+	expiring := srv.shorten(t, `{"url": "https://example.com/b", "owner_id": "team-a", "expires_in": 60}`)
+
+	// Drop the link's ID and owner entries, and point its destination elsewhere
+	srv.store.byID.Delete(link.ID)
+	srv.store.urlByOriginal.Store("https://example.com/a", expiring.ShortCode)
+	srv.store.ownerMu.Lock()
+	delete(srv.store.byOwner["team-a"], link.ShortCode)
+	srv.store.ownerMu.Unlock()
+	if resp := srv.do(t, "GET", "/api/by-id/"+link.ID, ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("by-id before reindex: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	var counts IndexCounts
+	resp := srv.do(t, "POST", "/api/admin/reindex", "", "Authorization", "Bearer secret")
+	decode(t, resp, &counts)
+	if counts.URLs != 2 || counts.IDs != 2 || counts.Destinations != 2 || counts.Owners != 1 || counts.Repaired != 3 {
+		t.Errorf("reindex = %+v, want 2 URLs, IDs and destinations, 1 owner and 3 repairs", counts)
+	}
+	if resp := srv.do(t, "GET", "/api/by-id/"+link.ID, ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("by-id after reindex: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if code, _ := srv.store.urlByOriginal.Load("https://example.com/a"); code != link.ShortCode {
+		t.Errorf("destination index points to %v, want %s", code, link.ShortCode)
+	}
+	want := []string{expiring.ShortCode, link.ShortCode}
+	if got := srv.listCodes(t, "/api/urls?owner_id=team-a"); !reflect.DeepEqual(got, want) {
+		t.Errorf("owner listing after reindex = %v, want %v", got, want)
+	}
+
+	// Expired links drop out of the owner listing like every other listing
+	now = now.Add(2 * time.Minute)
+	if got := srv.listCodes(t, "/api/urls?owner_id=team-a"); !reflect.DeepEqual(got, []string{link.ShortCode}) {
+		t.Errorf("owner listing after expiry = %v, want only %s", got, link.ShortCode)
+	}
+}
+
+func TestListingIsOnlyPagedOnRequest(t *testing.T) {
+	srv := newTestServer(t)
+	const links = defaultPageLimit + 5
+	for i := 0; i < links; i++ {
+		srv.shorten(t, fmt.Sprintf(`{"url": "https://example.com/%d"}`, i))
+	}
+
+	if got := srv.listCodes(t, "/api/urls"); len(got) != links {
+		t.Errorf("bare listing returned %d links, want all %d", len(got), links)
+	}
+	var page URLPageResponse
+	decode(t, srv.do(t, "GET", "/api/urls?envelope=true", ""), &page)
+	if page.Count != links || page.Total != links || page.NextCursor != "" {
+		t.Errorf("envelope = %d of %d (next %q), want all %d and no cursor", page.Count, page.Total, page.NextCursor, links)
+	}
+	page = URLPageResponse{}
+	decode(t, srv.do(t, "GET", "/api/urls?limit="+strconv.Itoa(defaultPageLimit), ""), &page)
+	if page.Count != defaultPageLimit || page.Total != links || page.NextCursor == "" {
+		t.Errorf("page = %d of %d (next %q), want %d with a next cursor", page.Count, page.Total, page.NextCursor, defaultPageLimit)
+	}
+}
+
+func TestHTMLModeRedirectsWithMetaRefresh(t *testing.T) {
+	srv := newTestServer(t)
+	link := srv.shorten(t, `{"url": "https://example.com/newsletter"}`)
+
+	resp := srv.do(t, "GET", "/"+link.ShortCode+"?mode=html", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Content-Type = %q, want text/html", ct)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	for _, want := range []string{
+		`<meta http-equiv="refresh" content="0; url=https://example.com/newsletter">`,
+		`<a href="https://example.com/newsletter">`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("page doesn't contain %s:\n%s", want, body)
+		}
+	}
+
+	srv.settleClicks(t)
+	if url, _ := srv.store.Get(link.ShortCode); url.AccessCount != 1 {
+		t.Errorf("AccessCount = %d, want the HTML redirect counted", url.AccessCount)
+	}
+}
+
+func TestAliasLengthIsSeparateFromCodeLength(t *testing.T) {
+	srv := newTestServer(t, "CODE_LENGTH", "4", "MAX_ALIAS_LENGTH", "12")
+
+	for _, tc := range []struct {
+		alias string
+		want  int
+	}{
+		{"spring-sale", http.StatusOK},           // Longer than generated codes
+		{"spring-sale2", http.StatusOK},          // Exactly the alias limit
+		{"spring-sale-2", http.StatusBadRequest}, // One over it
+	} {
+		resp := srv.do(t, "POST", "/api/shorten", `{"url": "https://example.com/", "custom_code": "`+tc.alias+`"}`)
+		if resp.StatusCode != tc.want {
+			t.Errorf("alias %q: status = %d, want %d", tc.alias, resp.StatusCode, tc.want)
+		}
+	}
+
+	// Generated codes keep their own length
+	if link := srv.shorten(t, `{"url": "https://example.com/generated"}`); len(link.ShortCode) != 4 {
+		t.Errorf("generated code %q, want 4 characters", link.ShortCode)
+	}
+}
+
+func TestURLQRRouteServesBothFormats(t *testing.T) {
+	srv := newTestServer(t)
+	link := srv.shorten(t, `{"url": "https://example.com/poster"}`)
+	path := "/api/urls/" + link.ShortCode + "/qr"
+
+	resp := srv.do(t, "GET", path+"?size=128", "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" {
+		t.Fatalf("PNG: status = %d, Content-Type = %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	img, err := png.Decode(resp.Body)
+	if err != nil {
+		t.Fatalf("decoding PNG: %v", err)
+	}
+	if width := img.Bounds().Dx(); width != 128 {
+		t.Errorf("PNG width = %d, want 128", width)
+	}
+	resp = srv.do(t, "GET", path, "", "Range", "bytes=0-7")
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Errorf("PNG range: status = %d, want %d", resp.StatusCode, http.StatusPartialContent)
+	}
+
+	resp = srv.do(t, "GET", path+"?format=svg&module_size=2", "")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/svg+xml" {
+		t.Fatalf("SVG: status = %d, Content-Type = %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	svg := srv.do(t, "GET", "/api/info/"+link.ShortCode+"/qr.svg?module_size=2", "")
+	if want, _ := io.ReadAll(svg.Body); string(body) != string(want) {
+		t.Errorf("SVG differs from the qr.svg route")
+	}
+
+	for _, query := range []string{"?format=gif", "?size=10", "?format=svg&module_size=0"} {
+		if resp := srv.do(t, "GET", path+query, ""); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", query, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+	if resp := srv.do(t, "GET", "/api/urls/missing/qr", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown code: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestAPIKeysGuardTheWholeAPI(t *testing.T) {
+	srv := newTestServer(t, "API_KEYS", "key-1,key-2", "ADMIN_TOKEN", "secret")
+	var link URLResponse
+	decode(t, srv.do(t, "POST", "/api/shorten", `{"url": "https://example.com/"}`, "X-API-Key", "key-2"), &link)
+
+	// Routes added after the original groups are covered without opting in
+	for _, path := range []string{
+		"/api/urls",
+		"/api/analytics",
+		"/api/analytics.ndjson",
+		"/api/clicks",
+		"/api/by-id/" + link.ID,
+		"/api/store/growth",
+	} {
+		if resp := srv.do(t, "GET", path, ""); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("GET %s without a key: status = %d, want %d", path, resp.StatusCode, http.StatusUnauthorized)
+		}
+		if resp := srv.do(t, "GET", path, "", "X-API-Key", "wrong"); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("GET %s with a wrong key: status = %d, want %d", path, resp.StatusCode, http.StatusUnauthorized)
+		}
+		if resp := srv.do(t, "GET", path, "", "X-API-Key", "key-1"); resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s with a key: status = %d, want %d", path, resp.StatusCode, http.StatusOK)
+		}
+	}
+
+	// Redirects and the public API paths need no key
+	for _, path := range []string{
+		"/" + link.ShortCode,
+		"/api/info/" + link.ShortCode + "/qr.svg",
+		"/api/qr/" + link.ShortCode + ".png",
+	} {
+		if resp := srv.do(t, "GET", path, ""); resp.StatusCode >= 400 {
+			t.Errorf("GET %s without a key: status = %d, want it served", path, resp.StatusCode)
+		}
+	}
+	if resp := srv.do(t, "GET", "/api/admin/jobs", "", "Authorization", "Bearer secret"); resp.StatusCode != http.StatusOK {
+		t.Errorf("admin route with only the admin token: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestDeleteNeedsOnlyAnAPIKey(t *testing.T) {
+	srv := newTestServer(t, "API_KEYS", "key-1", "ADMIN_TOKEN", "secret")
+	var link URLResponse
+	decode(t, srv.do(t, "POST", "/api/shorten", `{"url": "https://example.com/"}`, "X-API-Key", "key-1"), &link)
+
+	if resp := srv.do(t, "DELETE", "/api/urls/"+link.ShortCode, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without a key: status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	if resp := srv.do(t, "DELETE", "/api/urls/"+link.ShortCode, "", "X-API-Key", "key-1"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("with a key: status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	if resp := srv.do(t, "DELETE", "/api/urls/"+link.ShortCode, "", "X-API-Key", "key-1"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("already deleted: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestClickCountsMapLeavesOutProtectedLinks(t *testing.T) {
+	srv := newTestServer(t)
+	popular := srv.shorten(t, `{"url": "https://example.com/popular"}`)
+	quiet := srv.shorten(t, `{"url": "https://example.com/quiet"}`)
+	secret := srv.shorten(t, `{"url": "https://example.com/secret", "password": "hunter2"}`)
+	for i := 0; i < 3; i++ {
+		srv.do(t, "GET", "/"+popular.ShortCode, "")
+		srv.do(t, "GET", "/"+secret.ShortCode, "", "X-Link-Password", "hunter2")
+	}
+	srv.settleClicks(t)
+
+	var counts map[string]int64
+	decode(t, srv.do(t, "GET", "/api/clicks", ""), &counts)
+	if want := map[string]int64{popular.ShortCode: 3, quiet.ShortCode: 0}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("clicks = %v, want %v", counts, want)
+	}
+	counts = nil
+	decode(t, srv.do(t, "GET", "/api/clicks?min_clicks=1", ""), &counts)
+	if want := map[string]int64{popular.ShortCode: 3}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("clicks with min_clicks=1 = %v, want %v", counts, want)
+	}
+	if resp := srv.do(t, "GET", "/api/clicks?min_clicks=-1", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("negative min_clicks: status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestFaviconIsNotLookedUpAsShortCode(t *testing.T) {
+	srv := newTestServer(t)
+	persister := newFakePersister()
+	if err := srv.store.LoadLazily(persister); err != nil {
+		t.Fatalf("LoadLazily: %v", err)
+	}
+
+	if resp := srv.do(t, "GET", "/favicon.ico", ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("without an icon: status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	if reads := persister.Reads(); reads != 0 {
+		t.Errorf("/favicon.ico reached the store %d times, want none", reads)
+	}
+	srv.do(t, "GET", "/nosuch", "")
+	if reads := persister.Reads(); reads != 1 {
+		t.Errorf("an unknown code reached the store %d times, want 1", reads)
+	}
+
+	icon := filepath.Join(t.TempDir(), "favicon.ico")
+	if err := os.WriteFile(icon, []byte("icon"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srv = newTestServer(t, "FAVICON_FILE", icon)
+	resp := srv.do(t, "GET", "/favicon.ico", "")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "icon" {
+		t.Errorf("with FAVICON_FILE: status = %d, body = %q; want the icon", resp.StatusCode, body)
+	}
+}
+
+func TestListingFiltersByDestinationDomain(t *testing.T) {
+	srv := newTestServer(t)
+	now := time.Date(2026, 6, 10, 12, 0, 0, 0, time.UTC)
+	srv.store.SetClock(func() time.Time { return now })
+	create := func(body string) string {
+		now = now.Add(time.Second)
+		return srv.shorten(t, body).ShortCode
+	}
+	plain := create(`{"url": "https://example.com/a"}`)
+	www := create(`{"url": "https://WWW.Example.COM:443/b", "owner_id": "team-a"}`)
+	docs := create(`{"url": "https://docs.example.com/c"}`)
+	create(`{"url": "https://example.org/d"}`)
+	create(`{"url": "https://example.com/secret", "password": "hunter2"}`)
+
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"domain=example.com", []string{www, plain}},
+		{"domain=www.EXAMPLE.com", []string{www, plain}},
+		{"domain=docs.example.com", []string{docs}},
+		{"domain=example.net", []string{}},
+		{"domain=example.com&owner_id=team-a", []string{www}},
+	} {
+		if got := srv.listCodes(t, "/api/urls?"+tc.query); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.query, got, tc.want)
+		}
+	}
+
+	// Composes with pagination
+	var page URLPageResponse
+	decode(t, srv.do(t, "GET", "/api/urls?domain=example.com&limit=1", ""), &page)
+	if page.Total != 2 || len(page.URLs) != 1 || page.URLs[0].ShortCode != www || page.NextCursor == "" {
+		t.Errorf("first page = %+v, want %s of 2 with a next cursor", page, www)
+	}
+}
+
+func TestBaseURLHeaderOnlyFromTrustedSources(t *testing.T) {
+	shortURL := func(srv *server, headers ...string) (int, string) {
+		t.Helper()
+		resp := srv.do(t, "POST", "/api/shorten", `{"url": "https://example.com/"}`, headers...)
+		var link URLResponse
+		if resp.StatusCode == http.StatusOK {
+			decode(t, resp, &link)
+		}
+		return resp.StatusCode, strings.TrimSuffix(link.ShortURL, "/"+link.ShortCode)
+	}
+
+	srv := newTestServer(t, "BASE_URL", "https://sho.rt", "API_KEYS", "key-1")
+	if status, base := shortURL(srv, "X-API-Key", "key-1", "X-Base-URL", "https://brand.example/"); status != http.StatusOK || base != "https://brand.example" {
+		t.Errorf("with an API key: %d %q, want the header's base", status, base)
+	}
+	if status, base := shortURL(srv, "X-API-Key", "key-1"); status != http.StatusOK || base != "https://sho.rt" {
+		t.Errorf("without the header: %d %q, want BASE_URL", status, base)
+	}
+	if status, _ := shortURL(srv, "X-API-Key", "key-1", "X-Base-URL", "https://brand.example/?q=1"); status != http.StatusBadRequest {
+		t.Errorf("invalid header: status = %d, want %d", status, http.StatusBadRequest)
+	}
+
+	// Test requests come from 0.0.0.0
+	srv = newTestServer(t, "API_KEYS", "", "TRUSTED_PROXIES", "0.0.0.0")
+	if status, base := shortURL(srv, "X-Base-URL", "https://brand.example"); status != http.StatusOK || base != "https://brand.example" {
+		t.Errorf("via a trusted proxy: %d %q, want the header's base", status, base)
+	}
+	srv = newTestServer(t, "TRUSTED_PROXIES", "10.0.0.1")
+	if status, base := shortURL(srv, "X-Base-URL", "https://brand.example"); status != http.StatusOK || base != "https://sho.rt" {
+		t.Errorf("from an untrusted client: %d %q, want BASE_URL", status, base)
+	}
+}
+
+func TestSimulatePredictsRedirectWithoutCounting(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN", "secret")
+	now := time.Date(2026, 6, 10, 12, 0, 0, 0, time.UTC)
+	srv.store.SetClock(func() time.Time { return now })
+	link := srv.shorten(t, `{"url": "https://example.com/default", "ios_url": "https://apps.apple.com/app/id1", "expires_in": 3600, "query_rules": [
+		{"param": "lang", "value": "de", "destination": "https://example.de/"}
+	]}`)
+	path := "/api/info/" + link.ShortCode + "/simulate"
+
+	tests := []struct {
+		name, body                     string
+		status                         int
+		outcome, platform, destination string
+	}{
+		{"defaults", ``, http.StatusMovedPermanently, "redirect", "web", "https://example.com/default"},
+		{"iOS", `{"user_agent": "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)"}`, http.StatusMovedPermanently, "redirect", "ios", "https://apps.apple.com/app/id1"},
+		{"query rule", `{"query": "?lang=de&utm_source=mail"}`, http.StatusMovedPermanently, "redirect", "web", "https://example.de/?utm_source=mail"},
+		{"after expiry", `{"at": "2026-06-10T14:00:00Z"}`, http.StatusGone, "expired", "web", ""},
+	}
+	for _, tt := range tests {
+		var got SimulateRedirectResponse
+		resp := srv.do(t, "POST", path, tt.body, "Authorization", "Bearer secret")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status = %d, want %d", tt.name, resp.StatusCode, http.StatusOK)
+		}
+		decode(t, resp, &got)
+		if got.Status != tt.status || got.Outcome != tt.outcome || got.Platform != tt.platform || got.Destination != tt.destination {
+			t.Errorf("%s: %+v, want %d %s on %s to %q", tt.name, got, tt.status, tt.outcome, tt.platform, tt.destination)
+		}
+	}
+
+	// Inputs that don't affect the redirect are refused, not ignored
+	resp := srv.do(t, "POST", path, `{"country": "DE"}`, "Authorization", "Bearer secret")
+	var body map[string]string
+	decode(t, resp, &body)
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(body["error"], "country") {
+		t.Errorf("country: status = %d, body = %v; want a 400 naming the field", resp.StatusCode, body)
+	}
+	if resp := srv.do(t, "POST", path, ``); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without the admin token: status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	srv.settleClicks(t)
+	if url, _ := srv.store.Get(link.ShortCode); url.AccessCount != 0 {
+		t.Errorf("AccessCount = %d, simulations must not count", url.AccessCount)
+	}
+}
+
+func TestValidationErrorsNameFieldAndReason(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN", "secret")
+	link := srv.shorten(t, `{"url": "https://example.com/"}`)
+	missingScheme := []FieldError{{Field: "url", Reason: "missing scheme"}}
+	invalidAlias := []FieldError{{Field: "custom_code", Reason: "invalid alias"}}
+
+	for _, tc := range []struct {
+		name, method, path, body string
+		want                     []FieldError
+	}{
+		{"shorten without scheme", "POST", "/api/shorten", `{"url": "example.com/path"}`, missingScheme},
+		{"shorten with invalid alias", "POST", "/api/shorten", `{"url": "https://example.com/", "custom_code": "no spaces"}`, invalidAlias},
+		{"update without scheme", "PUT", "/api/urls/" + link.ShortCode, `{"url": "example.com/path"}`, missingScheme},
+	} {
+		resp := srv.do(t, tc.method, tc.path, tc.body, "Authorization", "Bearer secret")
+		var body ErrorResponse
+		decode(t, resp, &body)
+		if resp.StatusCode != http.StatusBadRequest || body.Error.Code != "VALIDATION" || !reflect.DeepEqual(body.Error.Fields, tc.want) {
+			t.Errorf("%s: %d %+v, want 400 VALIDATION with %+v", tc.name, resp.StatusCode, body.Error, tc.want)
+		}
+	}
+
+	// Batch and import report the same shape per item
+	var batch []struct {
+		Index int         `json:"index"`
+		Error ErrorDetail `json:"error"`
+	}
+	decode(t, srv.do(t, "POST", "/api/shorten/batch", `["example.com/path", {"url": "https://example.com/", "custom_code": "a!"}]`), &batch)
+	if len(batch) != 2 || !reflect.DeepEqual(batch[0].Error.Fields, missingScheme) || !reflect.DeepEqual(batch[1].Error.Fields, invalidAlias) {
+		t.Errorf("batch = %+v, want a missing scheme then an invalid alias", batch)
+	}
+	var imported struct {
+		Errors []struct {
+			Error ErrorDetail `json:"error"`
+		} `json:"errors"`
+	}
+	decode(t, srv.do(t, "POST", "/api/admin/import", `[{"short_code": "abc123", "original_url": "example.com/x"}]`, "Authorization", "Bearer secret"), &imported)
+	if want := []FieldError{{Field: "original_url", Reason: "missing scheme"}}; len(imported.Errors) != 1 || imported.Errors[0].Error.Code != "VALIDATION" || !reflect.DeepEqual(imported.Errors[0].Error.Fields, want) {
+		t.Errorf("import errors = %+v, want %+v", imported.Errors, want)
+	}
+}
+
+func TestBaseURLIsReadOnceAtStartup(t *testing.T) {
+	srv := newTestServer(t, "BASE_URL", "https://sho.rt/")
+	link := srv.shorten(t, `{"url": "https://example.com/"}`)
+	if want := "https://sho.rt/" + link.ShortCode; link.ShortURL != want {
+		t.Errorf("short_url = %q, want %q", link.ShortURL, want)
+	}
+
+	// Handlers keep the configured base even if the environment changes later
+	t.Setenv("BASE_URL", "https://changed.example")
+	var urls []URLResponse
+	decode(t, srv.do(t, "GET", "/api/urls", ""), &urls)
+	if len(urls) != 1 || urls[0].ShortURL != link.ShortURL {
+		t.Errorf("listing = %+v, want %s", urls, link.ShortURL)
+	}
+}
+
+func TestShortenFailsWhenNoFreeCodeIsDrawn(t *testing.T) {
+	srv := newTestServer(t)
+	taken := srv.shorten(t, `{"url": "https://example.com/first"}`)
+	srv.store.SetCodeGenerator(func(alphabet string, size int) (string, error) {
+		return taken.ShortCode, nil
+	})
+
+	resp := srv.do(t, "POST", "/api/shorten", `{"url": "https://example.com/second"}`)
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusInternalServerError)
+	}
+	if url, _ := srv.store.Get(taken.ShortCode); url.OriginalURL != "https://example.com/first" {
+		t.Errorf("%s now points to %q, want the original link kept", taken.ShortCode, url.OriginalURL)
+	}
+}
+
+func TestAnalyticsNDJSONStreamsOneLinePerLink(t *testing.T) {
+	srv := newTestServer(t)
+	var codes []string
+	for i, clicks := range []int{2, 0, 3, 1} {
+		link := srv.shorten(t, fmt.Sprintf(`{"url": "https://example.com/%d"}`, i))
+		codes = append(codes, link.ShortCode)
+		for j := 0; j < clicks; j++ {
+			srv.do(t, "GET", "/"+link.ShortCode, "")
+		}
+	}
+	srv.settleClicks(t)
+
+	read := func(query string) []AnalyticsRecord {
+		t.Helper()
+		resp := srv.do(t, "GET", "/api/analytics.ndjson"+query, "")
+		if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Errorf("Content-Type = %q, want application/x-ndjson", ct)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+		records := make([]AnalyticsRecord, len(lines))
+		for i, line := range lines {
+			if err := json.Unmarshal([]byte(line), &records[i]); err != nil {
+				t.Fatalf("line %d %q: %v", i+1, line, err)
+			}
+		}
+		return records
+	}
+
+	records := read("")
+	if len(records) != len(codes) {
+		t.Fatalf("%d lines, want one per link (%d)", len(records), len(codes))
+	}
+	var clicks []int64
+	for _, record := range records {
+		clicks = append(clicks, record.AccessCount)
+	}
+	if want := []int64{3, 2, 1, 0}; !reflect.DeepEqual(clicks, want) {
+		t.Errorf("clicks in order = %v, want %v", clicks, want)
+	}
+
+	sort.Strings(codes)
+	var byCode []string
+	for _, record := range read("?sort=code") {
+		byCode = append(byCode, record.ShortCode)
+	}
+	if !reflect.DeepEqual(byCode, codes) {
+		t.Errorf("sort=code = %v, want %v", byCode, codes)
+	}
+	if resp := srv.do(t, "GET", "/api/analytics.ndjson?sort=size", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown sort: status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestConnectionSettingsAreApplied(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN", "secret")
+	var config ServerConfigResponse
+	decode(t, srv.do(t, "GET", "/api/admin/config", "", "Authorization", "Bearer secret"), &config)
+	if !config.KeepAlive || config.IdleTimeout != "10s" || config.MaxConnsPerIP != 0 {
+		t.Errorf("defaults = %+v, want keep-alive on, a 10s idle timeout and no per-IP cap", config)
+	}
+
+	srv = newTestServer(t, "KEEP_ALIVE", "false", "IDLE_TIMEOUT", "45s", "MAX_CONNS_PER_IP", "20")
+	if fiberConfig := srv.app.Config(); !fiberConfig.DisableKeepalive || fiberConfig.IdleTimeout != 45*time.Second {
+		t.Errorf("fiber config: DisableKeepalive = %v, IdleTimeout = %s; want true and 45s", fiberConfig.DisableKeepalive, fiberConfig.IdleTimeout)
+	}
+	if conns := srv.app.Server().MaxConnsPerIP; conns != 20 {
+		t.Errorf("MaxConnsPerIP = %d, want 20", conns)
+	}
+	config = ServerConfigResponse{}
+	decode(t, srv.do(t, "GET", "/api/admin/config", "", "Authorization", "Bearer secret"), &config)
+	if config.KeepAlive || config.IdleTimeout != "45s" || config.MaxConnsPerIP != 20 {
+		t.Errorf("reported config = %+v, want keep-alive off, 45s and 20", config)
+	}
+}
+
+func TestCodeLengthsHistogram(t *testing.T) {
+	srv := newTestServer(t)
+	var resp CodeLengthsResponse
+	decode(t, srv.do(t, "GET", "/api/store/code-lengths", ""), &resp)
+	if resp.Total != 0 || resp.Lengths == nil || len(resp.Lengths) != 0 {
+		t.Errorf("empty store = %+v, want no lengths as an empty list", resp)
+	}
+
+	for i := 0; i < 3; i++ {
+		srv.shorten(t, fmt.Sprintf(`{"url": "https://example.com/%d"}`, i))
+	}
+	for _, alias := range []string{"abc", "xyz", "spring-sale"} {
+		srv.shorten(t, `{"url": "https://example.com/", "custom_code": "`+alias+`"}`)
+	}
+	deleted := srv.shorten(t, `{"url": "https://example.com/gone", "custom_code": "gone-soon-xx"}`)
+	srv.store.Delete(deleted.ShortCode)
+
+	resp = CodeLengthsResponse{}
+	decode(t, srv.do(t, "GET", "/api/store/code-lengths", ""), &resp)
+	want := CodeLengthsResponse{Total: 6, Lengths: []CodeLengthCount{{Length: 3, Count: 2}, {Length: defaultCodeLength, Count: 3}, {Length: 11, Count: 1}}}
+	if !reflect.DeepEqual(resp, want) {
+		t.Errorf("code lengths = %+v, want %+v", resp, want)
+	}
+}
+
+func TestShortenQuotaHeadersCountDownAndReset(t *testing.T) {
+	srv := newTestServer(t, "SHORTEN_RATE_LIMIT", "3", "SHORTEN_RATE_WINDOW", "1s")
+	shorten := func() *http.Response {
+		return srv.do(t, "POST", "/api/shorten", `{"url": "https://example.com/"}`)
+	}
+
+	for _, want := range []string{"2", "1", "0"} {
+		resp := shorten()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+		}
+		if limit, remaining := resp.Header.Get("X-RateLimit-Limit"), resp.Header.Get("X-RateLimit-Remaining"); limit != "3" || remaining != want {
+			t.Errorf("quota = %s remaining of %s, want %s of 3", remaining, limit, want)
+		}
+		if reset, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Reset")); err != nil || reset < 0 || reset > 1 {
+			t.Errorf("X-RateLimit-Reset = %q, want at most the 1s window", resp.Header.Get("X-RateLimit-Reset"))
+		}
+	}
+	resp := shorten()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("X-RateLimit-Remaining") != "0" || resp.Header.Get("X-RateLimit-Limit") != "3" {
+		t.Errorf("over quota: status = %d, remaining %q of %q; want 429 with 0 of 3", resp.StatusCode, resp.Header.Get("X-RateLimit-Remaining"), resp.Header.Get("X-RateLimit-Limit"))
+	}
+
+	// The limiter's clock ticks in whole seconds, so the window ends within about two
+	deadline := time.Now().Add(3 * time.Second)
+	for resp.StatusCode == http.StatusTooManyRequests && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		resp = shorten()
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-RateLimit-Remaining") != "2" {
+		t.Errorf("after the window: status = %d, remaining %q; want 200 with a fresh quota of 2", resp.StatusCode, resp.Header.Get("X-RateLimit-Remaining"))
+	}
+}
+
+func TestHistoryDoesNotRevealDestinations(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN", "secret")
+	link := srv.shorten(t, `{"url": "https://example.com/private-old", "password": "hunter2"}`)
+	resp := srv.do(t, "PUT", "/api/urls/"+link.ShortCode, `{"url": "https://example.com/private-new"}`, "Authorization", "Bearer secret")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	resp = srv.do(t, "GET", "/api/info/"+link.ShortCode+"/history", "")
+	body, _ := io.ReadAll(resp.Body)
+	if strings.Contains(string(body), "private-") {
+		t.Errorf("history of a protected link reveals a destination: %s", body)
+	}
+	var history LinkHistoryResponse
+	if err := json.Unmarshal(body, &history); err != nil {
+		t.Fatalf("decoding history: %v", err)
+	}
+	if n := len(history.Events); n != 2 || history.Events[1].Type != eventUpdated || history.Events[1].Detail != "destination changed" {
+		t.Errorf("history = %+v, want created then a destination change", history.Events)
+	}
+}
+
+func TestDeleteByFilterPreviewsThenDeletes(t *testing.T) {
+	srv := newTestServer(t, "ADMIN_TOKEN", "secret")
+	now := time.Date(2026, 6, 10, 12, 0, 0, 0, time.UTC)
+	srv.store.SetClock(func() time.Time { return now })
+	admin := []string{"Authorization", "Bearer secret"}
+
+	now = now.Add(-40 * 24 * time.Hour)
+	oldUnused := srv.shorten(t, `{"url": "https://www.old.example/a", "tags": ["promo"]}`)
+	oldClicked := srv.shorten(t, `{"url": "https://old.example/b", "tags": ["promo"]}`)
+	oldOtherSite := srv.shorten(t, `{"url": "https://example.org/c"}`)
+	now = now.Add(40 * 24 * time.Hour)
+	recent := srv.shorten(t, `{"url": "https://old.example/d"}`)
+	srv.do(t, "GET", "/"+oldClicked.ShortCode, "")
+	srv.settleClicks(t)
+
+	deleteBy := func(body string) (int, DeleteByFilterResponse) {
+		t.Helper()
+		resp := srv.do(t, "POST", "/api/urls/delete-by-filter", body, admin...)
+		var result DeleteByFilterResponse
+		if resp.StatusCode == http.StatusOK {
+			decode(t, resp, &result)
+		}
+		return resp.StatusCode, result
+	}
+
+	// A dry run only counts
+	filter := `"older_than": "30d", "zero_clicks": true, "domain": "old.example"`
+	if status, result := deleteBy(`{` + filter + `, "dry_run": true}`); status != http.StatusOK || result != (DeleteByFilterResponse{Matched: 1, DryRun: true}) {
+		t.Errorf("dry run = %d %+v, want 1 matched and none deleted", status, result)
+	}
+	if count := srv.store.Count(); count != 4 {
+		t.Fatalf("Count() after a dry run = %d, want 4", count)
+	}
+
+	if status, result := deleteBy(`{` + filter + `, "confirm": true}`); status != http.StatusOK || result != (DeleteByFilterResponse{Matched: 1, Deleted: 1}) {
+		t.Errorf("delete = %d %+v, want 1 matched and deleted", status, result)
+	}
+	if _, found := srv.store.Get(oldUnused.ShortCode); found {
+		t.Errorf("%s still found after deletion", oldUnused.ShortCode)
+	}
+	if status, result := deleteBy(`{"tag": "promo", "confirm": true}`); status != http.StatusOK || result.Deleted != 1 {
+		t.Errorf("delete by tag = %d %+v, want the remaining promo link deleted", status, result)
+	}
+	if got := srv.listCodes(t, "/api/urls"); !reflect.DeepEqual(got, []string{recent.ShortCode, oldOtherSite.ShortCode}) {
+		t.Errorf("remaining links = %v, want %s and %s", got, recent.ShortCode, oldOtherSite.ShortCode)
+	}
+	if count := srv.store.Count(); count != 2 {
+		t.Errorf("Count() = %d, want 2", count)
+	}
+
+	// Deleting needs the confirm guard and at least one criterion
+	for _, body := range []string{`{"tag": "promo"}`, `{"confirm": true}`, `{"older_than": "soon", "confirm": true}`} {
+		if status, _ := deleteBy(body); status != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", body, status, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestLinkIDsHonorConfiguredLength(t *testing.T) {
+	srv := newTestServer(t)
+	short := srv.shorten(t, `{"url": "https://example.com/a"}`)
+	if len(short.ID) != 10 {
+		t.Errorf("default ID %q, want 10 characters", short.ID)
+	}
+
+	srv = newTestServer(t, "URL_ID_LENGTH", "24")
+	long := srv.shorten(t, `{"url": "https://example.com/b"}`)
+	if len(long.ID) != 24 {
+		t.Errorf("ID %q, want 24 characters", long.ID)
+	}
+	// IDs of either length are found, e.g. links created before the change
+	if err := srv.store.Add("before", &URL{ID: "abcdefghij", ShortCode: "before", OriginalURL: "https://example.com/c", CreatedAt: time.Now()}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	for _, id := range []string{long.ID, "abcdefghij"} {
+		if resp := srv.do(t, "GET", "/api/by-id/"+id, ""); resp.StatusCode != http.StatusOK {
+			t.Errorf("by-id %s: status = %d, want %d", id, resp.StatusCode, http.StatusOK)
+		}
+	}
+}
+
+func TestSoftDeletedLinksIgnoreClicksAndWaitForPurge(t *testing.T) {
+	now := time.Date(2026, 6, 10, 12, 0, 0, 0, time.UTC)
+	store := NewURLStore()
+	store.SetClock(func() time.Time { return now })
+
+	link := newShortURL(&CreateURLRequest{URL: "https://example.com/a"}, now)
+	if err := store.Add("link01", link); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	store.RecordClick(Click{ShortCode: "link01", At: now})
+	store.Delete("link01")
+
+	// A click queued before the delete lands afterwards
+	if store.RecordClick(Click{ShortCode: "link01", At: now}) {
+		t.Error("RecordClick counted a click on a soft-deleted link")
+	}
+	if link.AccessCount != 1 || store.TotalClicks() != 0 {
+		t.Errorf("after a late click: AccessCount = %d, TotalClicks = %d; want 1 and 0", link.AccessCount, store.TotalClicks())
+	}
+	store.Restore("link01")
+	if store.TotalClicks() != 1 {
+		t.Errorf("TotalClicks after restore = %d, want 1", store.TotalClicks())
+	}
+
+	// An expired link in the recycle bin stays restorable until it is purged
+	expiring := newShortURL(&CreateURLRequest{URL: "https://example.com/b", ExpiresIn: 60}, now)
+	if err := store.Add("link02", expiring); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	store.Delete("link02")
+	now = now.Add(time.Hour)
+	if removed := store.SweepExpired(); removed != 0 {
+		t.Errorf("SweepExpired removed %d links, want the soft-deleted one left for the purge", removed)
+	}
+	if deleted := store.ListDeleted(); len(deleted) != 1 || deleted[0] != expiring {
+		t.Errorf("ListDeleted() = %v, want link02", deleted)
+	}
+	if removed := store.PurgeDeleted(30 * time.Minute); removed != 1 {
+		t.Errorf("PurgeDeleted removed %d links, want 1", removed)
+	}
+	if store.Count() != 1 || store.TotalClicks() != 1 {
+		t.Errorf("after the purge: %d links with %d clicks, want 1 with 1", store.Count(), store.TotalClicks())
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics tracks request counters for the /metrics endpoint. The counters
+// the server reads back itself (for throughput and load shedding) are kept
+// as atomics and exported through function collectors.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	inFlight atomic.Int64
+	latency  atomic.Int64 // Moving average of request latency, in nanoseconds
+
+	total           prometheus.Counter
+	byRoute         *prometheus.CounterVec // Labelled by method and route, bounded by the registered routes
+	shortens        atomic.Int64           // Successful POST /api/shorten
+	redirects       atomic.Int64           // Short codes resolved, including JSON mode lookups
+	notFound        prometheus.Counter     // Responses with status 404, on any route
+	redirectLatency prometheus.Histogram
+
+	samplesMu  sync.Mutex
+	samples    []counterSample // Ring of readings taken by SampleThroughput
+	nextSample int
+}
+
+// counterSample is a reading of the redirect and shorten counters
+type counterSample struct {
+	at                  time.Time
+	redirects, shortens int64
+}
+
+// redirectLatencyBuckets are the upper bounds, in seconds, of the redirect latency histogram
+var redirectLatencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25}
+
+// latencySmoothing is the weight (1/n) of each new sample in the latency average
+const latencySmoothing = 8
+
+// NewMetrics creates an empty set of request metrics, registered along with
+// the store's size and the Go runtime and process collectors
+func NewMetrics(store *URLStore) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		total: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "url_shortener_requests_total",
+			Help: "Requests served.",
+		}),
+		byRoute: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "url_shortener_route_requests_total",
+			Help: "Requests served per route.",
+		}, []string{"method", "route"}),
+		notFound: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "url_shortener_not_found_total",
+			Help: "Responses with status 404.",
+		}),
+		redirectLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "url_shortener_redirect_latency_seconds",
+			Help:    "Time to serve a redirect.",
+			Buckets: redirectLatencyBuckets,
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.total,
+		m.byRoute,
+		m.notFound,
+		m.redirectLatency,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "url_shortener_requests_in_flight",
+			Help: "Requests currently being handled.",
+		}, func() float64 { return float64(m.inFlight.Load()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "url_shortener_request_latency_seconds",
+			Help: "Moving average of request latency.",
+		}, func() float64 { return time.Duration(m.latency.Load()).Seconds() }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "url_shortener_shortens_total",
+			Help: "Links created through /api/shorten.",
+		}, func() float64 { return float64(m.shortens.Load()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "url_shortener_redirects_total",
+			Help: "Short codes resolved to a destination.",
+		}, func() float64 { return float64(m.redirects.Load()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "url_shortener_urls",
+			Help: "Links in the store.",
+		}, func() float64 { return float64(store.Count()) }),
+		// A gauge rather than a counter, deleting or sweeping links removes their clicks
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "url_shortener_clicks",
+			Help: "Clicks recorded across the links in the store.",
+		}, func() float64 { return float64(store.TotalClicks()) }),
+	)
+	return m
+}
+
+// Handler serves the registered metrics in the Prometheus exposition format
+func (m *Metrics) Handler() fiber.Handler {
+	return adaptor.HTTPHandler(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
+
+// Middleware counts every request, keeping the in-flight gauge accurate even
+// when a handler returns an error or panics
+func (m *Metrics) Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		m.inFlight.Add(1)
+		defer m.inFlight.Add(-1)
+
+		start := time.Now()
+		err := c.Next()
+		elapsed := time.Since(start)
+		m.observeLatency(elapsed)
+
+		m.total.Inc()
+		// Requests no route matched end on the "/" middleware route; label
+		// them separately instead of crediting the index page
+		route := c.Route().Path
+		if route == "/" && c.Path() != "/" {
+			route = "unmatched"
+		}
+
+		// Errors returned by handlers (including unmatched routes) are written
+		// by the error handler after this, take the status from the error
+		status := c.Response().StatusCode()
+		var fiberErr *fiber.Error
+		if errors.As(err, &fiberErr) {
+			status = fiberErr.Code
+		} else if err != nil {
+			status = fiber.StatusInternalServerError
+		}
+		switch {
+		case status == fiber.StatusNotFound:
+			m.notFound.Inc()
+		case route == "/:shortCode" && status < 400:
+			m.redirects.Add(1)
+			m.redirectLatency.Observe(elapsed.Seconds())
+		case route == "/api/shorten" && status < 300:
+			m.shortens.Add(1)
+		}
+
+		// The method is only valid during the request, the vector keeps its labels
+		m.byRoute.WithLabelValues(strings.Clone(c.Method()), route).Inc()
+		return err
+	}
+}
+
+// observeLatency folds a request's latency into the moving average
+func (m *Metrics) observeLatency(d time.Duration) {
+	for {
+		old := m.latency.Load()
+		updated := old + (int64(d)-old)/latencySmoothing
+		if old == 0 {
+			updated = int64(d)
+		}
+		if m.latency.CompareAndSwap(old, updated) {
+			return
+		}
+	}
+}
+
+// SampleThroughput reads the redirect and shorten counters every interval,
+// keeping enough readings to cover window, until the process exits
+func (m *Metrics) SampleThroughput(interval, window time.Duration) {
+	if interval <= 0 || window <= 0 {
+		return
+	}
+
+	m.samplesMu.Lock()
+	m.samples = make([]counterSample, 0, int(window/interval)+1)
+	m.samplesMu.Unlock()
+	m.sample()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.sample()
+	}
+}
+
+// sample records the current counters, replacing the oldest reading once the
+// ring is full
+func (m *Metrics) sample() {
+	reading := counterSample{at: time.Now(), redirects: m.redirects.Load(), shortens: m.shortens.Load()}
+
+	m.samplesMu.Lock()
+	defer m.samplesMu.Unlock()
+	if len(m.samples) < cap(m.samples) {
+		m.samples = append(m.samples, reading)
+		return
+	}
+	m.samples[m.nextSample] = reading
+	m.nextSample = (m.nextSample + 1) % len(m.samples)
+}
+
+// Throughput returns redirects and shortens per second since the oldest
+// reading in the window, and the span that covers. Rates are zero until the
+// sampler has taken its first reading.
+func (m *Metrics) Throughput() (redirects, shortens float64, span time.Duration) {
+	m.samplesMu.Lock()
+	if len(m.samples) == 0 {
+		m.samplesMu.Unlock()
+		return 0, 0, 0
+	}
+	oldest := m.samples[m.nextSample]
+	m.samplesMu.Unlock()
+
+	span = time.Since(oldest.at)
+	if span <= 0 {
+		return 0, 0, 0
+	}
+	seconds := span.Seconds()
+	redirects = float64(m.redirects.Load()-oldest.redirects) / seconds
+	shortens = float64(m.shortens.Load()-oldest.shortens) / seconds
+	return redirects, shortens, span
+}
+
+// InFlight returns the number of requests currently being handled
+func (m *Metrics) InFlight() int64 {
+	return m.inFlight.Load()
+}
+
+// EstimatedWait approximates how long a new request would take to be served:
+// the in-flight requests times the average latency, spread across the CPUs
+func (m *Metrics) EstimatedWait() time.Duration {
+	return time.Duration(m.inFlight.Load() * m.latency.Load() / int64(runtime.GOMAXPROCS(0)))
+}
+
+// ShedOverBudget rejects API requests with 503 while the estimated wait is
+// over budget, so overload can't push every response past it. Redirects,
+// probes and metrics are never shed. Must run after Middleware.
+func (m *Metrics) ShedOverBudget(budget time.Duration) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !strings.HasPrefix(c.Path(), "/api/") {
+			return c.Next()
+		}
+		if wait := m.EstimatedWait(); wait > budget {
+			SetRetryAfter(c, wait)
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "Server is overloaded, try again later"})
+		}
+		return c.Next()
+	}
+}
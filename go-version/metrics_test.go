@@ -0,0 +1,187 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	metrics := NewMetrics(NewURLStore())
+	app := fiber.New()
+	app.Use(metrics.Middleware())
+	app.Get("/metrics", metrics.Handler())
+	app.Get("/:shortCode", func(c *fiber.Ctx) error {
+		return c.Redirect("https://example.com/", fiber.StatusMovedPermanently)
+	})
+
+	for _, path := range []string{"/abc", "/def", "/metrics"} {
+		if _, err := app.Test(httptest.NewRequest("GET", path, nil)); err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+	}
+	resp, err := app.Test(httptest.NewRequest("GET", "/metrics", nil))
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	for _, want := range []string{
+		"url_shortener_redirects_total 2",
+		`url_shortener_route_requests_total{method="GET",route="/:shortCode"} 2`,
+		"url_shortener_redirect_latency_seconds_count 2",
+		"url_shortener_urls 0",
+		"go_goroutines ",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics are missing %q", want)
+		}
+	}
+}
+
+func TestInFlightGaugeReturnsToZero(t *testing.T) {
+	metrics := NewMetrics(NewURLStore())
+	app := fiber.New()
+	app.Use(metrics.Middleware())
+	app.Get("/metrics", metrics.Handler())
+	release := make(chan struct{})
+	app.Get("/slow", func(c *fiber.Ctx) error {
+		<-release
+		return c.SendString("ok")
+	})
+	app.Get("/failing", func(c *fiber.Ctx) error {
+		<-release
+		return fiber.NewError(fiber.StatusBadGateway, "upstream failed")
+	})
+
+	const concurrent = 6
+	var wg sync.WaitGroup
+	for i := 0; i < concurrent; i++ {
+		path := "/slow"
+		if i%2 == 1 {
+			path = "/failing"
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := app.Test(httptest.NewRequest("GET", path, nil), -1); err != nil {
+				t.Errorf("GET %s: %v", path, err)
+			}
+		}()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for metrics.InFlight() != concurrent {
+		if time.Now().After(deadline) {
+			t.Fatalf("in flight = %d, want %d", metrics.InFlight(), concurrent)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if got := metrics.InFlight(); got != 0 {
+		t.Errorf("in flight after the requests finished = %d, want 0", got)
+	}
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/metrics", nil))
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	// The scrape itself is in flight while the gauge is read
+	for _, want := range []string{"url_shortener_requests_in_flight 1", "url_shortener_requests_total 6"} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics are missing %q", want)
+		}
+	}
+}
+
+func TestShedOverBudgetKeepsRedirects(t *testing.T) {
+	metrics := NewMetrics(NewURLStore())
+	app := fiber.New()
+	app.Use(metrics.Middleware())
+	app.Use(metrics.ShedOverBudget(100 * time.Millisecond))
+	app.Get("/api/urls", func(c *fiber.Ctx) error {
+		return c.SendString("[]")
+	})
+	app.Get("/:shortCode", func(c *fiber.Ctx) error {
+		return c.Redirect("https://example.com/", fiber.StatusMovedPermanently)
+	})
+	get := func(path string) *http.Response {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest("GET", path, nil))
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		return resp
+	}
+
+	if resp := get("/api/urls"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("low load: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// A second of average latency with a queue as deep as there are CPUs
+	metrics.latency.Store(int64(time.Second))
+	metrics.inFlight.Add(int64(runtime.GOMAXPROCS(0)))
+	resp := get("/api/urls")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("overloaded: status = %d, Retry-After = %q; want 503 with Retry-After", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if resp := get("/abc"); resp.StatusCode != http.StatusMovedPermanently {
+		t.Errorf("overloaded redirect: status = %d, want %d", resp.StatusCode, http.StatusMovedPermanently)
+	}
+
+	metrics.inFlight.Add(-int64(runtime.GOMAXPROCS(0)))
+	metrics.latency.Store(int64(time.Millisecond))
+	if resp := get("/api/urls"); resp.StatusCode != http.StatusOK {
+		t.Errorf("after the load drops: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestThroughputRatesFollowTraffic(t *testing.T) {
+	metrics := NewMetrics(NewURLStore())
+	app := fiber.New()
+	app.Use(metrics.Middleware())
+	app.Get("/:shortCode", func(c *fiber.Ctx) error {
+		return c.Redirect("https://example.com/", fiber.StatusMovedPermanently)
+	})
+	app.Post("/api/shorten", func(c *fiber.Ctx) error {
+		return c.SendString("{}")
+	})
+
+	if redirects, shortens, span := metrics.Throughput(); redirects != 0 || shortens != 0 || span != 0 {
+		t.Errorf("before any sample: %v redirects/s, %v shortens/s over %s; want zeros", redirects, shortens, span)
+	}
+
+	// Stand in for the sampler's reading from two seconds ago
+	metrics.samples = make([]counterSample, 0, 4)
+	metrics.samples = append(metrics.samples, counterSample{at: time.Now().Add(-2 * time.Second)})
+
+	for i := 0; i < 6; i++ {
+		if _, err := app.Test(httptest.NewRequest("GET", "/abc", nil)); err != nil {
+			t.Fatalf("GET /abc: %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := app.Test(httptest.NewRequest("POST", "/api/shorten", nil)); err != nil {
+			t.Fatalf("POST /api/shorten: %v", err)
+		}
+	}
+
+	redirects, shortens, span := metrics.Throughput()
+	if span < 2*time.Second || span > 3*time.Second {
+		t.Errorf("span = %s, want about 2s", span)
+	}
+	if redirects <= 2 || redirects > 3 {
+		t.Errorf("redirects/s = %v, want about 3", redirects)
+	}
+	if shortens <= 0.6 || shortens > 1 {
+		t.Errorf("shortens/s = %v, want about 1", shortens)
+	}
+}
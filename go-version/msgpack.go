@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// mimeApplicationMsgpack is the media type clients request MessagePack with
+const mimeApplicationMsgpack = "application/msgpack"
+
+// sendNegotiated writes v as MessagePack when the Accept header prefers it
+// and as JSON otherwise. MessagePack keys follow the json struct tags, so
+// both encodings carry the same field names.
+func sendNegotiated(c *fiber.Ctx, v interface{}) error {
+	c.Vary(fiber.HeaderAccept)
+	if c.Accepts(fiber.MIMEApplicationJSON, mimeApplicationMsgpack) != mimeApplicationMsgpack {
+		return c.JSON(v)
+	}
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderContentType, mimeApplicationMsgpack)
+	return c.Send(buf.Bytes())
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClickNonceParam is the query parameter carrying the click nonce on signed redirects
+const ClickNonceParam = "sc_nonce"
+
+// ClickSigner produces and verifies short-lived nonces proving that a click
+// went through the shortener. A nonce has the form "<code>.<unix>.<sig>",
+// where sig is an HMAC-SHA256 of "<code>.<unix>" under a shared secret.
+type ClickSigner struct {
+	secret []byte
+}
+
+// NewClickSigner creates a signer, or returns nil when no secret is configured
+func NewClickSigner(secret string) *ClickSigner {
+	if secret == "" {
+		return nil
+	}
+	return &ClickSigner{secret: []byte(secret)}
+}
+
+func (s *ClickSigner) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Nonce returns a nonce for a click on shortCode at the given time
+func (s *ClickSigner) Nonce(shortCode string, at time.Time) string {
+	payload := fmt.Sprintf("%s.%d", shortCode, at.Unix())
+	return payload + "." + s.sign(payload)
+}
+
+// Verify checks a nonce's signature and that it is no older than maxAge,
+// returning the short code it was issued for
+func (s *ClickSigner) Verify(nonce string, now time.Time, maxAge time.Duration) (string, bool) {
+	parts := strings.Split(nonce, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	shortCode, ts, sig := parts[0], parts[1], parts[2]
+
+	if !hmac.Equal([]byte(sig), []byte(s.sign(shortCode+"."+ts))) {
+		return "", false
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", false
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age < -time.Minute || age > maxAge {
+		return "", false
+	}
+	return shortCode, true
+}
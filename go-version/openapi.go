@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// schemaGenerator derives OpenAPI schemas from Go types through their json
+// tags, so the spec follows the models as they change. Named structs become
+// components referenced by name.
+type schemaGenerator struct {
+	components map[string]interface{}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schema returns the schema for t, registering any struct it refers to
+func (g *schemaGenerator) schema(t reflect.Type) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		if _, exists := g.components[t.Name()]; !exists {
+			g.components[t.Name()] = nil // Placeholder, in case the type refers to itself
+			g.components[t.Name()] = g.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// object describes a struct's JSON fields. Embedded structs without a tag
+// are flattened like encoding/json does, and fields without omitempty are
+// listed as required.
+func (g *schemaGenerator) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || (!field.IsExported() && !field.Anonymous) {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			embedded := g.object(field.Type)
+			for key, value := range embedded["properties"].(map[string]interface{}) {
+				properties[key] = value
+			}
+			if fields, ok := embedded["required"].([]string); ok {
+				required = append(required, fields...)
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = g.schema(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	object := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		object["required"] = required
+	}
+	return object
+}
+
+// jsonContent is a response or request body of the given schema
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+// errorResponse is a response with the plain {"error": "..."} body
+func errorResponse(description string) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content":     jsonContent(map[string]interface{}{"$ref": "#/components/schemas/Error"}),
+	}
+}
+
+// queryParam describes an optional query parameter
+func queryParam(name, kind, description string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":        name,
+		"in":          "query",
+		"description": description,
+		"schema":      map[string]interface{}{"type": kind},
+	}
+}
+
+// buildOpenAPISpec returns the OpenAPI 3 document for the public API, with
+// schemas generated from the request and response models
+func buildOpenAPISpec(baseURL string) ([]byte, error) {
+	g := &schemaGenerator{components: make(map[string]interface{})}
+	createURLRequest := g.schema(reflect.TypeOf(CreateURLRequest{}))
+	urlResponse := g.schema(reflect.TypeOf(URLResponse{}))
+	urlPage := g.schema(reflect.TypeOf(URLPageResponse{}))
+	analytics := g.schema(reflect.TypeOf(AnalyticsResponse{}))
+	validationError := g.schema(reflect.TypeOf(ErrorResponse{}))
+	redirectTarget := g.schema(reflect.TypeOf(RedirectTargetResponse{}))
+
+	// Every request field is optional apart from the destination
+	g.components["CreateURLRequest"].(map[string]interface{})["required"] = []string{"url"}
+	g.components["Error"] = map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"error":      map[string]interface{}{"type": "string"},
+			"request_id": map[string]interface{}{"type": "string"},
+		},
+		"required": []string{"error"},
+	}
+
+	// API_KEYS is optional, so is the key: an empty requirement allows anonymous calls
+	apiKey := []map[string][]string{{}, {"apiKey": {}}}
+
+	spec := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "URL Shortener API",
+			"version": "1.0.0",
+		},
+		"servers": []map[string]interface{}{{"url": baseURL}},
+		"paths": map[string]interface{}{
+			"/api/shorten": map[string]interface{}{
+				"post": map[string]interface{}{
+					"summary":     "Create a short URL",
+					"operationId": "shorten",
+					"security":    apiKey,
+					"parameters": []map[string]interface{}{
+						queryParam("verify", "boolean", "Check that the destination responds before creating the link"),
+					},
+					"requestBody": map[string]interface{}{
+						"required": true,
+						"content":  jsonContent(createURLRequest),
+					},
+					"responses": map[string]interface{}{
+						"200": map[string]interface{}{"description": "The new link, or the existing one for a repeated destination", "content": jsonContent(urlResponse)},
+						"400": map[string]interface{}{"description": "Validation failed", "content": jsonContent(validationError)},
+						"401": errorResponse("Missing or invalid API key"),
+						"409": errorResponse("Custom code is already taken"),
+						"422": errorResponse("Destination is unreachable (with verify)"),
+						"429": errorResponse("Too many requests"),
+						"507": errorResponse("URL limit reached"),
+					},
+				},
+			},
+			"/api/urls": map[string]interface{}{
+				"get": map[string]interface{}{
+					"summary":     "List links, newest first",
+					"operationId": "listURLs",
+					"security":    apiKey,
+					"parameters": []map[string]interface{}{
+						queryParam("owner_id", "string", "Only links of this owner"),
+						queryParam("domain", "string", "Only links whose destination is on this site"),
+						queryParam("limit", "integer", "Page size (default 50, at most 500), returns the paginated envelope"),
+						queryParam("cursor", "string", "next_cursor of the previous page"),
+						queryParam("envelope", "boolean", "Wrap the list in the paginated envelope"),
+					},
+					"responses": map[string]interface{}{
+						"200": map[string]interface{}{
+							"description": "Every link as a bare array, or a page of them in the envelope when paginated",
+							"content": jsonContent(map[string]interface{}{"oneOf": []interface{}{
+								map[string]interface{}{"type": "array", "items": urlResponse},
+								urlPage,
+							}}),
+						},
+						"400": errorResponse("Invalid limit or cursor"),
+						"401": errorResponse("Missing or invalid API key"),
+					},
+				},
+			},
+			"/api/analytics": map[string]interface{}{
+				"get": map[string]interface{}{
+					"summary":     "Totals and every link, most clicked first",
+					"operationId": "analytics",
+					"security":    apiKey,
+					"responses": map[string]interface{}{
+						"200": map[string]interface{}{"description": "Analytics, as MessagePack when preferred by Accept", "content": jsonContent(analytics)},
+						"401": errorResponse("Missing or invalid API key"),
+					},
+				},
+			},
+			"/{shortCode}": map[string]interface{}{
+				"get": map[string]interface{}{
+					"summary":     "Redirect to the link's destination",
+					"operationId": "redirect",
+					"parameters": []map[string]interface{}{
+						{"name": "shortCode", "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"}},
+						{"name": "mode", "in": "query", "description": "json returns the destination, html a page that navigates to it", "schema": map[string]interface{}{"type": "string", "enum": []string{"json", "html"}}},
+						queryParam(LinkPasswordParam, "string", "Password of a protected link"),
+						{"name": LinkPasswordHeader, "in": "header", "description": "Password of a protected link", "schema": map[string]interface{}{"type": "string"}},
+					},
+					"responses": map[string]interface{}{
+						"301": map[string]interface{}{"description": "Redirect, the status is configurable per link (302, 307 and 308 are also used)", "headers": map[string]interface{}{
+							"Location": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+						}},
+						"200": map[string]interface{}{"description": "Destination, with mode=json or Accept: application/json", "content": jsonContent(redirectTarget)},
+						"401": errorResponse("Password required or incorrect"),
+						"403": errorResponse("Destination has been blocked"),
+						"404": errorResponse("URL not found"),
+						"410": errorResponse("Expired or click limit reached"),
+					},
+				},
+			},
+		},
+		"components": map[string]interface{}{
+			"schemas": g.components,
+			"securitySchemes": map[string]interface{}{
+				"apiKey": map[string]interface{}{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+	}
+	return json.Marshal(spec)
+}
+
+// docsPage renders the OpenAPI spec with Swagger UI loaded from a CDN
+const docsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>URL Shortener API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>
+window.ui = SwaggerUIBundle({ url: "/openapi.json", dom_id: "#swagger-ui" });
+</script>
+</body>
+</html>
+`
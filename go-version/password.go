@@ -0,0 +1,80 @@
+package main
+
+import (
+	"html/template"
+	neturl "net/url"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Where a redirect to a password-protected link looks for the password
+const (
+	LinkPasswordParam  = "pw"
+	LinkPasswordHeader = "X-Link-Password"
+)
+
+// maxPasswordLength is bcrypt's input limit in bytes; longer passwords would
+// be silently truncated
+const maxPasswordLength = 72
+
+// hashPassword returns the bcrypt hash stored for a link password
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// Protected reports whether redirects need the link's password
+func (u *URL) Protected() bool {
+	return u.PasswordHash != ""
+}
+
+// CheckPassword reports whether password unlocks a protected URL
+func (u *URL) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// PublicDestination returns the web destination for API responses, empty for
+// protected links so listings don't give away what the password guards
+func (u *URL) PublicDestination() string {
+	if u.Protected() {
+		return ""
+	}
+	return u.Destination()
+}
+
+// withoutQueryParam removes a parameter from a raw query string, leaving it
+// untouched when the parameter isn't there
+func withoutQueryParam(rawQuery, param string) string {
+	values, err := neturl.ParseQuery(rawQuery)
+	if err != nil || !values.Has(param) {
+		return rawQuery
+	}
+	values.Del(param)
+	return values.Encode()
+}
+
+// passwordPageData fills in the password interstitial
+type passwordPageData struct {
+	Incorrect bool          // A password was supplied and didn't match
+	Query     neturl.Values // Other query parameters, carried through the form
+}
+
+// passwordPage asks a browser for the password of a protected link and
+// submits it back to the same short URL as ?pw=
+var passwordPage = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>Password required</title>
+</head>
+<body>
+<form method="get">
+<p>{{if .Incorrect}}Incorrect password, try again.{{else}}This link is password protected.{{end}}</p>
+{{range $name, $values := .Query}}{{range $values}}<input type="hidden" name="{{$name}}" value="{{.}}">
+{{end}}{{end}}<input type="password" name="pw" autofocus required>
+<button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`))
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// URLPersister durably stores URLs behind the in-memory store, which stays
+// the source of truth for reads
+type URLPersister interface {
+	LoadAll() ([]*URL, error)
+	LoadCodes(shortCodes []string, foldCase bool) ([]*URL, error) // Unknown codes are left out
+	LoadTop(n int) ([]*URL, error)                                // Most clicked first
+	Count() (int64, error)                                        // Stored URLs that aren't soft-deleted
+	Save(urls []*URL) error
+	Delete(shortCodes []string) error
+	Close() error
+}
+
+// LoadFrom loads every URL held by a persister and then writes changes back
+// to it; until FlushDirty runs, changes are only in memory. Rows are loaded
+// as stored, like lazily loaded ones: they were validated when created, and
+// checks tightened since must not drop existing links.
+func (s *URLStore) LoadFrom(persister URLPersister) (int, error) {
+	urls, err := persister.LoadAll()
+	if err != nil {
+		return 0, err
+	}
+	loaded := s.adopt(urls)
+	s.persister = persister
+	return loaded, nil
+}
+
+// LoadLazily writes changes back to persister like LoadFrom, but instead of
+// importing every URL up front loads each one on its first lookup. The URL
+// count is read from the persister so it covers every stored URL; listings,
+// click totals and background jobs only cover the URLs loaded so far.
+func (s *URLStore) LoadLazily(persister URLPersister) error {
+	count, err := persister.Count()
+	if err != nil {
+		return err
+	}
+	s.urlCount.Store(count)
+	s.persister = persister
+	s.lazy = true
+	return nil
+}
+
+// fetch loads URLs missing from memory from the persister, returning how many
+// were added. Holding flushMu keeps a flush from deleting rows mid-load.
+func (s *URLStore) fetch(shortCodes []string) (int, error) {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	if s.persisterClosed {
+		return 0, nil
+	}
+	urls, err := s.persister.LoadCodes(shortCodes, s.foldCase)
+	if err != nil {
+		return 0, err
+	}
+	return s.adopt(urls), nil
+}
+
+// adopt adds URLs read from the persister without queueing them to be
+// written back. URLs removed since the last flush are skipped so they can't
+// come back, as are codes already in memory.
+func (s *URLStore) adopt(urls []*URL) int {
+	added := 0
+	for _, url := range urls {
+		if _, removed := s.deleted.Load(url.ShortCode); removed {
+			continue
+		}
+		if _, taken := s.store.LoadOrStore(s.key(url.ShortCode), url); taken {
+			continue
+		}
+		switch {
+		case url.Deleted():
+		case s.lazy:
+			s.indexCounted(url.ShortCode, url) // Counted by LoadLazily
+		default:
+			s.indexLive(url.ShortCode, url)
+		}
+		added++
+	}
+	return added
+}
+
+// Warm loads short codes into memory ahead of their first lookup, returning
+// how many were loaded. Codes already in memory or unknown to the persister
+// don't count, and nothing is loaded unless URLs are loaded lazily.
+func (s *URLStore) Warm(shortCodes []string) (int, error) {
+	if !s.lazy {
+		return 0, nil
+	}
+	var missing []string
+	for _, code := range shortCodes {
+		if _, resident := s.store.Load(s.key(code)); !resident {
+			missing = append(missing, code)
+		}
+	}
+	if len(missing) == 0 {
+		return 0, nil
+	}
+	return s.fetch(missing)
+}
+
+// WarmTop loads the n most clicked URLs in the persister into memory,
+// returning how many weren't there already
+func (s *URLStore) WarmTop(n int) (int, error) {
+	if !s.lazy {
+		return 0, nil
+	}
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	if s.persisterClosed {
+		return 0, nil
+	}
+	urls, err := s.persister.LoadTop(n)
+	if err != nil {
+		return 0, err
+	}
+	return s.adopt(urls), nil
+}
+
+// markDirty queues a changed URL for the next flush
+func (s *URLStore) markDirty(url *URL) {
+	if s.persister != nil {
+		s.dirty.Store(url.ShortCode, url)
+	}
+}
+
+// forget queues a removed URL's deletion for the next flush
+func (s *URLStore) forget(url *URL) {
+	if s.persister != nil {
+		s.dirty.CompareAndDelete(url.ShortCode, url)
+		s.deleted.Store(url.ShortCode, struct{}{})
+	}
+}
+
+// Touch queues a URL changed outside the store's own methods (its expiry or
+// history) for the next flush
+func (s *URLStore) Touch(url *URL) {
+	s.markDirty(url)
+}
+
+// FlushDirty deletes URLs removed since the last flush from the persister,
+// then writes every URL changed since, returning how many were written.
+// Changes that fail to save stay queued.
+func (s *URLStore) FlushDirty() (int, error) {
+	if s.persister == nil {
+		return 0, nil
+	}
+
+	// One flush at a time, and none once the persister is closed
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	return s.flushLocked()
+}
+
+// flushLocked implements FlushDirty. Callers must hold flushMu.
+func (s *URLStore) flushLocked() (int, error) {
+	if s.persisterClosed {
+		return 0, nil
+	}
+
+	// Deletions first, so a code removed and then reused keeps the new URL
+	var codes []string
+	s.deleted.Range(func(key, value interface{}) bool {
+		s.deleted.Delete(key)
+		codes = append(codes, key.(string))
+		return true
+	})
+	if len(codes) > 0 {
+		if err := s.persister.Delete(codes); err != nil {
+			for _, code := range codes {
+				s.deleted.Store(code, struct{}{})
+			}
+			return 0, err
+		}
+	}
+
+	var urls []*URL
+	s.dirty.Range(func(key, value interface{}) bool {
+		s.dirty.Delete(key)
+		urls = append(urls, value.(*URL))
+		return true
+	})
+	if len(urls) == 0 {
+		return 0, nil
+	}
+
+	if err := s.persister.Save(urls); err != nil {
+		for _, url := range urls {
+			s.dirty.LoadOrStore(url.ShortCode, url)
+		}
+		return 0, err
+	}
+	return len(urls), nil
+}
+
+// PendingWrites returns how many changed or deleted URLs haven't been
+// flushed to the persister yet
+func (s *URLStore) PendingWrites() int {
+	if s.persister == nil {
+		return 0
+	}
+	pending := 0
+	count := func(_, _ interface{}) bool {
+		pending++
+		return true
+	}
+	s.dirty.Range(count)
+	s.deleted.Range(count)
+	return pending
+}
+
+// RunPersistence periodically flushes changed URLs to the persister
+func (s *URLStore) RunPersistence(interval time.Duration) {
+	if s.persister == nil || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := s.FlushDirty(); err != nil {
+			log.Printf("Persistence: flush failed, will retry: %v", err)
+		}
+	}
+}
+
+// ClosePersistence flushes pending changes and closes the persister. Any
+// periodic flush still in progress finishes first, so it can't race the
+// final flush and find the persister closed.
+func (s *URLStore) ClosePersistence() error {
+	if s.persister == nil {
+		return nil
+	}
+
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	_, err := s.flushLocked()
+	s.persisterClosed = true
+	if closeErr := s.persister.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
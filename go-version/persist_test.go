@@ -0,0 +1,270 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePersister keeps URLs in a map and counts the reads that reach it
+type fakePersister struct {
+	mu    sync.Mutex
+	urls  map[string]*URL
+	reads int
+}
+
+func newFakePersister(urls ...*URL) *fakePersister {
+	p := &fakePersister{urls: make(map[string]*URL)}
+	for _, url := range urls {
+		p.urls[url.ShortCode] = url
+	}
+	return p
+}
+
+func (p *fakePersister) LoadAll() ([]*URL, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reads++
+	urls := make([]*URL, 0, len(p.urls))
+	for _, url := range p.urls {
+		urls = append(urls, url)
+	}
+	return urls, nil
+}
+
+func (p *fakePersister) LoadCodes(shortCodes []string, foldCase bool) ([]*URL, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reads++
+	var urls []*URL
+	for code, url := range p.urls {
+		for _, want := range shortCodes {
+			if code == want || (foldCase && strings.EqualFold(code, want)) {
+				urls = append(urls, url)
+				break
+			}
+		}
+	}
+	return urls, nil
+}
+
+func (p *fakePersister) LoadTop(n int) ([]*URL, error) {
+	urls, _ := p.LoadAll()
+	sort.Slice(urls, func(i, j int) bool {
+		return urls[i].AccessCount > urls[j].AccessCount
+	})
+	if len(urls) > n {
+		urls = urls[:n]
+	}
+	return urls, nil
+}
+
+func (p *fakePersister) Count() (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var count int64
+	for _, url := range p.urls {
+		if !url.Deleted() {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (p *fakePersister) Save(urls []*URL) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, url := range urls {
+		p.urls[url.ShortCode] = url
+	}
+	return nil
+}
+
+func (p *fakePersister) Delete(shortCodes []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, code := range shortCodes {
+		delete(p.urls, code)
+	}
+	return nil
+}
+
+func (p *fakePersister) Close() error { return nil }
+
+// Reads returns how many loads reached the persister
+func (p *fakePersister) Reads() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.reads
+}
+
+func storedURL(code, destination string, clicks int64) *URL {
+	return &URL{ID: "id-" + code, ShortCode: code, OriginalURL: destination, CreatedAt: time.Now(), AccessCount: clicks}
+}
+
+func TestWarmedCodesDontHitPersister(t *testing.T) {
+	persister := newFakePersister(
+		storedURL("warm01", "https://example.com/1", 0),
+		storedURL("warm02", "https://example.com/2", 0),
+		storedURL("cold01", "https://example.com/3", 0),
+	)
+	store := NewURLStore()
+	if err := store.LoadLazily(persister); err != nil {
+		t.Fatalf("LoadLazily: %v", err)
+	}
+
+	loaded, err := store.Warm([]string{"warm01", "warm02", "unknown"})
+	if err != nil {
+		t.Fatalf("Warm: %v", err)
+	}
+	if loaded != 2 {
+		t.Errorf("Warm loaded %d URLs, want 2", loaded)
+	}
+
+	before := persister.Reads()
+	for i := 0; i < 10; i++ {
+		for _, code := range []string{"warm01", "warm02"} {
+			if _, exists := store.Get(code); !exists {
+				t.Fatalf("Get(%q) after warming: not found", code)
+			}
+		}
+	}
+	if reads := persister.Reads() - before; reads != 0 {
+		t.Errorf("lookups of warmed codes reached the persister %d times, want 0", reads)
+	}
+
+	// A code that wasn't warmed is read through once, then served from memory
+	if _, exists := store.Get("cold01"); !exists {
+		t.Fatal("Get(cold01): not found")
+	}
+	store.Get("cold01")
+	if reads := persister.Reads() - before; reads != 1 {
+		t.Errorf("lookups of a cold code reached the persister %d times, want 1", reads)
+	}
+
+	// Warming again loads nothing new
+	if loaded, _ := store.Warm([]string{"warm01", "cold01"}); loaded != 0 {
+		t.Errorf("second Warm loaded %d URLs, want 0", loaded)
+	}
+}
+
+func TestWarmTopLoadsMostClicked(t *testing.T) {
+	persister := newFakePersister(
+		storedURL("top001", "https://example.com/1", 50),
+		storedURL("top002", "https://example.com/2", 20),
+		storedURL("low001", "https://example.com/3", 1),
+	)
+	store := NewURLStore()
+	if err := store.LoadLazily(persister); err != nil {
+		t.Fatalf("LoadLazily: %v", err)
+	}
+
+	loaded, err := store.WarmTop(2)
+	if err != nil {
+		t.Fatalf("WarmTop: %v", err)
+	}
+	if loaded != 2 {
+		t.Errorf("WarmTop loaded %d URLs, want 2", loaded)
+	}
+	// Every stored URL was counted up front, clicks only once loaded
+	if store.Count() != 3 || store.TotalClicks() != 70 {
+		t.Errorf("after WarmTop: %d URLs with %d clicks, want 3 with 70", store.Count(), store.TotalClicks())
+	}
+
+	before := persister.Reads()
+	store.Get("top001")
+	store.Get("top002")
+	if reads := persister.Reads() - before; reads != 0 {
+		t.Errorf("lookups of warmed codes reached the persister %d times, want 0", reads)
+	}
+}
+
+func TestLazyStoreDoesNotReuseStoredCodes(t *testing.T) {
+	persister := newFakePersister(storedURL("taken1", "https://example.com/old", 0))
+	store := NewURLStore()
+	if err := store.LoadLazily(persister); err != nil {
+		t.Fatalf("LoadLazily: %v", err)
+	}
+
+	if imported, _ := store.Import([]*URL{storedURL("taken1", "https://example.com/new", 0)}); imported != 0 {
+		t.Fatal("Import reused a code only present in the persister")
+	}
+	url, _ := store.Get("taken1")
+	if url.OriginalURL != "https://example.com/old" {
+		t.Errorf("taken1 points to %q, want the stored destination", url.OriginalURL)
+	}
+}
+
+func TestLazySuggestionsDontHitPersister(t *testing.T) {
+	check, _ := luhnCheckChar("abcdef", shortCodeAlphabet)
+	code := "abcdef" + string(check)
+	persister := newFakePersister(storedURL(code, "https://example.com/", 0))
+	store := NewURLStore()
+	store.SetChecksum(true)
+	if err := store.LoadLazily(persister); err != nil {
+		t.Fatalf("LoadLazily: %v", err)
+	}
+
+	typo := "bbcdef" + string(check)
+	if suggestions := store.SuggestCodes(typo); len(suggestions) != 0 || persister.Reads() != 0 {
+		t.Errorf("before loading: suggested %v with %d persister reads, want none", suggestions, persister.Reads())
+	}
+	store.Get(code)
+	if suggestions := store.SuggestCodes(typo); len(suggestions) != 1 || suggestions[0] != code {
+		t.Errorf("after loading: suggested %v, want [%s]", suggestions, code)
+	}
+}
+
+func TestLoadFromKeepsStoredRows(t *testing.T) {
+	// A destination current validation refuses still loads under its code
+	persister := newFakePersister(storedURL("good", "https://example.com/ok", 0), storedURL("bad", "javascript:alert(1)", 0))
+	store := NewURLStore()
+	loaded, err := store.LoadFrom(persister)
+	if err != nil || loaded != 2 {
+		t.Fatalf("LoadFrom = %d, %v; want 2 URLs loaded", loaded, err)
+	}
+	if url, ok := store.Get("bad"); !ok || url.OriginalURL != "javascript:alert(1)" {
+		t.Errorf("stored row \"bad\" wasn't loaded as stored")
+	}
+	if pending := store.PendingWrites(); pending != 0 {
+		t.Errorf("loading queued %d writes, want none", pending)
+	}
+}
+
+func TestLazyCountCoversStoredURLs(t *testing.T) {
+	deleted := storedURL("gone01", "https://example.com/gone", 0)
+	deletedAt := time.Now()
+	deleted.DeletedAt = &deletedAt
+	persister := newFakePersister(
+		storedURL("keep01", "https://example.com/1", 5),
+		storedURL("keep02", "https://example.com/2", 0),
+		deleted,
+	)
+	store := NewURLStore()
+	if err := store.LoadLazily(persister); err != nil {
+		t.Fatalf("LoadLazily: %v", err)
+	}
+	if count := store.Count(); count != 2 {
+		t.Fatalf("Count() before any lookup = %d, want the 2 live stored URLs", count)
+	}
+
+	// Loading a counted URL doesn't count it again, new and removed ones do
+	store.Get("keep01")
+	store.Get("gone01")
+	if count := store.Count(); count != 2 {
+		t.Errorf("Count() after loading = %d, want 2", count)
+	}
+	if err := store.InsertRandom(storedURL("", "https://example.com/new", 0)); err != nil {
+		t.Fatalf("InsertRandom: %v", err)
+	}
+	store.Delete("keep01")
+	if count := store.Count(); count != 2 {
+		t.Errorf("Count() after an insert and a delete = %d, want 2", count)
+	}
+	store.Reindex()
+	if count := store.Count(); count != 2 {
+		t.Errorf("Count() after Reindex = %d, want 2", count)
+	}
+}
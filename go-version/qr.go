@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// QR image sizes in pixels
+const (
+	defaultQRSize = 256
+	minQRSize     = 64
+	maxQRSize     = 1024
+)
+
+// QR SVG module sizes in user units
+const (
+	defaultQRModuleSize = 10
+	maxQRModuleSize     = 100
+)
+
+// errRangeNotSatisfiable is returned for ranges entirely past the end of the content
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// qrPNG renders content as a square PNG QR code
+func qrPNG(content string, size int) ([]byte, error) {
+	return qrcode.Encode(content, qrcode.Medium, size)
+}
+
+// qrSVG renders content as a scalable SVG QR code, including the quiet zone,
+// with each module moduleSize units wide
+func qrSVG(content string, moduleSize int) (string, error) {
+	code, err := qrcode.New(content, qrcode.Medium)
+	if err != nil {
+		return "", err
+	}
+	return renderQRSVG(code.Bitmap(), moduleSize), nil
+}
+
+// renderQRSVG draws a QR bitmap as SVG. Dark modules are drawn as one path.
+func renderQRSVG(bitmap [][]bool, moduleSize int) string {
+	size := len(bitmap) * moduleSize
+
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, size, size)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, size, size)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&b, "M%d %dh%dv%dh-%dz", x*moduleSize, y*moduleSize, moduleSize, moduleSize, moduleSize)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.String()
+}
+
+// parseByteRange parses a single "bytes=start-end" Range header against
+// content of the given length, returning the inclusive byte range to serve.
+// ok is false when the whole content should be sent instead, which is how
+// malformed and multi-range requests are answered.
+func parseByteRange(header string, length int) (start, end int, ok bool, err error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, nil
+	}
+
+	if first == "" {
+		// Suffix range, the final n bytes
+		n, err := strconv.Atoi(last)
+		if err != nil || n < 0 {
+			return 0, 0, false, nil
+		}
+		if n == 0 || length == 0 {
+			return 0, 0, false, errRangeNotSatisfiable
+		}
+		return max(length-n, 0), length - 1, true, nil
+	}
+
+	start, err = strconv.Atoi(first)
+	if err != nil || start < 0 {
+		return 0, 0, false, nil
+	}
+	end = length - 1
+	if last != "" {
+		if end, err = strconv.Atoi(last); err != nil || end < start {
+			return 0, 0, false, nil
+		}
+	}
+	if start >= length {
+		return 0, 0, false, errRangeNotSatisfiable
+	}
+	return start, min(end, length-1), true, nil
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SnapshotFormat selects the on-disk encoding used by SaveToFile
+type SnapshotFormat string
+
+const (
+	SnapshotJSON SnapshotFormat = "json"
+	SnapshotGob  SnapshotFormat = "gob"
+)
+
+// gobSnapshotMagic prefixes gob snapshots so LoadFromFile can tell them
+// apart from JSON ones, which always start with '['
+var gobSnapshotMagic = []byte("URLSNAP\x00gob1")
+
+// ParseSnapshotFormat validates a SNAPSHOT_FORMAT value
+func ParseSnapshotFormat(value string) (SnapshotFormat, error) {
+	switch SnapshotFormat(strings.ToLower(value)) {
+	case "", SnapshotJSON:
+		return SnapshotJSON, nil
+	case SnapshotGob:
+		return SnapshotGob, nil
+	default:
+		return "", fmt.Errorf("must be %q or %q", SnapshotJSON, SnapshotGob)
+	}
+}
+
+// snapshotURL copies a URL, reading counters atomically since redirects
+// may be updating them while the snapshot is taken
+func snapshotURL(u *URL) *URL {
+	cp := &URL{
+		ID:             u.ID,
+		OriginalURL:    u.Destination(),
+		ShortCode:      u.ShortCode,
+		CreatedAt:      u.CreatedAt,
+		AccessCount:    atomic.LoadInt64(&u.AccessCount),
+		IOSURL:         u.IOSURL,
+		AndroidURL:     u.AndroidURL,
+		OwnerID:        u.Owner(),
+		QueryRules:     u.QueryRules,
+		RedirectStatus: u.RedirectStatus,
+		CreatedByIP:    u.CreatedByIP,
+		SignClicks:     u.SignClicks,
+		ExpiresAt:      u.Expiry(),
+		PreviewHits:    atomic.LoadInt64(&u.PreviewHits),
+		MaxClicks:      u.MaxClicks,
+		ClaimedClicks:  atomic.LoadInt64(&u.ClaimedClicks),
+		PasswordHash:   u.PasswordHash,
+		Campaign:       u.Campaign,
+		ForwardQuery:   u.ForwardQuery,
+		Tags:           u.Tags,
+		DeletedAt:      u.DeletionTime(),
+		History:        u.LifecycleHistory(),
+	}
+	for i := range cp.HourlyClicks {
+		cp.HourlyClicks[i] = atomic.LoadInt64(&u.HourlyClicks[i])
+	}
+
+	u.statsMu.Lock()
+	if len(u.DailyClicks) > 0 {
+		cp.DailyClicks = make(map[string]int64, len(u.DailyClicks))
+		for day, clicks := range u.DailyClicks {
+			cp.DailyClicks[day] = clicks
+		}
+	}
+	if len(u.Referrers) > 0 {
+		cp.Referrers = make(map[string]int64, len(u.Referrers))
+		for host, clicks := range u.Referrers {
+			cp.Referrers[host] = clicks
+		}
+	}
+	if len(u.UserAgents) > 0 {
+		cp.UserAgents = make(map[string]int64, len(u.UserAgents))
+		for agent, clicks := range u.UserAgents {
+			cp.UserAgents[agent] = clicks
+		}
+	}
+	if len(u.MinuteClicks) > 0 {
+		cp.MinuteClicks = make(map[int64]int64, len(u.MinuteClicks))
+		for minute, clicks := range u.MinuteClicks {
+			cp.MinuteClicks[minute] = clicks
+		}
+	}
+	u.statsMu.Unlock()
+	return cp
+}
+
+// SaveToFile writes every URL to path in the given format. The snapshot is
+// written to a temporary file and renamed into place so a crash mid-write
+// never leaves a truncated snapshot behind.
+func (s *URLStore) SaveToFile(path string, format SnapshotFormat) error {
+	urls := s.all(true) // Soft-deleted URLs are kept until purged
+	snapshot := make([]*URL, 0, len(urls))
+	for _, url := range urls {
+		snapshot = append(snapshot, snapshotURL(url))
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	w := bufio.NewWriter(tmp)
+	switch format {
+	case SnapshotGob:
+		if _, err = w.Write(gobSnapshotMagic); err == nil {
+			err = gob.NewEncoder(w).Encode(snapshot)
+		}
+	default:
+		err = json.NewEncoder(w).Encode(snapshot)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// snapshotRetryBackoff is the wait before the first retry of a failed
+// shutdown snapshot, doubled after each further failure
+const snapshotRetryBackoff = 200 * time.Millisecond
+
+// SaveSnapshot writes the shutdown snapshot to path, retrying up to retries
+// times with exponential backoff. If every attempt fails it is written to
+// fallback instead, so a transient problem with the primary location doesn't
+// lose the data. No attempt is started once ctx is done. It returns the path
+// the snapshot was written to.
+func (s *URLStore) SaveSnapshot(ctx context.Context, path, fallback string, format SnapshotFormat, retries int) (string, error) {
+	backoff := snapshotRetryBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = s.SaveToFile(path, format); err == nil {
+			return path, nil
+		}
+		if attempt == retries {
+			break
+		}
+		log.Printf("Snapshot: saving to %s failed, retrying in %s: %v", path, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		backoff *= 2
+	}
+
+	if fallback == "" || fallback == path {
+		return "", err
+	}
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("%w (fallback %s skipped: %v)", err, fallback, ctx.Err())
+	}
+	log.Printf("Snapshot: saving to %s failed, writing to fallback %s: %v", path, fallback, err)
+	if fallbackErr := s.SaveToFile(fallback, format); fallbackErr != nil {
+		return "", fmt.Errorf("%w (fallback %s: %v)", err, fallback, fallbackErr)
+	}
+	return fallback, nil
+}
+
+// LoadFromFile adds every URL in a snapshot to the store, detecting the
+// format from the file header. Entries skip the checks Import applies, since
+// rules such as the blocklist may have changed since they were saved; ones
+// that can't be stored are logged and skipped. A missing file is not an error.
+func (s *URLStore) LoadFromFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header, err := r.Peek(len(gobSnapshotMagic))
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	var snapshot []*URL
+	if bytes.Equal(header, gobSnapshotMagic) {
+		if _, err := r.Discard(len(gobSnapshotMagic)); err != nil {
+			return 0, err
+		}
+		err = gob.NewDecoder(r).Decode(&snapshot)
+	} else {
+		err = json.NewDecoder(r).Decode(&snapshot)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("decoding snapshot %s: %w", path, err)
+	}
+
+	// The store's own snapshot is trusted as written; only entries that can't
+	// be stored at all are dropped
+	imported, skipped := s.importURLs(snapshot, false)
+	for _, skip := range skipped {
+		log.Printf("Snapshot: skipping entry %d of %s: %s", skip.Index, path, skip.Err.Message)
+	}
+	return imported, nil
+}
+
+// ImportSkip is an entry Import skipped and why
+type ImportSkip struct {
+	Index int
+	Err   *ValidationError
+}
+
+// Import adds URLs in snapshot form, keeping their short codes and counters.
+// Entries that fail the checks applied to new links, or whose short code is
+// already taken, are skipped. It returns how many URLs were added and the
+// skipped entries.
+func (s *URLStore) Import(urls []*URL) (int, []ImportSkip) {
+	return s.importURLs(urls, true)
+}
+
+// importURLs implements Import. Without validate only entries missing a short
+// code are skipped, along with taken codes.
+func (s *URLStore) importURLs(urls []*URL, validate bool) (int, []ImportSkip) {
+	imported := 0
+	var skipped []ImportSkip
+	for i, url := range urls {
+		err := checkEntry(url)
+		if err == nil && validate {
+			err = s.checkImport(url)
+		}
+		if err != nil {
+			skipped = append(skipped, ImportSkip{Index: i, Err: err})
+			continue
+		}
+		if s.lazy {
+			s.load(url.ShortCode) // The code may only be taken in the persister
+		}
+		if _, taken := s.store.LoadOrStore(s.key(url.ShortCode), url); taken {
+			skipped = append(skipped, ImportSkip{Index: i, Err: &ValidationError{Field: "short_code", Message: "Short code is already taken", Reason: "taken"}})
+			continue
+		}
+		s.index(url.ShortCode, url)
+		imported++
+	}
+	return imported, skipped
+}
+
+// checkImport validates one snapshot entry like a new link: the short code
+// must have the shape of a custom code and not shadow a route, and every
+// destination must be valid and not blocked. Lengths aren't checked, since
+// generated codes may be longer than custom ones.
+func (s *URLStore) checkImport(url *URL) *ValidationError {
+	if err := checkEntry(url); err != nil {
+		return err
+	}
+	if !customCodePattern.MatchString(url.ShortCode) {
+		return &ValidationError{Field: "short_code", Message: "Short code may only contain letters, digits, '_' or '-'", Reason: "invalid alias"}
+	}
+	if isReservedCode(url.ShortCode) {
+		return &ValidationError{Field: "short_code", Message: "Short code is reserved", Reason: "reserved alias"}
+	}
+	if err := checkDestination(url.OriginalURL, s.trusted); err != nil {
+		return &ValidationError{Field: "original_url", Message: "Invalid URL provided: " + err.Error(), Reason: err.Error()}
+	}
+	if url.IOSURL != "" {
+		if err := checkDestination(url.IOSURL, s.trusted); err != nil {
+			return &ValidationError{Field: "ios_url", Message: "Invalid platform URL provided: " + err.Error(), Reason: err.Error()}
+		}
+	}
+	if url.AndroidURL != "" {
+		if err := checkDestination(url.AndroidURL, s.trusted); err != nil {
+			return &ValidationError{Field: "android_url", Message: "Invalid platform URL provided: " + err.Error(), Reason: err.Error()}
+		}
+	}
+	if err := validateQueryRules(url.QueryRules, s.trusted); err != nil {
+		return err.(*ValidationError)
+	}
+
+	if s.blocklist == nil {
+		return nil
+	}
+	type destination struct{ field, url string }
+	destinations := []destination{{"original_url", url.OriginalURL}, {"ios_url", url.IOSURL}, {"android_url", url.AndroidURL}}
+	for i, rule := range url.QueryRules {
+		destinations = append(destinations, destination{fmt.Sprintf("query_rules[%d].destination", i), rule.Destination})
+	}
+	for _, d := range destinations {
+		if d.url != "" && s.blocklist.IsBlocked(d.url) && !s.trusted.Trusts(d.url) {
+			return &ValidationError{Field: d.field, Message: "Destination host is blocked"}
+		}
+	}
+	return nil
+}
+
+// checkEntry rejects snapshot entries that can't be stored under any rules
+func checkEntry(url *URL) *ValidationError {
+	if url == nil {
+		return &ValidationError{Message: "Entry must be an object"}
+	}
+	if url.ShortCode == "" {
+		return &ValidationError{Field: "short_code", Message: "Short code is required", Reason: "missing"}
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seedSnapshotStore returns a store with n links carrying clicks, analytics
+// and optional settings, so snapshots exercise every field
+func seedSnapshotStore(t testing.TB, n int) *URLStore {
+	t.Helper()
+	now := time.Date(2026, 5, 4, 10, 0, 0, 0, time.UTC)
+	store := NewURLStore()
+	store.SetClock(func() time.Time { return now })
+	for i := 0; i < n; i++ {
+		req := &CreateURLRequest{
+			URL:        fmt.Sprintf("https://example.com/page/%d", i),
+			IOSURL:     "https://apps.apple.com/app/id1",
+			QueryRules: []QueryRule{{Param: "v", Value: "b", Destination: "https://example.com/b"}},
+			Tags:       []string{"docs"},
+			MaxClicks:  100,
+		}
+		url, _, err := store.Insert(newShortURL(req, now))
+		if err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+		for j := 0; j <= i%5; j++ {
+			store.RecordClick(Click{ShortCode: url.ShortCode, Referrer: "news.example", At: now.Add(-time.Duration(j) * time.Hour)})
+		}
+	}
+	return store
+}
+
+// snapshotState is what a round trip must preserve, keyed by short code
+func snapshotState(store *URLStore) map[string]*URL {
+	state := make(map[string]*URL)
+	for _, url := range store.all(true) {
+		cp := snapshotURL(url)
+		cp.CreatedAt = cp.CreatedAt.UTC() // JSON keeps the instant, not the location
+		state[cp.ShortCode] = cp
+	}
+	return state
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	store := seedSnapshotStore(t, 20)
+	deleted := store.GetAll()[0]
+	store.Delete(deleted.ShortCode)
+	want := snapshotState(store)
+
+	for _, format := range []SnapshotFormat{SnapshotJSON, SnapshotGob} {
+		t.Run(string(format), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "urls.snapshot")
+			if err := store.SaveToFile(path, format); err != nil {
+				t.Fatalf("SaveToFile: %v", err)
+			}
+
+			restored := NewURLStore()
+			loaded, err := restored.LoadFromFile(path) // Detects the format from the header
+			if err != nil || loaded != len(want) {
+				t.Fatalf("LoadFromFile = %d, %v; want %d URLs", loaded, err, len(want))
+			}
+			if got := snapshotState(restored); !reflect.DeepEqual(got, want) {
+				t.Errorf("restored store differs from the saved one")
+			}
+			if restored.TotalClicks() != store.TotalClicks() {
+				t.Errorf("TotalClicks() = %d, want %d", restored.TotalClicks(), store.TotalClicks())
+			}
+			if _, found := restored.Get(deleted.ShortCode); found {
+				t.Errorf("soft-deleted %s is live after restoring", deleted.ShortCode)
+			}
+		})
+	}
+}
+
+// BenchmarkSnapshotSize reports the snapshot size of each format in bytes
+func BenchmarkSnapshotSize(b *testing.B) {
+	store := seedSnapshotStore(b, 1000)
+	for _, format := range []SnapshotFormat{SnapshotJSON, SnapshotGob} {
+		b.Run(string(format), func(b *testing.B) {
+			path := filepath.Join(b.TempDir(), "urls.snapshot")
+			for i := 0; i < b.N; i++ {
+				if err := store.SaveToFile(path, format); err != nil {
+					b.Fatalf("SaveToFile: %v", err)
+				}
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				b.Fatalf("Stat: %v", err)
+			}
+			b.ReportMetric(float64(info.Size()), "bytes")
+		})
+	}
+}
+
+func TestImportAppliesShortenValidation(t *testing.T) {
+	blocklist := NewBlocklist("", []string{"blocked.example"})
+	if err := blocklist.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	store := NewURLStore()
+	store.SetBlocklist(blocklist)
+
+	tests := []struct {
+		name  string
+		url   *URL
+		field string
+	}{
+		{"invalid code", &URL{ShortCode: "a/b", OriginalURL: "https://example.com/"}, "short_code"},
+		{"reserved code", &URL{ShortCode: "API", OriginalURL: "https://example.com/"}, "short_code"},
+		{"invalid ios_url", &URL{ShortCode: "ios1", OriginalURL: "https://example.com/", IOSURL: "javascript:alert(1)"}, "ios_url"},
+		{"invalid android_url", &URL{ShortCode: "and1", OriginalURL: "https://example.com/", AndroidURL: "ftp://example.com/"}, "android_url"},
+		{"invalid rule", &URL{ShortCode: "rule1", OriginalURL: "https://example.com/", QueryRules: []QueryRule{{Param: "v", Destination: "nope"}}}, "query_rules[0].destination"},
+		{"blocked", &URL{ShortCode: "blk1", OriginalURL: "https://blocked.example/"}, "original_url"},
+		{"blocked platform", &URL{ShortCode: "blk2", OriginalURL: "https://example.com/", AndroidURL: "https://blocked.example/app"}, "android_url"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imported, skipped := store.Import([]*URL{tt.url})
+			if imported != 0 || len(skipped) != 1 {
+				t.Fatalf("Import = %d imported, %d skipped; want the entry skipped", imported, len(skipped))
+			}
+			if skipped[0].Err.Field != tt.field {
+				t.Errorf("skipped on %q (%s), want %q", skipped[0].Err.Field, skipped[0].Err.Message, tt.field)
+			}
+		})
+	}
+
+	if imported, skipped := store.Import([]*URL{{ShortCode: "ok_1", OriginalURL: "https://example.com/"}}); imported != 1 {
+		t.Errorf("valid entry skipped: %+v", skipped[0].Err)
+	}
+}
+
+func TestLoadFromFileSkipsImportValidation(t *testing.T) {
+	blocklist := NewBlocklist("", []string{"blocked.example"})
+	if err := blocklist.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	saved := NewURLStore()
+	for _, url := range []*URL{
+		{ShortCode: "blk1", OriginalURL: "https://blocked.example/"},
+		{ShortCode: "app1", OriginalURL: "https://example.com/", IOSURL: "myapp://open"}, // Saved while myapp was trusted
+		{ShortCode: "taken", OriginalURL: "https://example.com/saved"},
+	} {
+		saved.Add(url.ShortCode, url)
+	}
+	path := filepath.Join(t.TempDir(), "urls.snapshot")
+	if err := saved.SaveToFile(path, SnapshotJSON); err != nil {
+		t.Fatalf("SaveToFile: %v", err)
+	}
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	restored := NewURLStore()
+	restored.SetBlocklist(blocklist)
+	if err := restored.Add("taken", &URL{ShortCode: "taken", OriginalURL: "https://example.com/live"}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	loaded, err := restored.LoadFromFile(path)
+	if err != nil || loaded != 2 {
+		t.Fatalf("LoadFromFile = %d, %v; want 2 URLs loaded", loaded, err)
+	}
+	for _, code := range []string{"blk1", "app1"} {
+		if _, found := restored.Get(code); !found {
+			t.Errorf("%s was dropped from the store's own snapshot", code)
+		}
+	}
+	if !strings.Contains(logged.String(), "already taken") {
+		t.Errorf("entry with a taken code not logged, log: %q", logged.String())
+	}
+}
+
+func TestSaveSnapshotFallsBackWhenPrimaryFails(t *testing.T) {
+	store := seedSnapshotStore(t, 3)
+	dir := t.TempDir()
+	primary := filepath.Join(dir, "missing", "urls.snapshot") // Its directory doesn't exist
+	fallback := filepath.Join(dir, "fallback.snapshot")
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	saved, err := store.SaveSnapshot(context.Background(), primary, fallback, SnapshotJSON, 0)
+	if err != nil || saved != fallback {
+		t.Fatalf("SaveSnapshot = %q, %v; want it written to the fallback", saved, err)
+	}
+	if !strings.Contains(logged.String(), "writing to fallback") {
+		t.Errorf("fallback not logged, log: %q", logged.String())
+	}
+	restored := NewURLStore()
+	if loaded, err := restored.LoadFromFile(fallback); err != nil || loaded != 3 {
+		t.Errorf("LoadFromFile(fallback) = %d, %v; want 3 URLs", loaded, err)
+	}
+
+	// Both locations failing reports both errors
+	_, err = store.SaveSnapshot(context.Background(), primary, filepath.Join(dir, "missing", "fallback.snapshot"), SnapshotJSON, 0)
+	if err == nil || !strings.Contains(err.Error(), "fallback") {
+		t.Errorf("SaveSnapshot with no writable location: err = %v, want the fallback's error too", err)
+	}
+
+	// Once the shutdown deadline has passed, neither retries nor the fallback are attempted
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	late := filepath.Join(dir, "late.snapshot")
+	start := time.Now()
+	if _, err := store.SaveSnapshot(ctx, primary, late, SnapshotJSON, 3); err == nil {
+		t.Error("SaveSnapshot after the deadline succeeded")
+	}
+	if elapsed := time.Since(start); elapsed >= snapshotRetryBackoff {
+		t.Errorf("SaveSnapshot after the deadline took %s, want no retry waits", elapsed)
+	}
+	if _, err := os.Stat(late); !os.IsNotExist(err) {
+		t.Errorf("fallback written after the deadline: %v", err)
+	}
+}
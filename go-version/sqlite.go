@@ -0,0 +1,235 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // Pure Go driver, keeps CGO_ENABLED=0 builds working
+)
+
+// sqliteSchema stores each URL as its full JSON snapshot, with the fields
+// worth querying on pulled out into columns
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS urls (
+	short_code   TEXT PRIMARY KEY,
+	id           TEXT NOT NULL,
+	original_url TEXT NOT NULL,
+	owner_id     TEXT NOT NULL DEFAULT '',
+	campaign     TEXT NOT NULL DEFAULT '',
+	created_at   TEXT NOT NULL,
+	expires_at   TEXT,
+	access_count INTEGER NOT NULL DEFAULT 0,
+	data         TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS urls_id ON urls (id);
+CREATE INDEX IF NOT EXISTS urls_owner_id ON urls (owner_id);
+`
+
+// openSQLite opens (creating if needed) a SQLite database with the URL schema
+func openSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// upsertSQLite writes URLs to the database in a single transaction
+func upsertSQLite(db *sql.DB, urls []*URL) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // No-op once committed
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO urls (short_code, id, original_url, owner_id, campaign, created_at, expires_at, access_count, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (short_code) DO UPDATE SET
+			id = excluded.id,
+			original_url = excluded.original_url,
+			owner_id = excluded.owner_id,
+			campaign = excluded.campaign,
+			created_at = excluded.created_at,
+			expires_at = excluded.expires_at,
+			access_count = excluded.access_count,
+			data = excluded.data`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, url := range urls {
+		snapshot := snapshotURL(url)
+		data, err := json.Marshal(snapshot)
+		if err != nil {
+			return err
+		}
+
+		var expiresAt *string
+		if snapshot.ExpiresAt != nil {
+			formatted := snapshot.ExpiresAt.UTC().Format(time.RFC3339Nano)
+			expiresAt = &formatted
+		}
+
+		if _, err := stmt.Exec(
+			snapshot.ShortCode,
+			snapshot.ID,
+			snapshot.OriginalURL,
+			snapshot.OwnerID,
+			snapshot.Campaign,
+			snapshot.CreatedAt.UTC().Format(time.RFC3339Nano),
+			expiresAt,
+			snapshot.AccessCount,
+			string(data),
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ExportSQLite writes every URL into a new SQLite database at path
+func (s *URLStore) ExportSQLite(path string) (int, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	urls := s.GetAll()
+	if err := upsertSQLite(db, urls); err != nil {
+		return 0, err
+	}
+	return len(urls), nil
+}
+
+// SQLiteStore persists URLs to a SQLite database
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// OpenSQLiteStore opens the database at path, creating the file and schema
+// when missing. A file that isn't a healthy SQLite database is an error.
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	db.SetMaxOpenConns(1) // Serialize writers instead of failing with SQLITE_BUSY
+
+	var result string
+	if err := db.QueryRow("PRAGMA quick_check").Scan(&result); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("checking %s: %w", path, err)
+	}
+	if result != "ok" {
+		db.Close()
+		return nil, fmt.Errorf("checking %s: database is corrupt: %s", path, result)
+	}
+	if _, err := db.Exec("PRAGMA journal_mode = WAL"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+// LoadAll reads every stored URL
+func (p *SQLiteStore) LoadAll() ([]*URL, error) {
+	return p.query("SELECT short_code, data FROM urls")
+}
+
+// LoadCodes reads the URLs stored under the given short codes, compared
+// case-insensitively with foldCase
+func (p *SQLiteStore) LoadCodes(shortCodes []string, foldCase bool) ([]*URL, error) {
+	if len(shortCodes) == 0 {
+		return nil, nil
+	}
+	column := "short_code"
+	args := make([]interface{}, len(shortCodes))
+	for i, code := range shortCodes {
+		args[i] = code
+		if foldCase {
+			args[i] = strings.ToLower(code)
+		}
+	}
+	if foldCase {
+		column = "lower(short_code)"
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(shortCodes)), ",")
+	return p.query("SELECT short_code, data FROM urls WHERE "+column+" IN ("+placeholders+")", args...)
+}
+
+// LoadTop reads the n URLs with the most clicks as of their last flush
+func (p *SQLiteStore) LoadTop(n int) ([]*URL, error) {
+	return p.query("SELECT short_code, data FROM urls ORDER BY access_count DESC, short_code LIMIT ?", n)
+}
+
+// Count returns how many stored URLs aren't soft-deleted
+func (p *SQLiteStore) Count() (int64, error) {
+	var count int64
+	err := p.db.QueryRow("SELECT COUNT(*) FROM urls WHERE json_extract(data, '$.deleted_at') IS NULL").Scan(&count)
+	return count, err
+}
+
+// query decodes the URLs selected by a (short_code, data) query
+func (p *SQLiteStore) query(query string, args ...interface{}) ([]*URL, error) {
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var urls []*URL
+	for rows.Next() {
+		var shortCode, data string
+		if err := rows.Scan(&shortCode, &data); err != nil {
+			return nil, err
+		}
+		url := new(URL)
+		if err := json.Unmarshal([]byte(data), url); err != nil {
+			return nil, fmt.Errorf("decoding URL %s: %w", shortCode, err)
+		}
+		urls = append(urls, url)
+	}
+	return urls, rows.Err()
+}
+
+// Save upserts URLs in a single transaction
+func (p *SQLiteStore) Save(urls []*URL) error {
+	return upsertSQLite(p.db, urls)
+}
+
+// Delete removes URLs by short code in a single transaction
+func (p *SQLiteStore) Delete(shortCodes []string) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // No-op once committed
+
+	stmt, err := tx.Prepare("DELETE FROM urls WHERE short_code = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, shortCode := range shortCodes {
+		if _, err := stmt.Exec(shortCode); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Close closes the database
+func (p *SQLiteStore) Close() error {
+	return p.db.Close()
+}